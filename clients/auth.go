@@ -0,0 +1,57 @@
+package clients
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+/**
+####################################################################################
+HMAC CALLER TOKEN
+sent in HEADER_AUTHORIZATION as "HMAC <caller>:<unix ts>:<signature>", the
+signature being the hex hmac-sha256 of "<caller>:<unix ts>" with the secret
+shared by the caller and the server, see middleware.OptAuth. a token can be
+replayed within the skew allowed by the server, it is only sent over tls
+*/
+
+const AUTH_SCHEME_HMAC = "HMAC"
+
+// HmacSignature returns the hex hmac-sha256 of "<caller>:<ts>" with secret
+func HmacSignature(caller string, ts int64, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%v:%v", caller, ts)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HmacToken returns the HEADER_AUTHORIZATION value of caller signed at ts
+func HmacToken(caller, secret string, ts time.Time) string {
+	unix := ts.Unix()
+	return fmt.Sprintf("%v %v:%v:%v", AUTH_SCHEME_HMAC, caller, unix, HmacSignature(caller, unix, secret))
+}
+
+type hmacCredentials struct {
+	caller string
+	secret string
+}
+
+// NewHmacCredentials signs every rpc with a fresh HMAC token of caller
+func NewHmacCredentials(caller, secret string) credentials.PerRPCCredentials {
+	return &hmacCredentials{caller: caller, secret: secret}
+}
+
+func (c *hmacCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{
+		HEADER_AUTHORIZATION: HmacToken(c.caller, c.secret, time.Now()),
+	}, nil
+}
+
+// RequireTransportSecurity keeps the tokens away from plaintext conns
+func (c *hmacCredentials) RequireTransportSecurity() bool {
+	return true
+}
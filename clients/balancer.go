@@ -0,0 +1,448 @@
+package clients
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+/*
+####################################################################################
+LOAD BALANCING
+a balancer picks the addr of every Get of GrpcClientPool among the healthy ones,
+the conn is then taken from the ones dialed to that addr. outstanding requests
+and latency of each addr are tracked by an interceptor bound to its conns
+*/
+
+const (
+	BalancerRoundRobin     = "round_robin"
+	BalancerLeastRequest   = "least_request"
+	BalancerPeakEwma       = "peak_ewma"
+	BalancerP2C            = "p2c"
+	BalancerConsistentHash = "consistent_hash"
+	BalancerRingHash       = "ring_hash"
+	BalancerMaglev         = "maglev"
+)
+
+// BalancerNode is an addr as seen by a Balancer
+type BalancerNode interface {
+	Addr() string
+	Weight() int
+	// in-flight rpcs on the addr
+	Outstanding() int64
+	// peak ewma of the rpc latency of the addr, 0 before any rpc ends
+	Latency() time.Duration
+}
+
+type Balancer interface {
+	// Pick returns one of nodes, nodes is never empty, key is empty unless the
+	// caller asked for a sticky conn
+	Pick(nodes []BalancerNode, key string) BalancerNode
+}
+
+var (
+	balancerMtx = &sync.RWMutex{}
+	balancerMap = map[string]func() Balancer{}
+)
+
+// RegisterBalancer makes a balancer available to GrpcClientConfig.Balancer,
+// newFunc is called once per pool
+func RegisterBalancer(name string, newFunc func() Balancer) {
+	balancerMtx.Lock()
+	defer balancerMtx.Unlock()
+	balancerMap[name] = newFunc
+}
+
+// newBalancer returns nil for round robin which keeps the plain pool rotation
+func newBalancer(name string) (b Balancer, err error) {
+	if name == "" || name == BalancerRoundRobin {
+		return nil, nil
+	}
+	balancerMtx.RLock()
+	defer balancerMtx.RUnlock()
+	newFunc, ok := balancerMap[name]
+	if !ok {
+		return nil, fmt.Errorf("balancer not registered||balancer=%v", name)
+	}
+	return newFunc(), nil
+}
+
+func init() {
+	RegisterBalancer(BalancerLeastRequest, func() Balancer { return &leastRequestBalancer{} })
+	RegisterBalancer(BalancerPeakEwma, func() Balancer { return &peakEwmaBalancer{} })
+	RegisterBalancer(BalancerP2C, func() Balancer { return &p2cBalancer{} })
+	RegisterBalancer(BalancerConsistentHash, func() Balancer { return newRingHashBalancer() })
+	RegisterBalancer(BalancerRingHash, func() Balancer { return newRingHashBalancer() })
+	RegisterBalancer(BalancerMaglev, func() Balancer { return newMaglevBalancer() })
+}
+
+// keyHashName returns the table a key hash balancer name stands for, empty if
+// name is not one
+func keyHashName(name string) string {
+	switch name {
+	case BalancerConsistentHash, BalancerRingHash:
+		return BalancerRingHash
+	case BalancerMaglev:
+		return BalancerMaglev
+	}
+	return ""
+}
+
+// keyHashOf returns the table used by GetByKey, a key hash Balancer sets it as
+// well since Get carries no key to hash
+func keyHashOf(conf GrpcClientConfig) (string, error) {
+	keyHash := conf.KeyHash
+	if keyHash != "" && keyHashName(keyHash) == "" {
+		return "", fmt.Errorf("key hash not supported||key_hash=%v", keyHash)
+	}
+	if byBalancer := keyHashName(conf.Balancer); byBalancer != "" {
+		if keyHash != "" && keyHashName(keyHash) != byBalancer {
+			return "", fmt.Errorf("balancer and key_hash differ||balancer=%v||key_hash=%v", conf.Balancer, keyHash)
+		}
+		keyHash = byBalancer
+	}
+	return keyHash, nil
+}
+
+// newKeyBalancer returns the balancer used by GetByKey, ring hash by default
+func newKeyBalancer(name string) (Balancer, error) {
+	switch keyHashName(name) {
+	case BalancerMaglev:
+		return newMaglevBalancer(), nil
+	case BalancerRingHash:
+		return newRingHashBalancer(), nil
+	}
+	if name == "" {
+		return newRingHashBalancer(), nil
+	}
+	return nil, fmt.Errorf("key hash not supported||key_hash=%v", name)
+}
+
+// staticNode is a node without load stats, used by the short connection pool
+type staticNode struct {
+	addr Address
+}
+
+func (n *staticNode) Addr() string           { return n.addr.Addr }
+func (n *staticNode) Weight() int            { return addrWeight(n.addr) }
+func (n *staticNode) Outstanding() int64     { return 0 }
+func (n *staticNode) Latency() time.Duration { return 0 }
+
+/**
+####################################################################################
+ADDR LOAD TRACKING
+*/
+
+const ewmaDecay = 10 * time.Second
+
+type addrLoad struct {
+	outstanding int64
+	mtx         *sync.Mutex
+	ewma        float64 // ns
+	lastTs      time.Time
+}
+
+func newAddrLoad() *addrLoad {
+	return &addrLoad{
+		mtx: &sync.Mutex{},
+	}
+}
+
+// observe updates the peak ewma, a latency above the average replaces it at
+// once while lower ones decay it with time
+func (l *addrLoad) observe(rtt time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := time.Now()
+	if float64(rtt) > l.ewma || l.lastTs.IsZero() {
+		l.ewma = float64(rtt)
+	} else {
+		w := math.Exp(-float64(now.Sub(l.lastTs)) / float64(ewmaDecay))
+		l.ewma = l.ewma*w + float64(rtt)*(1-w)
+	}
+	l.lastTs = now
+}
+
+func (l *addrLoad) latency() time.Duration {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return time.Duration(l.ewma)
+}
+
+func (l *addrLoad) unaryInterceptor(
+	ctx context.Context,
+	method string,
+	req, reply interface{},
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption) error {
+	atomic.AddInt64(&l.outstanding, 1)
+	defer atomic.AddInt64(&l.outstanding, -1)
+	t0 := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	l.observe(time.Since(t0))
+	return err
+}
+
+func (stat *addrStats) Addr() string {
+	return stat.addr
+}
+
+func (stat *addrStats) Weight() int {
+	return stat.weight
+}
+
+func (stat *addrStats) Outstanding() int64 {
+	return atomic.LoadInt64(&stat.load.outstanding)
+}
+
+func (stat *addrStats) Latency() time.Duration {
+	return stat.load.latency()
+}
+
+/**
+####################################################################################
+BUILTIN BALANCERS
+*/
+
+func nodeWeight(node BalancerNode) float64 {
+	if node.Weight() <= 0 {
+		return 1
+	}
+	return float64(node.Weight())
+}
+
+// pickMin returns the node with the lowest cost, ties are broken randomly
+func pickMin(nodes []BalancerNode, cost func(node BalancerNode) float64) (picked BalancerNode) {
+	minCost := math.MaxFloat64
+	ties := 0
+	for _, node := range nodes {
+		c := cost(node)
+		if c < minCost {
+			minCost, picked, ties = c, node, 1
+		} else if c == minCost {
+			ties++
+			if rand.Intn(ties) == 0 {
+				picked = node
+			}
+		}
+	}
+	return
+}
+
+type leastRequestBalancer struct{}
+
+func (b *leastRequestBalancer) Pick(nodes []BalancerNode, key string) BalancerNode {
+	return pickMin(nodes, func(node BalancerNode) float64 {
+		return float64(node.Outstanding()) / nodeWeight(node)
+	})
+}
+
+// peakEwmaBalancer weighs the latency with the queue that builds on the addr
+type peakEwmaBalancer struct{}
+
+func peakEwmaCost(node BalancerNode) float64 {
+	return float64(node.Latency()) * float64(node.Outstanding()+1) / nodeWeight(node)
+}
+
+func (b *peakEwmaBalancer) Pick(nodes []BalancerNode, key string) BalancerNode {
+	return pickMin(nodes, peakEwmaCost)
+}
+
+// p2cBalancer compares two random nodes only, which avoids herding on the
+// single least loaded addr when the stats are stale
+type p2cBalancer struct{}
+
+func (b *p2cBalancer) Pick(nodes []BalancerNode, key string) BalancerNode {
+	if len(nodes) == 1 {
+		return nodes[0]
+	}
+	i := rand.Intn(len(nodes))
+	j := rand.Intn(len(nodes) - 1)
+	if j >= i {
+		j++
+	}
+	if peakEwmaCost(nodes[j]) < peakEwmaCost(nodes[i]) {
+		return nodes[j]
+	}
+	return nodes[i]
+}
+
+/**
+####################################################################################
+RING HASH
+each addr is put weight*ringReplicas times on the ring, a key goes to the first
+point after its hash so that adding or removing an addr only moves the keys of
+its own points
+*/
+
+const ringReplicas = 100
+
+type ringPoint struct {
+	hash uint32
+	addr string
+}
+
+type ringHashBalancer struct {
+	mtx    *sync.Mutex
+	sign   string
+	points []ringPoint
+}
+
+func newRingHashBalancer() *ringHashBalancer {
+	return &ringHashBalancer{
+		mtx: &sync.Mutex{},
+	}
+}
+
+func nodesSign(nodes []BalancerNode) string {
+	parts := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		parts = append(parts, node.Addr()+"#"+strconv.Itoa(node.Weight()))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func hashKey(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
+
+// ring rebuilds the points only when the node set changes
+func (b *ringHashBalancer) ring(nodes []BalancerNode) []ringPoint {
+	sign := nodesSign(nodes)
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if sign == b.sign {
+		return b.points
+	}
+	points := []ringPoint{}
+	for _, node := range nodes {
+		replicas := int(nodeWeight(node)) * ringReplicas
+		for i := 0; i < replicas; i++ {
+			points = append(points, ringPoint{
+				hash: hashKey(node.Addr() + "#" + strconv.Itoa(i)),
+				addr: node.Addr(),
+			})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	b.sign, b.points = sign, points
+	return points
+}
+
+func (b *ringHashBalancer) Pick(nodes []BalancerNode, key string) BalancerNode {
+	if key == "" {
+		return nodes[rand.Intn(len(nodes))]
+	}
+	points := b.ring(nodes)
+	h := hashKey(key)
+	idx := sort.Search(len(points), func(i int) bool { return points[i].hash >= h })
+	if idx == len(points) {
+		idx = 0
+	}
+	for _, node := range nodes {
+		if node.Addr() == points[idx].addr {
+			return node
+		}
+	}
+	return nodes[0]
+}
+
+/**
+####################################################################################
+MAGLEV
+a lookup table filled by the addrs in turn following their own permutation,
+lookups are O(1) and keys spread more evenly than on a ring, at the price of a
+bit more remapping when the addr set changes
+*/
+
+const maglevTableSize = 65537
+
+type maglevBalancer struct {
+	mtx   *sync.Mutex
+	sign  string
+	addrs []string
+	table []int
+}
+
+func newMaglevBalancer() *maglevBalancer {
+	return &maglevBalancer{
+		mtx: &sync.Mutex{},
+	}
+}
+
+func hashKey2(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func (b *maglevBalancer) build(nodes []BalancerNode) ([]string, []int) {
+	sign := nodesSign(nodes)
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if sign == b.sign {
+		return b.addrs, b.table
+	}
+
+	sorted := append([]BalancerNode{}, nodes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Addr() < sorted[j].Addr() })
+	n := len(sorted)
+	addrs := make([]string, n)
+	offsets := make([]uint64, n)
+	skips := make([]uint64, n)
+	nexts := make([]uint64, n)
+	for i, node := range sorted {
+		addrs[i] = node.Addr()
+		offsets[i] = uint64(hashKey2(node.Addr())) % maglevTableSize
+		skips[i] = uint64(hashKey(node.Addr()))%(maglevTableSize-1) + 1
+	}
+	table := make([]int, maglevTableSize)
+	for i := range table {
+		table[i] = -1
+	}
+	filled := 0
+	for filled < maglevTableSize {
+		for i, node := range sorted {
+			// an addr of weight w takes w slots per round
+			for turn := 0; turn < int(nodeWeight(node)) && filled < maglevTableSize; turn++ {
+				c := (offsets[i] + nexts[i]*skips[i]) % maglevTableSize
+				for table[c] >= 0 {
+					nexts[i]++
+					c = (offsets[i] + nexts[i]*skips[i]) % maglevTableSize
+				}
+				table[c] = i
+				nexts[i]++
+				filled++
+			}
+		}
+	}
+	b.sign, b.addrs, b.table = sign, addrs, table
+	return addrs, table
+}
+
+func (b *maglevBalancer) Pick(nodes []BalancerNode, key string) BalancerNode {
+	if key == "" {
+		return nodes[rand.Intn(len(nodes))]
+	}
+	addrs, table := b.build(nodes)
+	addr := addrs[table[hashKey(key)%maglevTableSize]]
+	for _, node := range nodes {
+		if node.Addr() == addr {
+			return node
+		}
+	}
+	return nodes[0]
+}
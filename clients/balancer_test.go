@@ -0,0 +1,218 @@
+package clients
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeNode struct {
+	addr        string
+	weight      int
+	outstanding int64
+	latency     time.Duration
+}
+
+func (n *fakeNode) Addr() string           { return n.addr }
+func (n *fakeNode) Weight() int            { return n.weight }
+func (n *fakeNode) Outstanding() int64     { return n.outstanding }
+func (n *fakeNode) Latency() time.Duration { return n.latency }
+
+func TestLeastRequestBalancer(t *testing.T) {
+	b, err := newBalancer(BalancerLeastRequest)
+	assert.Nil(t, err)
+	nodes := []BalancerNode{
+		&fakeNode{addr: "a", weight: 1, outstanding: 5},
+		&fakeNode{addr: "b", weight: 1, outstanding: 2},
+		// weight 4 makes it the least loaded one
+		&fakeNode{addr: "c", weight: 4, outstanding: 4},
+	}
+	assert.Equal(t, "c", b.Pick(nodes, "").Addr())
+}
+
+func TestPeakEwmaBalancer(t *testing.T) {
+	b, err := newBalancer(BalancerPeakEwma)
+	assert.Nil(t, err)
+	nodes := []BalancerNode{
+		&fakeNode{addr: "slow", weight: 1, latency: time.Millisecond * 100},
+		&fakeNode{addr: "fast_busy", weight: 1, latency: time.Millisecond * 10, outstanding: 3},
+	}
+	assert.Equal(t, "fast_busy", b.Pick(nodes, "").Addr())
+	nodes[1].(*fakeNode).outstanding = 20
+	assert.Equal(t, "slow", b.Pick(nodes, "").Addr())
+}
+
+func TestP2CBalancer(t *testing.T) {
+	b, err := newBalancer(BalancerP2C)
+	assert.Nil(t, err)
+	nodes := []BalancerNode{
+		&fakeNode{addr: "hot", weight: 1, latency: time.Second, outstanding: 100},
+		&fakeNode{addr: "cold", weight: 1, latency: time.Millisecond},
+	}
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "cold", b.Pick(nodes, "").Addr())
+	}
+}
+
+func TestRingHashBalancer(t *testing.T) {
+	b, err := newBalancer(BalancerConsistentHash)
+	assert.Nil(t, err)
+	nodes := []BalancerNode{}
+	for i := 0; i < 5; i++ {
+		nodes = append(nodes, &fakeNode{addr: fmt.Sprintf("10.0.0.%v:80", i), weight: 1})
+	}
+
+	picked := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("user_%v", i)
+		picked[key] = b.Pick(nodes, key).Addr()
+		// sticky
+		assert.Equal(t, picked[key], b.Pick(nodes, key).Addr())
+	}
+
+	// removing one addr only moves its own keys
+	removed := nodes[2].Addr()
+	moved := 0
+	for key, addr := range picked {
+		newAddr := b.Pick(append(append([]BalancerNode{}, nodes[:2]...), nodes[3:]...), key).Addr()
+		if addr != removed {
+			assert.Equal(t, addr, newAddr)
+		} else {
+			moved++
+		}
+	}
+	assert.True(t, moved > 0)
+}
+
+func TestMaglevBalancer(t *testing.T) {
+	b, err := newBalancer(BalancerMaglev)
+	assert.Nil(t, err)
+	nodes := []BalancerNode{}
+	for i := 0; i < 5; i++ {
+		nodes = append(nodes, &fakeNode{addr: fmt.Sprintf("10.0.0.%v:80", i), weight: 1})
+	}
+
+	picked := map[string]string{}
+	counts := map[string]int{}
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("user_%v", i)
+		picked[key] = b.Pick(nodes, key).Addr()
+		counts[picked[key]]++
+		assert.Equal(t, picked[key], b.Pick(nodes, key).Addr())
+	}
+	// evenly spread
+	for _, node := range nodes {
+		assert.True(t, counts[node.Addr()] > 700, node.Addr())
+	}
+
+	// most of the keys of the other addrs stay
+	removed := nodes[2].Addr()
+	kept, others := 0, 0
+	for key, addr := range picked {
+		if addr == removed {
+			continue
+		}
+		others++
+		if b.Pick(append(append([]BalancerNode{}, nodes[:2]...), nodes[3:]...), key).Addr() == addr {
+			kept++
+		}
+	}
+	assert.True(t, float64(kept)/float64(others) > 0.9)
+}
+
+func TestGetByKey(t *testing.T) {
+	addrs := []string{}
+	for i := 0; i < 3; i++ {
+		addr, stop := startFlakyServer(t, &flakyHealthServer{})
+		defer stop()
+		addrs = append(addrs, addr)
+	}
+
+	for _, conf := range []GrpcClientConfig{
+		{LongConnection: true, KeyHash: BalancerMaglev},
+		{LongConnection: false, KeyHash: BalancerMaglev},
+		{LongConnection: true, Balancer: BalancerConsistentHash},
+		{LongConnection: false, Balancer: BalancerConsistentHash},
+	} {
+		conf.Addrs = addrs
+		conf.PoolSize = 2
+		cli, err := NewGrpcClientBase(conf)
+		assert.Nil(t, err)
+
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("user_%v", i)
+			conn, err := cli.GetByKey(key)
+			assert.Nil(t, err)
+			target := conn.Target()
+			cli.Put(conn)
+			conn, err = cli.GetByKey(key)
+			assert.Nil(t, err)
+			assert.Equal(t, target, conn.Target(), key)
+			cli.Put(conn)
+		}
+		cli.Close()
+	}
+}
+
+func TestTakeOverIdx(t *testing.T) {
+	a, b, c := newAddrStats(0, "a:80"), newAddrStats(1, "b:80"), newAddrStats(2, "c:80")
+	pool := &GrpcClientPool{
+		conns:    []*longConn{newLongConn(nil, a), newLongConn(nil, a), newLongConn(nil, b)},
+		capacity: 3,
+	}
+
+	// the only conn of b is kept, a holds two
+	assert.Equal(t, int64(0), pool.takeOverIdxLocked(2))
+	assert.Equal(t, int64(1), pool.takeOverIdxLocked(1))
+
+	// every addr holds a single conn, the pool grows
+	pool.conns[0] = newLongConn(nil, c)
+	assert.Equal(t, int64(3), pool.takeOverIdxLocked(0))
+	assert.Equal(t, 4, len(pool.conns))
+	assert.Equal(t, int64(4), pool.capacity)
+
+	// the empty slot and the removed addr are taken first
+	assert.Equal(t, int64(3), pool.takeOverIdxLocked(3))
+	pool.conns[3] = newLongConn(nil, newAddrStats(3, "d:80"))
+	atomic.StoreInt32(&b.removed, 1)
+	assert.Equal(t, int64(2), pool.takeOverIdxLocked(0))
+}
+
+func TestKeyHashOf(t *testing.T) {
+	for _, c := range []struct {
+		balancer, keyHash, expected string
+		fails                       bool
+	}{
+		{"", "", "", false},
+		{BalancerP2C, BalancerMaglev, BalancerMaglev, false},
+		{BalancerConsistentHash, "", BalancerRingHash, false},
+		{BalancerConsistentHash, BalancerRingHash, BalancerRingHash, false},
+		{BalancerMaglev, "", BalancerMaglev, false},
+		{BalancerMaglev, BalancerRingHash, "", true},
+		{"", "not_exist", "", true},
+	} {
+		keyHash, err := keyHashOf(GrpcClientConfig{Balancer: c.balancer, KeyHash: c.keyHash})
+		assert.Equal(t, c.fails, err != nil, c)
+		assert.Equal(t, c.expected, keyHash, c)
+	}
+
+	b, err := newKeyBalancer("")
+	assert.Nil(t, err)
+	assert.IsType(t, newRingHashBalancer(), b)
+	b, err = newKeyBalancer(BalancerMaglev)
+	assert.Nil(t, err)
+	assert.IsType(t, newMaglevBalancer(), b)
+	_, err = newKeyBalancer("not_exist")
+	assert.NotNil(t, err)
+}
+
+func TestUnknownBalancer(t *testing.T) {
+	_, err := newBalancer("not_exist")
+	assert.NotNil(t, err)
+	b, err := newBalancer("")
+	assert.Nil(t, err)
+	assert.Nil(t, b)
+}
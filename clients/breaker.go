@@ -0,0 +1,291 @@
+package clients
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/xutils/lib-common/metrics"
+	"github.com/xutils/lib-common/xlog"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+####################################################################################
+CIRCUIT BREAKER PER ADDR
+closed: calls go through, outcomes are counted in a rolling window
+open: the addr is ejected from routing until OpenSec elapses
+half-open: up to HalfOpenProbes calls are let through, all of them succeed to close
+*/
+
+type BreakerConfig struct {
+	Enable         bool    `toml:"enable"`
+	WindowSec      int     `toml:"window_sec"`
+	MinRequests    int64   `toml:"min_requests"`
+	ErrRatio       float64 `toml:"err_ratio"`
+	SlowCallMs     int     `toml:"slow_call_ms"` // calls slower than it count as failures, 0 to disable
+	OpenSec        int     `toml:"open_sec"`
+	HalfOpenProbes int64   `toml:"half_open_probes"`
+}
+
+func (conf *BreakerConfig) setDefault() {
+	if conf.WindowSec <= 0 {
+		conf.WindowSec = 10
+	}
+	if conf.MinRequests <= 0 {
+		conf.MinRequests = 20
+	}
+	if conf.ErrRatio <= 0 || conf.ErrRatio > 1 {
+		conf.ErrRatio = 0.5
+	}
+	if conf.OpenSec <= 0 {
+		conf.OpenSec = 5
+	}
+	if conf.HalfOpenProbes <= 0 {
+		conf.HalfOpenProbes = 3
+	}
+}
+
+type BreakerState int32
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half_open"
+	}
+	return "unknown"
+}
+
+const breakerBucketCnt = 10
+
+type breakerBucket struct {
+	total int64
+	fail  int64
+}
+
+type circuitBreaker struct {
+	conf BreakerConfig
+	mtx  *sync.Mutex
+
+	state    BreakerState
+	gen      int64 // bumped on every state change, outcomes of older gens are dropped
+	openedAt time.Time
+
+	buckets     [breakerBucketCnt]breakerBucket
+	bucketDur   time.Duration
+	bucketIdx   int
+	bucketStart time.Time
+
+	probing   int64
+	probeSucc int64
+
+	onStateChange func(from, to BreakerState)
+	now           func() time.Time
+}
+
+func newCircuitBreaker(conf BreakerConfig, onStateChange func(from, to BreakerState)) *circuitBreaker {
+	conf.setDefault()
+	cb := &circuitBreaker{
+		conf:          conf,
+		mtx:           &sync.Mutex{},
+		bucketDur:     time.Duration(conf.WindowSec) * time.Second / breakerBucketCnt,
+		onStateChange: onStateChange,
+		now:           time.Now,
+	}
+	cb.bucketStart = cb.now()
+	return cb
+}
+
+func (cb *circuitBreaker) State() BreakerState {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+	return cb.state
+}
+
+// Ready reports whether the addr may be routed to without taking a probe slot
+func (cb *circuitBreaker) Ready() bool {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+	switch cb.state {
+	case BreakerOpen:
+		return cb.now().Sub(cb.openedAt) >= time.Duration(cb.conf.OpenSec)*time.Second
+	case BreakerHalfOpen:
+		return cb.probing < cb.conf.HalfOpenProbes
+	}
+	return true
+}
+
+// Allow reports whether a call may go through, done must be called with its outcome
+func (cb *circuitBreaker) Allow() (done func(failed bool), ok bool) {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	if cb.state == BreakerOpen {
+		if cb.now().Sub(cb.openedAt) < time.Duration(cb.conf.OpenSec)*time.Second {
+			return nil, false
+		}
+		cb.setStateLocked(BreakerHalfOpen)
+	}
+
+	gen := cb.gen
+	probe := cb.state == BreakerHalfOpen
+	if probe {
+		if cb.probing >= cb.conf.HalfOpenProbes {
+			return nil, false
+		}
+		cb.probing++
+	}
+	done = func(failed bool) {
+		cb.record(gen, probe, failed)
+	}
+	return done, true
+}
+
+func (cb *circuitBreaker) record(gen int64, probe bool, failed bool) {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+	if gen != cb.gen {
+		return
+	}
+
+	if probe {
+		cb.probing--
+		if failed {
+			cb.setStateLocked(BreakerOpen)
+			return
+		}
+		cb.probeSucc++
+		if cb.probeSucc >= cb.conf.HalfOpenProbes {
+			cb.setStateLocked(BreakerClosed)
+		}
+		return
+	}
+
+	cb.rollLocked()
+	bucket := &cb.buckets[cb.bucketIdx]
+	bucket.total++
+	if failed {
+		bucket.fail++
+	}
+	var total, fail int64
+	for _, b := range cb.buckets {
+		total += b.total
+		fail += b.fail
+	}
+	if total >= cb.conf.MinRequests && float64(fail)/float64(total) >= cb.conf.ErrRatio {
+		cb.setStateLocked(BreakerOpen)
+	}
+}
+
+// rollLocked moves the current bucket forward, clearing the expired ones
+func (cb *circuitBreaker) rollLocked() {
+	elapsed := cb.now().Sub(cb.bucketStart)
+	if elapsed < cb.bucketDur {
+		return
+	}
+	steps := int(elapsed / cb.bucketDur)
+	if steps > breakerBucketCnt {
+		steps = breakerBucketCnt
+	}
+	for i := 0; i < steps; i++ {
+		cb.bucketIdx = (cb.bucketIdx + 1) % breakerBucketCnt
+		cb.buckets[cb.bucketIdx] = breakerBucket{}
+	}
+	cb.bucketStart = cb.bucketStart.Add(elapsed / cb.bucketDur * cb.bucketDur)
+}
+
+func (cb *circuitBreaker) setStateLocked(state BreakerState) {
+	from := cb.state
+	cb.state = state
+	cb.gen++
+	cb.probing, cb.probeSucc = 0, 0
+	switch state {
+	case BreakerOpen:
+		cb.openedAt = cb.now()
+	case BreakerClosed:
+		cb.buckets = [breakerBucketCnt]breakerBucket{}
+		cb.bucketStart = cb.now()
+	}
+	if cb.onStateChange != nil && from != state {
+		cb.onStateChange(from, state)
+	}
+}
+
+// isFailure tells whether an rpc outcome should count against the addr,
+// business errors and cancellation by the caller never do
+func (cb *circuitBreaker) isFailure(err error, latency time.Duration) bool {
+	if cb.conf.SlowCallMs > 0 && latency > time.Duration(cb.conf.SlowCallMs)*time.Millisecond {
+		return true
+	}
+	if err == nil {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+func (cb *circuitBreaker) unaryInterceptor(addr string) grpc.UnaryClientInterceptor {
+	return func(
+		ctx context.Context,
+		method string,
+		req, reply interface{},
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption) error {
+		done, ok := cb.Allow()
+		if !ok {
+			return status.Errorf(codes.Unavailable, "circuit breaker open||addr=%v", addr)
+		}
+		t0 := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		done(cb.isFailure(err, time.Since(t0)))
+		return err
+	}
+}
+
+/**
+####################################################################################
+BREAKER METRICS
+*/
+
+var breakerMetrics = &metrics.MetricsBase{}
+
+// InitBreakerMetrics creates and registers the breaker state gauge
+// (0:closed, 1:open, 2:half_open) and the state transition counter
+func InitBreakerMetrics(prefix string) {
+	breakerMetrics.CreateMetricsGaugeVec(prefix, "grpc_client_breaker", "state", []string{"svr_name", "addr"})
+	breakerMetrics.CreateMetricsCountVec(prefix, "grpc_client_breaker", "transition_cnt", []string{"svr_name", "addr", "state"})
+	if err := breakerMetrics.Register(); err != nil {
+		xlog.Error("failed to register breaker metrics||prefix=%v||err=%v", prefix, err)
+	}
+}
+
+func breakerStateChangeFunc(svrName, addr string) func(from, to BreakerState) {
+	return func(from, to BreakerState) {
+		xlog.Warn("_grpc_breaker||svrname=%v||addr=%v||from=%v||to=%v", svrName, addr, from, to)
+		breakerMetrics.SetGauge(float64(to), svrName, addr)
+		breakerMetrics.ObserveCounter(1, svrName, addr, to.String())
+	}
+}
+
+func removeBreakerMetrics(svrName, addr string) {
+	if gauge := breakerMetrics.GetMetricsGauge(); gauge != nil {
+		gauge.DeleteLabelValues(svrName, addr)
+	}
+}
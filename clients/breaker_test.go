@@ -0,0 +1,104 @@
+package clients
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	transitions := []BreakerState{}
+	cb := newCircuitBreaker(BreakerConfig{
+		Enable:         true,
+		MinRequests:    4,
+		ErrRatio:       0.5,
+		OpenSec:        1,
+		HalfOpenProbes: 2,
+	}, func(from, to BreakerState) {
+		transitions = append(transitions, to)
+	})
+	cb.now = func() time.Time { return now }
+
+	call := func(failed bool) bool {
+		done, ok := cb.Allow()
+		if ok {
+			done(failed)
+		}
+		return ok
+	}
+
+	// not enough requests to trip
+	assert.True(t, call(true))
+	assert.True(t, call(true))
+	assert.Equal(t, BreakerClosed, cb.State())
+
+	assert.True(t, call(false))
+	assert.True(t, call(true))
+	assert.Equal(t, BreakerOpen, cb.State())
+	assert.False(t, cb.Ready())
+	assert.False(t, call(false))
+
+	// half open after OpenSec, a failed probe opens again
+	now = now.Add(time.Second)
+	assert.True(t, cb.Ready())
+	assert.True(t, call(true))
+	assert.Equal(t, BreakerOpen, cb.State())
+
+	now = now.Add(time.Second)
+	done1, ok := cb.Allow()
+	assert.True(t, ok)
+	done2, ok := cb.Allow()
+	assert.True(t, ok)
+	// probe slots are taken
+	_, ok = cb.Allow()
+	assert.False(t, ok)
+	done1(false)
+	assert.Equal(t, BreakerHalfOpen, cb.State())
+	done2(false)
+	assert.Equal(t, BreakerClosed, cb.State())
+
+	assert.Equal(t, []BreakerState{
+		BreakerOpen, BreakerHalfOpen, BreakerOpen, BreakerHalfOpen, BreakerClosed,
+	}, transitions)
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	now := time.Now()
+	cb := newCircuitBreaker(BreakerConfig{
+		WindowSec:   1,
+		MinRequests: 2,
+		ErrRatio:    1,
+	}, nil)
+	cb.now = func() time.Time { return now }
+
+	done, _ := cb.Allow()
+	done(true)
+	// the first failure has left the window
+	now = now.Add(time.Second * 2)
+	done, _ = cb.Allow()
+	done(true)
+	assert.Equal(t, BreakerClosed, cb.State())
+	done, _ = cb.Allow()
+	done(true)
+	assert.Equal(t, BreakerOpen, cb.State())
+}
+
+func TestCircuitBreakerIsFailure(t *testing.T) {
+	cb := newCircuitBreaker(BreakerConfig{SlowCallMs: 100}, nil)
+	assert.False(t, cb.isFailure(nil, time.Millisecond))
+	assert.True(t, cb.isFailure(nil, time.Second))
+	assert.True(t, cb.isFailure(status.Error(codes.Unavailable, ""), time.Millisecond))
+	assert.False(t, cb.isFailure(status.Error(codes.InvalidArgument, ""), time.Millisecond))
+	assert.False(t, cb.isFailure(status.Error(codes.Canceled, ""), time.Millisecond))
+}
+
+func TestInitBreakerMetricsTwice(t *testing.T) {
+	InitBreakerMetrics("test_breaker")
+	assert.NotPanics(t, func() { InitBreakerMetrics("test_breaker") })
+	breakerStateChangeFunc("svr_a", "a:1")(BreakerClosed, BreakerOpen)
+	removeBreakerMetrics("svr_a", "a:1")
+}
@@ -1,43 +1,362 @@
 package clients
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
 	"github.com/xutils/lib-common/xlog"
 
 	"github.com/BurntSushi/toml"
 )
 
 type ClientAddr struct {
-	Addrs []string `toml:"addrs"`
+	Addrs []string   `toml:"addrs"`
+	Nodes []*Address `toml:"nodes"`
+}
+
+// Addresses merges the plain addrs with the weighted nodes
+func (c *ClientAddr) Addresses() (addrs []Address) {
+	addrs = addrsFromStrings(c.Addrs)
+	for _, node := range c.Nodes {
+		if node != nil {
+			addrs = append(addrs, *node)
+		}
+	}
+	return normalizeAddrs(addrs)
 }
 
 type ClientAddrConf struct {
 	AddrMap map[string]*ClientAddr `toml:"addr_map"`
 }
 
+// ClientAddrMgr keeps the addr file in memory and re-reads it when its mtime or
+// size changes, subscribers of a svr receive the full addr set every time it
+// changes. it implements Resolver so GrpcClientBase follows it directly
+//
+// the file layout:
+//
+//	[addr_map.user_svr]
+//	addrs = ["127.0.0.1:8001"]
+//
+//	[[addr_map.user_svr.nodes]]
+//	addr = "127.0.0.1:8002"
+//	weight = 2
 type ClientAddrMgr struct {
-	conf ClientAddrConf
+	filepath   string
+	interval   time.Duration
+	intervalCh chan time.Duration
+
+	mtx     *sync.RWMutex
+	conf    ClientAddrConf
+	modTime time.Time
+	size    int64
+	subs    map[string]map[*addrSubscriber]struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// closed once watchWorker returns
+	done chan struct{}
 }
 
-var cliAddrMgr *ClientAddrMgr
+type addrSubscriber struct {
+	ch chan []Address
+}
+
+// push keeps only the latest addr set in the channel, the caller holds the mgr lock
+func (sub *addrSubscriber) push(addrs []Address) {
+	select {
+	case <-sub.ch:
+	default:
+	}
+	sub.ch <- addrs
+}
+
+var (
+	cliAddrMgrMtx = &sync.RWMutex{}
+	cliAddrMgr    *ClientAddrMgr
+)
 
 func InitClientAddrMap(filepath string) (err error) {
+	return InitClientAddrMapWithInterval(filepath, defaultResolveIntervalSec)
+}
+
+// InitClientAddrMapWithInterval inits the mgr used by the clients, called again
+// it switches the mgr to filepath so that the clients following it keep their
+// subscriptions
+func InitClientAddrMapWithInterval(filepath string, intervalSec int) (err error) {
+	cliAddrMgrMtx.Lock()
+	defer cliAddrMgrMtx.Unlock()
+	if cliAddrMgr != nil && cliAddrMgr.ctx.Err() == nil {
+		if err = cliAddrMgr.SwitchFile(filepath, intervalSec); err != nil {
+			xlog.Error("failed to switch client map||file=%v||err=%v", filepath, err)
+		}
+		return
+	}
+	mgr, err := NewClientAddrMgr(filepath, intervalSec)
+	if err != nil {
+		xlog.Error("failed to init client map||file=%v||err=%v", filepath, err)
+		return
+	}
+	cliAddrMgr = mgr
+	return
+}
+
+// GetClientAddrMgr returns the mgr set by InitClientAddrMap, nil if not inited
+func GetClientAddrMgr() *ClientAddrMgr {
+	cliAddrMgrMtx.RLock()
+	defer cliAddrMgrMtx.RUnlock()
+	return cliAddrMgr
+}
+
+func NewClientAddrMgr(filepath string, intervalSec int) (mgr *ClientAddrMgr, err error) {
+	if intervalSec <= 0 {
+		intervalSec = defaultResolveIntervalSec
+	}
+	mgr = &ClientAddrMgr{
+		filepath:   filepath,
+		interval:   time.Duration(intervalSec) * time.Second,
+		intervalCh: make(chan time.Duration, 1),
+		mtx:        &sync.RWMutex{},
+		subs:       map[string]map[*addrSubscriber]struct{}{},
+	}
+	if _, _, err = mgr.reload(); err != nil {
+		return nil, err
+	}
+	mgr.ctx, mgr.cancel = context.WithCancel(context.Background())
+	mgr.done = make(chan struct{})
+	go mgr.watchWorker()
+	return
+}
+
+func (mgr *ClientAddrMgr) watchWorker() {
+	defer close(mgr.done)
+	ticker := time.NewTicker(mgr.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			filepath, changed, err := mgr.reload()
+			if err != nil {
+				xlog.Warn("_client_addr_mgr||failed to reload||file=%v||err=%v", filepath, err)
+			} else if changed {
+				xlog.Info("_client_addr_mgr||reloaded||file=%v", filepath)
+			}
+		case interval := <-mgr.intervalCh:
+			ticker.Reset(interval)
+		case <-mgr.ctx.Done():
+			return
+		}
+	}
+}
+
+// reload decodes the file again only if it was modified since the last read,
+// a broken file keeps the last good conf
+func (mgr *ClientAddrMgr) reload() (filepath string, changed bool, err error) {
+	mgr.mtx.RLock()
+	filepath, modTime, size := mgr.filepath, mgr.modTime, mgr.size
+	mgr.mtx.RUnlock()
+
+	info, err := os.Stat(filepath)
+	if err != nil {
+		return
+	}
+	if info.ModTime().Equal(modTime) && info.Size() == size {
+		return
+	}
+	conf := ClientAddrConf{}
+	if _, err = toml.DecodeFile(filepath, &conf); err != nil {
+		return
+	}
+
+	mgr.mtx.Lock()
+	defer mgr.mtx.Unlock()
+	if mgr.filepath != filepath {
+		// switched meanwhile, the new file is already applied
+		return
+	}
+	mgr.applyLocked(conf, info)
+	return filepath, true, nil
+}
+
+// SwitchFile makes the mgr follow another file, the subscriptions are kept and
+// receive the addr sets which differ in the new file
+func (mgr *ClientAddrMgr) SwitchFile(filepath string, intervalSec int) (err error) {
+	info, err := os.Stat(filepath)
+	if err != nil {
+		return
+	}
 	conf := ClientAddrConf{}
 	if _, err = toml.DecodeFile(filepath, &conf); err != nil {
-		xlog.Error("failed to init client map")
+		return
+	}
+	if intervalSec <= 0 {
+		intervalSec = defaultResolveIntervalSec
+	}
+
+	mgr.mtx.Lock()
+	defer mgr.mtx.Unlock()
+	xlog.Info("_client_addr_mgr||switch file||old=%v||new=%v", mgr.filepath, filepath)
+	mgr.filepath = filepath
+	if interval := time.Duration(intervalSec) * time.Second; interval != mgr.interval {
+		mgr.interval = interval
+		select {
+		case <-mgr.intervalCh:
+		default:
+		}
+		mgr.intervalCh <- interval
 	}
+	mgr.applyLocked(conf, info)
 	return
 }
 
-func getAddrFromSvrMgr(svrName string) (addr *ClientAddr) {
+// applyLocked sets conf and pushes the changed addr sets to the subscribers
+func (mgr *ClientAddrMgr) applyLocked(conf ClientAddrConf, info os.FileInfo) {
+	oldConf := mgr.conf
+	mgr.conf, mgr.modTime, mgr.size = conf, info.ModTime(), info.Size()
 
-	if cliAddrMgr == nil {
-		return
+	for svrName, subs := range mgr.subs {
+		newAddrs := mgr.addressesLocked(svrName)
+		if len(newAddrs) == 0 {
+			// never drain the pools when a svr is dropped from the file by mistake
+			continue
+		}
+		var oldAddrs []Address
+		if oldAddr, ok := oldConf.AddrMap[svrName]; ok && oldAddr != nil {
+			oldAddrs = oldAddr.Addresses()
+		}
+		if addrsEqual(oldAddrs, newAddrs) {
+			continue
+		}
+		xlog.Info("_client_addr_mgr||svrname=%v||addrs changed||old=%v||new=%v",
+			svrName, addrStrings(oldAddrs), addrStrings(newAddrs))
+		for sub := range subs {
+			sub.push(newAddrs)
+		}
+	}
+}
+
+func (mgr *ClientAddrMgr) addressesLocked(svrName string) []Address {
+	clientAddr, ok := mgr.conf.AddrMap[svrName]
+	if !ok || clientAddr == nil {
+		return nil
 	}
+	return clientAddr.Addresses()
+}
+
+// Snapshot returns a copy of the current conf
+func (mgr *ClientAddrMgr) Snapshot() (conf ClientAddrConf) {
+	mgr.mtx.RLock()
+	defer mgr.mtx.RUnlock()
+	conf.AddrMap = make(map[string]*ClientAddr, len(mgr.conf.AddrMap))
+	for svrName, clientAddr := range mgr.conf.AddrMap {
+		if clientAddr == nil {
+			continue
+		}
+		copied := &ClientAddr{
+			Addrs: append([]string{}, clientAddr.Addrs...),
+		}
+		for _, node := range clientAddr.Nodes {
+			if node == nil {
+				continue
+			}
+			nodeCopy := *node
+			if node.Metadata != nil {
+				nodeCopy.Metadata = make(map[string]string, len(node.Metadata))
+				for k, v := range node.Metadata {
+					nodeCopy.Metadata[k] = v
+				}
+			}
+			copied.Nodes = append(copied.Nodes, &nodeCopy)
+		}
+		conf.AddrMap[svrName] = copied
+	}
+	return
+}
 
-	if cliAddrMgr.conf.AddrMap == nil {
+// Subscribe returns a channel receiving the addr set of svrName, the current
+// one is delivered first if the svr exists, only the latest set is kept when
+// the reader falls behind. call cancel to release the subscription
+func (mgr *ClientAddrMgr) Subscribe(svrName string) (addrCh <-chan []Address, cancel func()) {
+	sub := &addrSubscriber{
+		ch: make(chan []Address, 1),
+	}
+	mgr.mtx.Lock()
+	defer mgr.mtx.Unlock()
+	if _, ok := mgr.subs[svrName]; !ok {
+		mgr.subs[svrName] = map[*addrSubscriber]struct{}{}
+	}
+	mgr.subs[svrName][sub] = struct{}{}
+	if addrs := mgr.addressesLocked(svrName); len(addrs) > 0 {
+		sub.push(addrs)
+	}
+
+	cancel = func() {
+		mgr.mtx.Lock()
+		defer mgr.mtx.Unlock()
+		if _, ok := mgr.subs[svrName][sub]; !ok {
+			// already released by Close
+			return
+		}
+		delete(mgr.subs[svrName], sub)
+		if len(mgr.subs[svrName]) == 0 {
+			delete(mgr.subs, svrName)
+		}
+		close(sub.ch)
+	}
+	return sub.ch, cancel
+}
+
+func (mgr *ClientAddrMgr) Resolve(svrName string) (addrs []Address, err error) {
+	mgr.mtx.RLock()
+	defer mgr.mtx.RUnlock()
+	addrs = mgr.addressesLocked(svrName)
+	if len(addrs) == 0 {
+		err = fmt.Errorf("svr not found||svrname=%v||file=%v", svrName, mgr.filepath)
+	}
+	return
+}
+
+func (mgr *ClientAddrMgr) Watch(ctx context.Context, svrName string) (<-chan []Address, error) {
+	if _, err := mgr.Resolve(svrName); err != nil {
+		return nil, err
+	}
+	addrCh, cancel := mgr.Subscribe(svrName)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-mgr.ctx.Done():
+		}
+		cancel()
+	}()
+	return addrCh, nil
+}
+
+// Close stops watching the file, subscriptions are closed as well
+func (mgr *ClientAddrMgr) Close() {
+	mgr.cancel()
+	<-mgr.done
+	mgr.mtx.Lock()
+	defer mgr.mtx.Unlock()
+	for _, subs := range mgr.subs {
+		for sub := range subs {
+			close(sub.ch)
+		}
+	}
+	mgr.subs = map[string]map[*addrSubscriber]struct{}{}
+}
+
+func getAddrFromSvrMgr(svrName string) (addr *ClientAddr) {
+
+	mgr := GetClientAddrMgr()
+	if mgr == nil {
 		return
 	}
-	addr, _ = cliAddrMgr.conf.AddrMap[svrName]
+
+	conf := mgr.Snapshot()
+	addr, _ = conf.AddrMap[svrName]
 	return
 }
 
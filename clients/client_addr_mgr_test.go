@@ -0,0 +1,134 @@
+package clients
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// resetClientAddrMgr closes the mgr inited by the test and restores the global one
+func resetClientAddrMgr(t *testing.T) {
+	cliAddrMgrMtx.Lock()
+	old := cliAddrMgr
+	cliAddrMgrMtx.Unlock()
+	t.Cleanup(func() {
+		cliAddrMgrMtx.Lock()
+		defer cliAddrMgrMtx.Unlock()
+		if cliAddrMgr != nil && cliAddrMgr != old {
+			cliAddrMgr.Close()
+		}
+		cliAddrMgr = old
+	})
+}
+
+func TestClientAddrMgr(t *testing.T) {
+	resetClientAddrMgr(t)
+	dir, err := ioutil.TempDir("", "addr_mgr")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "addrs.toml")
+	err = ioutil.WriteFile(file, []byte(`
+[addr_map.svr_a]
+addrs = ["127.0.0.1:8001"]
+
+[addr_map.svr_b]
+addrs = ["127.0.0.1:9001"]
+`), 0644)
+	assert.Nil(t, err)
+
+	err = InitClientAddrMapWithInterval(file, 1)
+	assert.Nil(t, err)
+	mgr := GetClientAddrMgr()
+	defer mgr.Close()
+
+	assert.Equal(t, []string{"127.0.0.1:8001"}, GetAddrFromSvrMg("svr_a").Addrs)
+
+	// snapshot must not be affected by later changes
+	snapshot := mgr.Snapshot()
+	snapshot.AddrMap["svr_a"].Addrs[0] = "changed"
+	assert.Equal(t, "127.0.0.1:8001", mgr.Snapshot().AddrMap["svr_a"].Addrs[0])
+
+	chA, cancelA := mgr.Subscribe("svr_a")
+	chB, cancelB := mgr.Subscribe("svr_b")
+	defer cancelB()
+	assert.Equal(t, []string{"127.0.0.1:8001"}, addrStrings(<-chA))
+	assert.Equal(t, []string{"127.0.0.1:9001"}, addrStrings(<-chB))
+
+	time.Sleep(time.Millisecond * 10)
+	err = ioutil.WriteFile(file, []byte(`
+[addr_map.svr_a]
+addrs = ["127.0.0.1:8001", "127.0.0.1:8002"]
+
+[addr_map.svr_b]
+addrs = ["127.0.0.1:9001"]
+`), 0644)
+	assert.Nil(t, err)
+
+	select {
+	case addrs := <-chA:
+		assert.Equal(t, []string{"127.0.0.1:8001", "127.0.0.1:8002"}, addrStrings(addrs))
+	case <-time.After(time.Second * 3):
+		t.Fatal("addrs change not pushed")
+	}
+	// unchanged svr is not notified
+	select {
+	case <-chB:
+		t.Fatal("unexpected push for unchanged svr")
+	default:
+	}
+
+	cancelA()
+	_, ok := <-chA
+	assert.False(t, ok)
+
+	mgr.Close()
+	_, ok = <-chB
+	assert.False(t, ok)
+}
+
+func TestClientAddrMgrReinit(t *testing.T) {
+	resetClientAddrMgr(t)
+	dir, err := ioutil.TempDir("", "addr_mgr")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	file1, file2 := path.Join(dir, "addrs1.toml"), path.Join(dir, "addrs2.toml")
+	assert.Nil(t, ioutil.WriteFile(file1, []byte(`
+[addr_map.svr_a]
+addrs = ["127.0.0.1:8001"]
+`), 0644))
+	assert.Nil(t, ioutil.WriteFile(file2, []byte(`
+[addr_map.svr_a]
+addrs = ["127.0.0.1:8003"]
+`), 0644))
+
+	assert.Nil(t, InitClientAddrMapWithInterval(file1, 1))
+	mgr := GetClientAddrMgr()
+	defer mgr.Close()
+	ch, cancel := mgr.Subscribe("svr_a")
+	defer cancel()
+	assert.Equal(t, []string{"127.0.0.1:8001"}, addrStrings(<-ch))
+
+	// the subscription survives the switch and gets the addrs of the new file
+	assert.NotNil(t, InitClientAddrMapWithInterval(path.Join(dir, "not_exist.toml"), 1))
+	assert.Nil(t, InitClientAddrMapWithInterval(file2, 1))
+	assert.Equal(t, mgr, GetClientAddrMgr())
+	assert.Equal(t, []string{"127.0.0.1:8003"}, addrStrings(<-ch))
+
+	time.Sleep(time.Millisecond * 10)
+	assert.Nil(t, ioutil.WriteFile(file2, []byte(`
+[addr_map.svr_a]
+addrs = ["127.0.0.1:8003", "127.0.0.1:8004"]
+`), 0644))
+	select {
+	case addrs := <-ch:
+		assert.Equal(t, []string{"127.0.0.1:8003", "127.0.0.1:8004"}, addrStrings(addrs))
+	case <-time.After(time.Second * 3):
+		t.Fatal("addrs change of the new file not pushed")
+	}
+}
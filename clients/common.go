@@ -4,12 +4,14 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"sync"
 	"time"
 
 	"google.golang.org/grpc/metadata"
 
 	"github.com/xutils/lib-common/local_context"
 	"github.com/xutils/lib-common/metrics"
+	"github.com/xutils/lib-common/tracing"
 	"github.com/xutils/lib-common/xlog"
 
 	"google.golang.org/grpc"
@@ -52,9 +54,58 @@ type GrpcClientConfig struct {
 	PoolMaxAliveSec  int64 `toml:"pool_max_alive_sec"`
 	KeepAliveSec     int   `toml:"keep_alive_sec"`
 	KeepAliveTimeOut int   `toml:"keep_alive_timeout_sec"`
+	// how long a recycled long conn waits for its rpcs to end before being closed
+	DrainTimeoutSec int `toml:"drain_timeout_sec"`
+	// recycled long conns also wait for the Gets not followed by a Put yet,
+	// only for callers which Put every conn they Get
+	TrackLeases bool `toml:"track_leases"`
+
+	// max conns handed out at once by the short connection pool, 0 for no limit
+	MaxInFlight int `toml:"max_in_flight"`
+	// how long Get waits for a conn once MaxInFlight is reached, 0 fails at once
+	MaxWaitMs int `toml:"max_wait_ms"`
+
+	// name of a resolver registered by RegisterResolver, the addrs of SvrName
+	// are then followed at runtime instead of the static Addrs
+	Resolver string `toml:"resolver"`
+
+	// round_robin (default), least_request, peak_ewma, p2c or one added by
+	// RegisterBalancer, long connection only. consistent_hash, ring_hash or
+	// maglev hash the key of GetByKey, Get keeps round robin then
+	Balancer string `toml:"balancer"`
+	// table used by GetByKey, ring_hash (default) or maglev, see Balancer
+	KeyHash string `toml:"key_hash"`
+	// circuit breaker per addr, long connection only
+	Breaker BreakerConfig `toml:"breaker"`
+	// retry and hedging policies, applied by the client interceptor
+	Retry RetryConfig `toml:"retry"`
+	// metrics of every rpc are observed by the client interceptor when set, see InitMetrics
+	MetricsPrefix string `toml:"metrics_prefix"`
+	// dial with tls instead of insecure, the dialOpts given must then not
+	// include grpc.WithInsecure
+	TLS TLSConfig `toml:"tls"`
+	// every rpc carries an HMAC token of Caller signed with it when set, tls
+	// only
+	HmacSecret string `toml:"hmac_secret"`
 }
 
 func NewGrpcClientBase(conf GrpcClientConfig, dialOpts ...grpc.DialOption) (base *GrpcClientBase, err error) {
+	var r Resolver
+	if conf.Resolver != "" {
+		var ok bool
+		if r, ok = GetResolver(conf.Resolver); !ok {
+			err = fmt.Errorf("resolver not registered||resolver=%v", conf.Resolver)
+			return
+		}
+	}
+	return NewGrpcClientBaseWithResolver(conf, r, dialOpts...)
+}
+
+// NewGrpcClientBaseWithResolver subscribes the pool to r when r is not nil
+func NewGrpcClientBaseWithResolver(
+	conf GrpcClientConfig,
+	r Resolver,
+	dialOpts ...grpc.DialOption) (base *GrpcClientBase, err error) {
 
 	if conf.DialTimeoutMs <= 0 {
 		conf.DialTimeoutMs = 200
@@ -81,12 +132,24 @@ func NewGrpcClientBase(conf GrpcClientConfig, dialOpts ...grpc.DialOption) (base
 		conf.PoolMaxAliveSec = 60
 	}
 
-	// try get addr from svr-addr mgr
+	// try get addr from svr-addr mgr, and follow its changes
 
-	if addrs := getAddrFromSvrMgr(conf.SvrName); addrs != nil {
-		if len(addrs.Addrs) > 0 {
-			conf.Addrs = addrs.Addrs
+	if mgr := GetClientAddrMgr(); r == nil && mgr != nil {
+		if addrs, _err := mgr.Resolve(conf.SvrName); _err == nil {
+			r = mgr
 			xlog.Info("_GrpcClientBase_init||use addrs from mgr||svrname=[%v]||addrs=%+v",
+				conf.SvrName,
+				addrStrings(addrs))
+		}
+	}
+
+	if r != nil {
+		addrs, _err := r.Resolve(conf.SvrName)
+		if _err != nil {
+			xlog.Warn("_GrpcClientBase_init||failed to resolve||svrname=[%v]||err=%v", conf.SvrName, _err)
+		} else if addrs = normalizeAddrs(addrs); len(addrs) > 0 {
+			conf.Addrs = addrStrings(addrs)
+			xlog.Info("_GrpcClientBase_init||use addrs from resolver||svrname=[%v]||addrs=%+v",
 				conf.SvrName,
 				conf.Addrs)
 		}
@@ -98,17 +161,60 @@ func NewGrpcClientBase(conf GrpcClientConfig, dialOpts ...grpc.DialOption) (base
 
 	base = &GrpcClientBase{
 		conf: conf,
+		mtx:  &sync.RWMutex{},
+	}
+	base.ctx, base.cancel = context.WithCancel(context.Background())
+	if conf.MetricsPrefix != "" {
+		base.InitMetrics(conf.MetricsPrefix)
+	}
+
+	dialOpts = append([]grpc.DialOption{}, dialOpts...)
+	if conf.TLS.Enable {
+		creds, _err := NewClientTLSCredentials(conf.TLS)
+		if _err != nil {
+			base.cancel()
+			return nil, fmt.Errorf("failed to load tls||svrname=%v||err=%v", conf.SvrName, _err)
+		}
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(creds))
+	} else if len(dialOpts) == 0 {
+		if conf.HmacSecret != "" {
+			base.cancel()
+			return nil, fmt.Errorf("hmac_secret requires tls||svrname=%v", conf.SvrName)
+		}
+		// an empty dialOpts still means insecure for the pools
+		dialOpts = []grpc.DialOption{grpc.WithInsecure()}
 	}
+	if conf.HmacSecret != "" {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(NewHmacCredentials(conf.Caller, conf.HmacSecret)))
+	}
+	dialOpts = append(dialOpts, base.interceptorDialOpts()...)
 	if !conf.LongConnection {
-		base.pool, _ = newShortGrpcClientPool(conf, dialOpts...)
+		pool, _err := newShortGrpcClientPool(conf, dialOpts...)
+		if _err != nil {
+			base.cancel()
+			return nil, _err
+		}
+		base.pool = pool
 	} else {
 		xlog.Info(" _GrpcClientBase_init||long_pool=true||conf=%v", conf)
 		base.pool, err = NewGrpcClientPool(conf, dialOpts...)
 		if err != nil {
+			base.cancel()
 			return nil, err
 		}
 	}
 
+	registerClient(base)
+
+	if r != nil {
+		addrCh, _err := r.Watch(base.ctx, conf.SvrName)
+		if _err != nil {
+			xlog.Warn("_GrpcClientBase_init||failed to watch||svrname=[%v]||err=%v", conf.SvrName, _err)
+		} else {
+			go base.watchAddrs(addrCh)
+		}
+	}
+
 	/*
 		base.pool, err = pool.NewGRPCPool(
 			&pool.Options{
@@ -127,9 +233,35 @@ func NewGrpcClientBase(conf GrpcClientConfig, dialOpts ...grpc.DialOption) (base
 
 type GrpcClientBase struct {
 	conf GrpcClientConfig
+	mtx  *sync.RWMutex
 	//pool *pool.GRPCPool
 	pool GrpcPool
 	metrics.MetricsBase
+
+	retrier     *retrier
+	autoMetrics bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (cli *GrpcClientBase) watchAddrs(addrCh <-chan []Address) {
+	for addrs := range addrCh {
+		if addrs = normalizeAddrs(addrs); len(addrs) == 0 {
+			// never drain the pool on an empty set, as pollWatch
+			xlog.Warn("_GrpcClientBase_watch||empty addrs||skip||svrname=%v", cli.conf.SvrName)
+			continue
+		}
+		if updater, ok := cli.pool.(AddrUpdater); ok {
+			updater.UpdateAddrs(addrs)
+		}
+		cli.mtx.Lock()
+		cli.conf.Addrs = addrStrings(addrs)
+		cli.mtx.Unlock()
+	}
+	if cli.ctx.Err() == nil {
+		xlog.Warn("_GrpcClientBase_watch||addr watch ended||svrname=%v", cli.conf.SvrName)
+	}
 }
 
 func (cli *GrpcClientBase) CreateMetrics(
@@ -156,9 +288,22 @@ const (
 	HEADER_PREFIX = "Grpc-"
 	HEADER_TRACE  = "grpc-trace-id"
 	HEADER_CALLER = "grpc-caller"
+
+	HEADER_AUTHORIZATION = "authorization"
+	// w3c trace context, see tracing.ParseTraceparent
+	HEADER_TRACEPARENT = tracing.HEADER_TRACEPARENT
 )
 
+// GetTimeout is GetTimeoutWithCancel leaving the ctx to be released by its timer
 func (cli *GrpcClientBase) GetTimeout(parentCtx local_context.TraceContext) (cctx context.Context) {
+	cctx, _ = cli.GetTimeoutWithCancel(parentCtx)
+	return
+}
+
+// GetTimeoutWithCancel returns the ctx of an rpc made on behalf of parentCtx,
+// with the trace md and a deadline of ReadTimeoutMs or the remaining deadline
+// of parentCtx, whichever is shorter
+func (cli *GrpcClientBase) GetTimeoutWithCancel(parentCtx local_context.TraceContext) (cctx context.Context, cancel context.CancelFunc) {
 	mdMap := map[string]string{
 		HEADER_TRACE: parentCtx.LogId(),
 	}
@@ -167,8 +312,23 @@ func (cli *GrpcClientBase) GetTimeout(parentCtx local_context.TraceContext) (cct
 	}
 	md := metadata.New(mdMap)
 	cctx = metadata.NewOutgoingContext(parentCtx, md)
-	cctx, _ = context.WithTimeout(cctx, time.Duration(cli.conf.ReadTimeoutMs)*time.Millisecond)
-	return
+	budget := cli.deadlineBudget(parentCtx)
+	if budget <= 0 {
+		xlog.Warn("_grpc_deadline||svrname=%v||logid=%v||deadline of parent exceeded", cli.conf.SvrName, parentCtx.LogId())
+	}
+	return context.WithTimeout(cctx, budget)
+}
+
+// deadlineBudget returns the min of ReadTimeoutMs and the time left before the
+// deadline of parentCtx, <= 0 when the deadline has passed
+func (cli *GrpcClientBase) deadlineBudget(parentCtx context.Context) time.Duration {
+	budget := time.Duration(cli.conf.ReadTimeoutMs) * time.Millisecond
+	if deadline, ok := parentCtx.Deadline(); ok {
+		if left := time.Until(deadline); left < budget {
+			budget = left
+		}
+	}
+	return budget
 }
 
 func (cli *GrpcClientBase) GetTimeoutFromCtx(parentCtx TraceContext) (cctx context.Context) {
@@ -179,20 +339,59 @@ func (cli *GrpcClientBase) Get() (conn *grpc.ClientConn, err error) {
 	return cli.pool.Get()
 }
 
+// GetByKey returns a conn of the addr key is hashed to, e.g. to route all the
+// requests of a user to the same backend for cache locality
+func (cli *GrpcClientBase) GetByKey(key string) (conn *grpc.ClientConn, err error) {
+	return cli.pool.GetByKey(key)
+}
+
 func (cli *GrpcClientBase) Put(conn *grpc.ClientConn) {
 	_ = cli.pool.Put(conn)
 }
 
 func (cli *GrpcClientBase) Conf() GrpcClientConfig {
+	cli.mtx.RLock()
+	defer cli.mtx.RUnlock()
 	return cli.conf
 }
 func (cli *GrpcClientBase) GetConf() GrpcClientConfig {
-	return cli.conf
+	return cli.Conf()
 }
 func (cli *GrpcClientBase) GetAddr() string {
+	cli.mtx.RLock()
+	defer cli.mtx.RUnlock()
+	if len(cli.conf.Addrs) == 0 {
+		return ""
+	}
 	return cli.conf.Addrs[rand.Intn(len(cli.conf.Addrs))]
 }
 
+// Stats returns a snapshot of the pool, see PoolStatsHandler
+func (cli *GrpcClientBase) Stats() PoolStats {
+	return cli.pool.Stats()
+}
+
+// HealthCheck fails unless an addr of the pool is healthy with its breaker not
+// open, see health.Checker
+func (cli *GrpcClientBase) HealthCheck(ctx context.Context) error {
+	stats := cli.Stats()
+	for _, addr := range stats.Addrs {
+		if addr.Healthy && addr.Breaker != BreakerOpen.String() {
+			return nil
+		}
+	}
+	return fmt.Errorf("no healthy addr||svr_name=%v||addrs=%v", stats.SvrName, len(stats.Addrs))
+}
+
 func (cli *GrpcClientBase) Close() {
+	unregisterClient(cli)
+	cli.cancel()
 	cli.pool.Close()
 }
+
+// Shutdown is Close waiting for the conns in use to be done until ctx is done
+func (cli *GrpcClientBase) Shutdown(ctx context.Context) error {
+	unregisterClient(cli)
+	cli.cancel()
+	return cli.pool.Shutdown(ctx)
+}
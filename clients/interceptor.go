@@ -0,0 +1,211 @@
+package clients
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/xutils/lib-common/local_context"
+	"github.com/xutils/lib-common/metrics"
+	"github.com/xutils/lib-common/tracing"
+	"github.com/xutils/lib-common/utils"
+	"github.com/xutils/lib-common/xlog"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// labels of the metrics observed by the client interceptor, method and err
+// take the same values as the ones of middleware.GrpcInterceptor
+var (
+	ClientTimecostLabels = []string{"method", "addr"}
+	ClientCountLabels    = []string{"method", "addr", "err", "caller"}
+)
+
+var grpcMethodReg = regexp.MustCompile(`\/([^\/]*)$`)
+
+func shortMethod(fullMethod string) string {
+	subStrs := grpcMethodReg.FindStringSubmatch(fullMethod)
+	if len(subStrs) > 1 {
+		return subStrs[1]
+	}
+	return fullMethod
+}
+
+// interceptorDialOpts builds the client interceptor chain installed on every
+// conn of the pool, the first one is the outermost
+func (cli *GrpcClientBase) interceptorDialOpts() (opts []grpc.DialOption) {
+	unary := []grpc.UnaryClientInterceptor{}
+	stream := []grpc.StreamClientInterceptor{}
+
+	if len(cli.conf.Retry.Policies) > 0 {
+		cli.retrier = newRetrier(cli, cli.conf.Retry)
+		unary = append(unary, cli.retrier.unaryInterceptor)
+		stream = append(stream, cli.retrier.streamInterceptor)
+	}
+
+	// inside retry so that every attempt is traced and observed on its own addr
+	unary = append(unary, cli.traceMetricsUnaryInterceptor)
+	stream = append(stream, cli.traceMetricsStreamInterceptor)
+
+	if len(unary) > 0 {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(unary...))
+	}
+	if len(stream) > 0 {
+		opts = append(opts, grpc.WithChainStreamInterceptor(stream...))
+	}
+	return
+}
+
+// InitMetrics creates the metrics observed by the client interceptor with
+// ClientTimecostLabels and ClientCountLabels and registers them, clients
+// sharing a prefix share the collectors
+func (cli *GrpcClientBase) InitMetrics(prefix string) {
+	cli.CreateMetricsV2(prefix, nil, ClientTimecostLabels, ClientCountLabels)
+	if err := cli.MetricsBase.Register(); err != nil {
+		xlog.Error("failed to register client metrics||prefix=%v||err=%v", prefix, err)
+		return
+	}
+	cli.autoMetrics = true
+}
+
+// startClientSpan starts the span of an attempt, child of the span of ctx
+func (cli *GrpcClientBase) startClientSpan(ctx context.Context, method, addr string) (context.Context, *tracing.Span) {
+	ctx, span := tracing.StartSpan(ctx, method, tracing.SpanKindClient)
+	if span.IsRecording() {
+		span.SetAttribute(tracing.AttrRpcSystem, "grpc")
+		span.SetAttribute(tracing.AttrRpcService, cli.conf.SvrName)
+		span.SetAttribute(tracing.AttrRpcMethod, method)
+		span.SetAttribute(tracing.AttrNetPeerName, addr)
+	}
+	return ctx, span
+}
+
+// traceOutgoingContext adds trace id and caller to the outgoing md unless the
+// caller already did, e.g. through GetTimeout, and the traceparent of the
+// span of ctx
+func (cli *GrpcClientBase) traceOutgoingContext(ctx context.Context) context.Context {
+	ctx = tracing.InjectOutgoing(ctx)
+	md, _ := metadata.FromOutgoingContext(ctx)
+	kv := []string{}
+	if len(md.Get(HEADER_TRACE)) == 0 {
+		if logId := traceIdFromContext(ctx); logId != "" {
+			kv = append(kv, HEADER_TRACE, logId)
+		}
+	}
+	if len(md.Get(HEADER_CALLER)) == 0 && cli.conf.Caller != "" {
+		kv = append(kv, HEADER_CALLER, cli.conf.Caller)
+	}
+	if len(kv) == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+func traceIdFromContext(ctx context.Context) string {
+	if tctx, ok := ctx.(TraceContext); ok {
+		return tctx.LogId()
+	}
+	if lctx, ok := local_context.FromContext(ctx); ok {
+		return lctx.LogId()
+	}
+	return ""
+}
+
+var deadlineMetrics = &metrics.MetricsBase{}
+
+// InitDeadlineMetrics creates and registers the counter of the rpcs failed with
+// DeadlineExceeded by svr_name and method, for all the clients
+func InitDeadlineMetrics(prefix string) {
+	deadlineMetrics.CreateMetricsCountVec(prefix, "grpc_client", "deadline_exceeded_cnt", []string{"svr_name", "method"})
+	if err := deadlineMetrics.Register(); err != nil {
+		xlog.Error("failed to register deadline metrics||prefix=%v||err=%v", prefix, err)
+	}
+}
+
+func (cli *GrpcClientBase) observe(method, addr string, t0 time.Time, err error) {
+	if status.Code(err) == codes.DeadlineExceeded {
+		deadlineMetrics.ObserveCounter(1, cli.conf.SvrName, shortMethod(method))
+	}
+	if !cli.autoMetrics {
+		return
+	}
+	method = shortMethod(method)
+	cli.Observe(utils.CalTimecost(t0), method, addr)
+	errType := ERR_SUCC
+	if err != nil {
+		errType = status.Code(err).String()
+	}
+	cli.ObserveCounter(1, method, addr, errType, cli.conf.Caller)
+}
+
+func (cli *GrpcClientBase) traceMetricsUnaryInterceptor(
+	ctx context.Context,
+	method string,
+	req, reply interface{},
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption) (err error) {
+	t0 := time.Now()
+	ctx, span := cli.startClientSpan(ctx, method, cc.Target())
+	ctx = cli.traceOutgoingContext(ctx)
+	err = invoker(ctx, method, req, reply, cc, opts...)
+	cli.observe(method, cc.Target(), t0, err)
+	span.Finish(err)
+	return
+}
+
+func (cli *GrpcClientBase) traceMetricsStreamInterceptor(
+	ctx context.Context,
+	desc *grpc.StreamDesc,
+	cc *grpc.ClientConn,
+	method string,
+	streamer grpc.Streamer,
+	opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	t0 := time.Now()
+	ctx, span := cli.startClientSpan(ctx, method, cc.Target())
+	ctx = cli.traceOutgoingContext(ctx)
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		cli.observe(method, cc.Target(), t0, err)
+		span.Finish(err)
+		return nil, err
+	}
+	return &observedClientStream{
+		ClientStream: stream,
+		once:         &sync.Once{},
+		finish: func(err error) {
+			cli.observe(method, cc.Target(), t0, err)
+			span.Finish(err)
+		},
+	}, nil
+}
+
+// observedClientStream observes the stream once it ends, either by io.EOF or an error
+type observedClientStream struct {
+	grpc.ClientStream
+	once   *sync.Once
+	finish func(err error)
+}
+
+func (s *observedClientStream) RecvMsg(m interface{}) (err error) {
+	err = s.ClientStream.RecvMsg(m)
+	if err == io.EOF {
+		s.once.Do(func() { s.finish(nil) })
+	} else if err != nil {
+		s.once.Do(func() { s.finish(err) })
+	}
+	return
+}
+
+func (s *observedClientStream) SendMsg(m interface{}) (err error) {
+	err = s.ClientStream.SendMsg(m)
+	if err != nil && err != io.EOF {
+		s.once.Do(func() { s.finish(err) })
+	}
+	return
+}
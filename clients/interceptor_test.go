@@ -0,0 +1,186 @@
+package clients
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xutils/lib-common/local_context"
+	"github.com/xutils/lib-common/tracing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type mdHealthServer struct {
+	grpc_health_v1.UnimplementedHealthServer
+	md metadata.MD
+}
+
+func (s *mdHealthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	s.md, _ = metadata.FromIncomingContext(ctx)
+	return &grpc_health_v1.HealthCheckResponse{}, nil
+}
+
+func TestTraceMetricsInterceptor(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	svr := &mdHealthServer{}
+	s := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(s, svr)
+	go func() {
+		_ = s.Serve(lis)
+	}()
+	defer s.Stop()
+	addr := lis.Addr().String()
+
+	cli, err := NewGrpcClientBase(GrpcClientConfig{
+		Addrs:         []string{addr},
+		Caller:        "test_caller",
+		MetricsPrefix: "test_client",
+	})
+	assert.Nil(t, err)
+	defer cli.Close()
+
+	conn, err := cli.Get()
+	assert.Nil(t, err)
+	defer cli.Put(conn)
+
+	// trace id is taken from the LocalContext the ctx is derived from
+	lctx := local_context.NewLocalContextWithTrace("trace_1")
+	ctx, cancel := context.WithCancel(lctx)
+	defer cancel()
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"trace_1"}, svr.md.Get(HEADER_TRACE))
+	assert.Equal(t, []string{"test_caller"}, svr.md.Get(HEADER_CALLER))
+
+	// the one set by GetTimeout is kept
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(
+		cli.GetTimeout(local_context.NewLocalContextWithTrace("trace_2")),
+		&grpc_health_v1.HealthCheckRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"trace_2"}, svr.md.Get(HEADER_TRACE))
+
+	counter := cli.GetTimeoutMetricsCounter().WithLabelValues("Check", addr, ERR_SUCC, "test_caller")
+	assert.Equal(t, float64(2), testutil.ToFloat64(counter))
+
+	// a second client with the same prefix shares the collectors
+	cli2, err := NewGrpcClientBase(GrpcClientConfig{
+		Addrs:         []string{addr},
+		Caller:        "test_caller",
+		MetricsPrefix: "test_client",
+	})
+	assert.Nil(t, err)
+	defer cli2.Close()
+	assert.Equal(t, cli.GetTimeoutMetricsCounter(), cli2.GetTimeoutMetricsCounter())
+}
+
+func TestClientSpans(t *testing.T) {
+	exporter := tracing.NewInMemoryExporter()
+	defer tracing.SetTracer(tracing.DefaultTracer())
+	tracing.SetTracer(tracing.NewTracer("test", tracing.AlwaysSample(), exporter))
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	svr := &mdHealthServer{}
+	s := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(s, svr)
+	go func() {
+		_ = s.Serve(lis)
+	}()
+	defer s.Stop()
+
+	cli, err := NewGrpcClientBase(GrpcClientConfig{
+		SvrName: "health_svr",
+		Addrs:   []string{lis.Addr().String()},
+	})
+	assert.Nil(t, err)
+	defer cli.Close()
+	conn, err := cli.Get()
+	assert.Nil(t, err)
+	defer cli.Put(conn)
+
+	ctx, parent := tracing.StartSpan(context.Background(), "handler", tracing.SpanKindServer)
+	lctx := local_context.NewLocalContextWithCtx(ctx)
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(cli.GetTimeout(lctx), &grpc_health_v1.HealthCheckRequest{})
+	assert.Nil(t, err)
+	parent.End()
+
+	spans := exporter.Spans()
+	assert.Equal(t, 2, len(spans))
+	span := spans[0]
+	assert.Equal(t, "/grpc.health.v1.Health/Check", span.Name)
+	assert.Equal(t, tracing.SpanKindClient, span.Kind)
+	assert.Equal(t, parent.Context.TraceID, span.Context.TraceID)
+	assert.Equal(t, parent.Context.SpanID, span.ParentID)
+	assert.Equal(t, "health_svr", span.Attributes[tracing.AttrRpcService])
+	// the server gets the client span as parent
+	assert.Equal(t, []string{span.Context.Traceparent()}, svr.md.Get(HEADER_TRACEPARENT))
+}
+
+type slowHealthServer struct {
+	grpc_health_v1.UnimplementedHealthServer
+}
+
+func (s *slowHealthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestDeadlineBudget(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(s, &slowHealthServer{})
+	go func() {
+		_ = s.Serve(lis)
+	}()
+	defer s.Stop()
+
+	InitDeadlineMetrics("test_deadline")
+	// a second init keeps the registered collector
+	assert.NotPanics(t, func() { InitDeadlineMetrics("test_deadline") })
+	cli, err := NewGrpcClientBase(GrpcClientConfig{
+		SvrName:       "deadline_svr",
+		Addrs:         []string{lis.Addr().String()},
+		ReadTimeoutMs: 1000,
+	})
+	assert.Nil(t, err)
+	defer cli.Close()
+
+	// no parent deadline, ReadTimeoutMs applies
+	cctx, cancel := cli.GetTimeoutWithCancel(local_context.NewLocalContextWithTrace("trace_1"))
+	deadline, ok := cctx.Deadline()
+	cancel()
+	assert.True(t, ok)
+	assert.InDelta(t, time.Second, time.Until(deadline), float64(100*time.Millisecond))
+
+	// the shorter parent deadline is kept
+	lctx := local_context.NewLocalContextWithTrace("trace_2")
+	lctx.Context, cancel = context.WithTimeout(lctx.Context, 100*time.Millisecond)
+	defer cancel()
+	cctx, cctxCancel := cli.GetTimeoutWithCancel(lctx)
+	defer cctxCancel()
+	deadline, _ = cctx.Deadline()
+	assert.True(t, time.Until(deadline) <= 100*time.Millisecond)
+
+	conn, err := cli.Get()
+	assert.Nil(t, err)
+	defer cli.Put(conn)
+	// the counter is kept across inits, so compare against its value before the rpc
+	timeouts := deadlineMetrics.GetTimeoutMetricsCounter().WithLabelValues("deadline_svr", "Check")
+	before := testutil.ToFloat64(timeouts)
+	t0 := time.Now()
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(cctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.True(t, time.Since(t0) < 500*time.Millisecond)
+	assert.Equal(t, before+1, testutil.ToFloat64(timeouts))
+}
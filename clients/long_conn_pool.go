@@ -38,6 +38,10 @@ type longConn struct {
 	conn     *grpc.ClientConn
 	ts       int64
 	addrStat *addrStats
+	// Gets not followed by a Put yet
+	leases int64
+	// rpcs and streams in flight on the conn
+	inflight int64
 }
 
 func newLongConn(conn *grpc.ClientConn, stats *addrStats) (c *longConn) {
@@ -49,6 +53,60 @@ func newLongConn(conn *grpc.ClientConn, stats *addrStats) (c *longConn) {
 	return
 }
 
+// busy is true while the conn carries rpcs, or is leased with TrackLeases,
+// it is not closed then unless the drain times out
+func (lconn *longConn) busy() bool {
+	return atomic.LoadInt64(&lconn.leases) > 0 || atomic.LoadInt64(&lconn.inflight) > 0
+}
+
+func (lconn *longConn) unaryInterceptor(
+	ctx context.Context,
+	method string,
+	req, reply interface{},
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption) error {
+	atomic.AddInt64(&lconn.inflight, 1)
+	defer atomic.AddInt64(&lconn.inflight, -1)
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// streamInterceptor counts the stream until it ends or its ctx is done
+func (lconn *longConn) streamInterceptor(
+	ctx context.Context,
+	desc *grpc.StreamDesc,
+	cc *grpc.ClientConn,
+	method string,
+	streamer grpc.Streamer,
+	opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	atomic.AddInt64(&lconn.inflight, 1)
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		atomic.AddInt64(&lconn.inflight, -1)
+		return nil, err
+	}
+	once := &sync.Once{}
+	ended := make(chan struct{})
+	finish := func(err error) {
+		once.Do(func() {
+			atomic.AddInt64(&lconn.inflight, -1)
+			close(ended)
+		})
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			finish(ctx.Err())
+		case <-ended:
+		}
+	}()
+	return &observedClientStream{
+		ClientStream: stream,
+		once:         &sync.Once{},
+		finish:       finish,
+	}, nil
+}
+
 var (
 	ErrConnShutdown = errors.New("grpc conn shutdown")
 	ErrLongConnNil  = errors.New("long conn wrapper nil")
@@ -61,10 +119,21 @@ const MaxReconnectCnt = 10
 
 const UNHEALTH_LOAD_SCORE = 2000000
 
+// recycled conns are kept at least drainGrace for the callers which just got them
+const drainGrace = time.Second
+
+const defaultDrainTimeoutSec = 10
+
 type addrStats struct {
 	loadScore *int64
 	idx       int
 	addr      string
+	weight    int
+	// set once the resolver drops the addr, conns on it are recycled
+	removed int32
+	// nil when breaker is not enabled
+	breaker *circuitBreaker
+	load    *addrLoad
 }
 
 func newAddrStats(idx int, addr string) *addrStats {
@@ -72,9 +141,24 @@ func newAddrStats(idx int, addr string) *addrStats {
 		loadScore: new(int64),
 		idx:       idx,
 		addr:      addr,
+		weight:    1,
+		load:      newAddrLoad(),
 	}
 }
 
+func (stat *addrStats) score() int64 {
+	return atomic.LoadInt64(stat.loadScore)
+}
+
+func (stat *addrStats) isRemoved() bool {
+	return atomic.LoadInt32(&stat.removed) == 1
+}
+
+// isReady is false while the breaker of the addr is open
+func (stat *addrStats) isReady() bool {
+	return stat.breaker == nil || stat.breaker.Ready()
+}
+
 type GrpcClientPool struct {
 	conf     GrpcClientConfig
 	mtx      *sync.Mutex
@@ -87,6 +171,25 @@ type GrpcClientPool struct {
 	w        *weighted.SW
 
 	connStats []*addrStats
+	refresh   chan struct{}
+	// nil for round robin over the conns
+	balancer Balancer
+	// used by GetByKey
+	keyBalancer Balancer
+
+	// conns recycled by the balance worker
+	recycledCnt   int64
+	lastBalanceTs int64
+
+	// *grpc.ClientConn to its *longConn, for Put
+	leases sync.Map
+	// conns waiting for their leases and rpcs to end before being closed
+	draining     map[*longConn]struct{}
+	drainWg      *sync.WaitGroup
+	drainStopped bool
+	forceDone    chan struct{}
+	forceOnce    *sync.Once
+	closed       int32
 
 	dialOpts []grpc.DialOption
 }
@@ -96,6 +199,9 @@ func NewGrpcClientPool(conf GrpcClientConfig, opt ...grpc.DialOption) (pool *Grp
 	if conf.PoolSize < len(conf.Addrs) {
 		conf.PoolSize = len(conf.Addrs)
 	}
+	if conf.DrainTimeoutSec <= 0 {
+		conf.DrainTimeoutSec = defaultDrainTimeoutSec
+	}
 
 	pool = &GrpcClientPool{
 		conf:     conf,
@@ -104,6 +210,12 @@ func NewGrpcClientPool(conf GrpcClientConfig, opt ...grpc.DialOption) (pool *Grp
 		capacity: int64(conf.PoolSize),
 		conns:    make([]*longConn, conf.PoolSize),
 		w:        &weighted.SW{},
+		refresh:  make(chan struct{}, 1),
+
+		draining:  map[*longConn]struct{}{},
+		drainWg:   &sync.WaitGroup{},
+		forceDone: make(chan struct{}),
+		forceOnce: &sync.Once{},
 
 		dialOpts: opt,
 	}
@@ -120,11 +232,25 @@ func NewGrpcClientPool(conf GrpcClientConfig, opt ...grpc.DialOption) (pool *Grp
 			Timeout: time.Duration(pool.conf.KeepAliveTimeOut) * time.Second,
 		}))
 
+	keyHash, err := keyHashOf(conf)
+	if err != nil {
+		return nil, err
+	}
+	if pool.keyBalancer, err = newKeyBalancer(keyHash); err != nil {
+		return nil, err
+	}
+	// a key hash balancer only serves GetByKey, Get keeps round robin
+	if keyHashName(conf.Balancer) == "" {
+		if pool.balancer, err = newBalancer(conf.Balancer); err != nil {
+			return nil, err
+		}
+	}
+
 	pool.connStats = make([]*addrStats, len(conf.Addrs))
 
 	// init conn counts
 	for idx, _ := range pool.connStats {
-		stat := newAddrStats(idx, conf.Addrs[idx])
+		stat := pool.newAddrStats(idx, conf.Addrs[idx])
 		pool.w.Add(stat, 1)
 		pool.connStats[idx] = stat
 	}
@@ -137,6 +263,14 @@ func NewGrpcClientPool(conf GrpcClientConfig, opt ...grpc.DialOption) (pool *Grp
 	return
 }
 
+func (pool *GrpcClientPool) newAddrStats(idx int, addr string) (stat *addrStats) {
+	stat = newAddrStats(idx, addr)
+	if pool.conf.Breaker.Enable {
+		stat.breaker = newCircuitBreaker(pool.conf.Breaker, breakerStateChangeFunc(pool.conf.SvrName, addr))
+	}
+	return
+}
+
 func (pool *GrpcClientPool) debugConn(action string, conn *grpc.ClientConn) {
 	//xlog.Debug("act=%v||conn=%p", action, conn)
 }
@@ -146,22 +280,20 @@ func (pool *GrpcClientPool) balanceWorker() {
 	connToRecycle := []*longConn{}
 	for {
 		select {
-		case <-ticker:
-
-			connToRecycle = pool.checkLongConns()
-			time.Sleep(time.Second)
-			xlog.Debug("lconns to recycle=%v", len(connToRecycle))
-			//close long conns to do recycle from last round
-			for _, lconn := range connToRecycle {
-				if lconn != nil && lconn.conn != nil {
-					_ = lconn.conn.Close()
-					pool.debugConn("close", lconn.conn)
-				}
-			}
 		// do ttl check
+		case <-ticker:
+		// addrs changed by resolver
+		case <-pool.refresh:
 		case <-pool.ctx.Done():
 			return
 		}
+
+		connToRecycle = pool.checkLongConns()
+		xlog.Debug("lconns to recycle=%v", len(connToRecycle))
+		//close long conns to do recycle from last round once drained
+		for _, lconn := range connToRecycle {
+			pool.drain(lconn, drainGrace)
+		}
 	}
 }
 
@@ -170,19 +302,21 @@ func (pool *GrpcClientPool) checkLongConns() (connToRecycle []*longConn) {
 	idxToReconnect := map[*longConn]int{}
 	idxToNewConnect := []int{}
 	connSlice := longConnSlice{}
-	healthCountMap := map[int]int64{}
+	healthCountMap := map[*addrStats]int64{}
 
-	for idx, lconn := range pool.conns {
+	for idx, lconn := range pool.connsSnapshot() {
 		if lconn == nil || lconn.addrStat == nil {
 			xlog.Warn("idx=%v||lconn nil or addrStat nil||lconn=%+v", idx, lconn)
 			idxToNewConnect = append(idxToNewConnect, idx)
 			continue
 		}
-		if _, ok := healthCountMap[lconn.addrStat.idx]; ok {
-			healthCountMap[lconn.addrStat.idx] += 1
-		} else {
-			healthCountMap[lconn.addrStat.idx] = 1
+		if lconn.addrStat.isRemoved() {
+			// addr dropped by resolver, move the conn without waiting for ttl
+			xlog.Info("idx=%v||addr=%v||addr removed||reconnect", idx, lconn.addrStat.addr)
+			idxToNewConnect = append(idxToNewConnect, idx)
+			continue
 		}
+		healthCountMap[lconn.addrStat] += 1
 		if nowTs-lconn.ts > pool.conf.PoolMaxAliveSec {
 			//xlog.Debug("idx=%v||addr=%v||timemout||ts=%v", connIdx, lconn.addrStat.addr, lconn.ts)
 			idxToReconnect[lconn] = idx
@@ -192,13 +326,16 @@ func (pool *GrpcClientPool) checkLongConns() (connToRecycle []*longConn) {
 
 	//xlog.Info("[%v]||healthCountMap=%v", pool.conf.Addrs[0], healthCountMap)
 	// check health conn count
-	for addIdx, stat := range pool.connStats {
+	pool.mapMtx.RLock()
+	connStats := pool.connStats
+	pool.mapMtx.RUnlock()
+	for _, stat := range connStats {
 		if *(stat.loadScore) < UNHEALTH_LOAD_SCORE {
 			// reset health conn count
-			atomic.StoreInt64(stat.loadScore, healthCountMap[addIdx])
+			atomic.StoreInt64(stat.loadScore, healthCountMap[stat])
 		} else {
 			// try get long connection
-			conn, err := pool.connectAddr(stat.addr)
+			lconn, err := pool.connectAddr(stat)
 			if err != nil {
 				xlog.Warn("try connect addr and still failed||idx=%v||addr=%v||err=%+v",
 					stat.idx, stat.addr, err)
@@ -206,7 +343,7 @@ func (pool *GrpcClientPool) checkLongConns() (connToRecycle []*longConn) {
 				xlog.Info("try connect add||recovered||idx=%v||addr=%v||err=%+v",
 					stat.idx, stat.addr, err)
 				atomic.StoreInt64(stat.loadScore, 0)
-				_ = conn.Close()
+				pool.closeLongConn(lconn)
 			}
 		}
 		//xlog.Debug("addidx=%v||stat=%v", addIdx, *(stat.loadScore))
@@ -247,6 +384,8 @@ func (pool *GrpcClientPool) checkLongConns() (connToRecycle []*longConn) {
 		connToRecycle = append(connToRecycle, pool.conns[idx])
 		pool.conns[idx] = newLconn
 	}
+	atomic.AddInt64(&pool.recycledCnt, int64(len(connToRecycle)))
+	atomic.StoreInt64(&pool.lastBalanceTs, nowTs)
 	return
 }
 
@@ -287,15 +426,71 @@ func (pool *GrpcClientPool) checkState(lconn *longConn) error {
 }
 
 func (pool *GrpcClientPool) randAddr() (stat *addrStats) {
-	for i := 0; i < len(pool.conf.Addrs); i++ {
+	pool.mapMtx.Lock()
+	defer pool.mapMtx.Unlock()
+	for i := 0; i < len(pool.connStats); i++ {
 		stat, _ = pool.w.Next().(*addrStats)
-		if *(stat.loadScore) < UNHEALTH_LOAD_SCORE {
+		if stat != nil && *(stat.loadScore) < UNHEALTH_LOAD_SCORE && stat.isReady() {
 			return stat
 		}
 	}
 	return
 }
 
+// UpdateAddrs replaces the addr set of the pool, stats of the kept addrs are
+// reserved, conns on removed addrs are moved to the remaining ones on the next
+// balance round which is triggered immediately. the pool grows to one conn per
+// addr at least
+func (pool *GrpcClientPool) UpdateAddrs(addrs []Address) {
+	addrs = normalizeAddrs(addrs)
+	if len(addrs) == 0 {
+		xlog.Warn("_grpc_pool_update||empty addrs||skip||svrname=%v", pool.conf.SvrName)
+		return
+	}
+
+	pool.mapMtx.Lock()
+	oldStats := map[string]*addrStats{}
+	for _, stat := range pool.connStats {
+		oldStats[stat.addr] = stat
+	}
+	connStats := make([]*addrStats, 0, len(addrs))
+	w := &weighted.SW{}
+	for idx, addr := range addrs {
+		stat, ok := oldStats[addr.Addr]
+		if ok {
+			delete(oldStats, addr.Addr)
+			stat.idx = idx
+		} else {
+			stat = pool.newAddrStats(idx, addr.Addr)
+		}
+		stat.weight = addrWeight(addr)
+		w.Add(stat, stat.weight)
+		connStats = append(connStats, stat)
+	}
+	for _, stat := range oldStats {
+		atomic.StoreInt32(&stat.removed, 1)
+		removeBreakerMetrics(pool.conf.SvrName, stat.addr)
+	}
+	pool.connStats = connStats
+	pool.w = w
+	pool.conf.Addrs = addrStrings(addrs)
+	pool.mapMtx.Unlock()
+
+	// every addr gets at least a conn, as done by NewGrpcClientPool
+	pool.mtx.Lock()
+	if len(addrs) > len(pool.conns) {
+		pool.growLocked(len(addrs))
+	}
+	pool.mtx.Unlock()
+
+	xlog.Info("_grpc_pool_update||svrname=%v||addrs=%v||removed=%v",
+		pool.conf.SvrName, pool.conf.Addrs, len(oldStats))
+	select {
+	case pool.refresh <- struct{}{}:
+	default:
+	}
+}
+
 func (pool *GrpcClientPool) connect(retry int) (*longConn, error) {
 	addrStat := pool.randAddr()
 	if addrStat == nil {
@@ -304,7 +499,7 @@ func (pool *GrpcClientPool) connect(retry int) (*longConn, error) {
 	addr, _ := addrStat.addr, addrStat.idx
 	atomic.AddInt64(addrStat.loadScore, 1)
 	//xlog.Debug("create connect||addrIdx=%v||stat=%v", addrIdx, *(addrStat.loadScore))
-	conn, err := pool.connectAddr(addr)
+	lconn, err := pool.connectAddr(addrStat)
 	if err != nil {
 		atomic.AddInt64(addrStat.loadScore, UNHEALTH_LOAD_SCORE)
 		if retry < 1 {
@@ -314,24 +509,112 @@ func (pool *GrpcClientPool) connect(retry int) (*longConn, error) {
 		xlog.Error("failed to connect to %v||retry=%v||err=%v", addr, retry, err)
 		return nil, err
 	}
-	lconn := newLongConn(conn, addrStat)
 	return lconn, nil
 }
 
-func (pool *GrpcClientPool) connectAddr(addr string) (conn *grpc.ClientConn, err error) {
-	ctx, _ := context.WithTimeout(context.Background(), time.Millisecond*500)
-	conn, err = grpc.DialContext(
+func (pool *GrpcClientPool) connectAddr(stat *addrStats) (lconn *longConn, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	lconn = newLongConn(nil, stat)
+	interceptors := []grpc.UnaryClientInterceptor{lconn.unaryInterceptor, stat.load.unaryInterceptor}
+	if stat.breaker != nil {
+		interceptors = append(interceptors, stat.breaker.unaryInterceptor(stat.addr))
+	}
+	dialOpts := append(append([]grpc.DialOption{}, pool.dialOpts...),
+		grpc.WithChainUnaryInterceptor(interceptors...),
+		grpc.WithChainStreamInterceptor(lconn.streamInterceptor))
+	lconn.conn, err = grpc.DialContext(
 		ctx,
-		addr,
-		pool.dialOpts...,
+		stat.addr,
+		dialOpts...,
 	)
-	if conn != nil {
-		pool.debugConn("connect", conn)
+	if err != nil {
+		return nil, err
 	}
+	pool.leases.Store(lconn.conn, lconn)
+	pool.debugConn("connect", lconn.conn)
 	return
 }
 
-func (pool *GrpcClientPool) getConn() (conn *grpc.ClientConn, err error) {
+// closeLongConn closes lconn at once, whatever it carries
+func (pool *GrpcClientPool) closeLongConn(lconn *longConn) {
+	if lconn == nil || lconn.conn == nil {
+		return
+	}
+	pool.leases.Delete(lconn.conn)
+	_ = lconn.conn.Close()
+	pool.debugConn("close", lconn.conn)
+}
+
+// drain closes lconn once it is not busy anymore, or after DrainTimeoutSec,
+// grace leaves time to the callers which got the conn right before it was
+// swapped out of the pool to lease it
+func (pool *GrpcClientPool) drain(lconn *longConn, grace time.Duration) {
+	if lconn == nil || lconn.conn == nil {
+		return
+	}
+	pool.mtx.Lock()
+	started := pool.drainLocked(lconn, grace)
+	pool.mtx.Unlock()
+	if !started {
+		// the pool is shut down, nobody waits for the conn anymore
+		pool.closeLongConn(lconn)
+	}
+}
+
+// drainLocked returns false once Shutdown stopped new drains
+func (pool *GrpcClientPool) drainLocked(lconn *longConn, grace time.Duration) bool {
+	if pool.drainStopped {
+		return false
+	}
+	if _, exist := pool.draining[lconn]; exist {
+		return true
+	}
+	pool.draining[lconn] = struct{}{}
+	pool.drainWg.Add(1)
+
+	go func() {
+		defer pool.drainWg.Done()
+		if !pool.waitIdle(lconn, grace) {
+			xlog.Warn("_grpc_pool_drain||timeout||svrname=%v||addr=%v||leases=%v||inflight=%v",
+				pool.conf.SvrName, lconn.addrStat.addr,
+				atomic.LoadInt64(&lconn.leases), atomic.LoadInt64(&lconn.inflight))
+		}
+		pool.mtx.Lock()
+		delete(pool.draining, lconn)
+		pool.mtx.Unlock()
+		pool.closeLongConn(lconn)
+	}()
+	return true
+}
+
+// waitIdle returns false if lconn is still busy after the drain timeout or
+// the pool is closed
+func (pool *GrpcClientPool) waitIdle(lconn *longConn, grace time.Duration) bool {
+	deadline := time.Now().Add(time.Duration(pool.conf.DrainTimeoutSec) * time.Second)
+	if grace > 0 {
+		select {
+		case <-time.After(grace):
+		case <-pool.forceDone:
+			return false
+		}
+	}
+	ticker := time.NewTicker(time.Millisecond * 50)
+	defer ticker.Stop()
+	for lconn.busy() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		select {
+		case <-ticker.C:
+		case <-pool.forceDone:
+			return false
+		}
+	}
+	return true
+}
+
+func (pool *GrpcClientPool) getConn(key string) (conn *grpc.ClientConn, err error) {
 	var (
 		idx  int64
 		next int64
@@ -342,8 +625,14 @@ func (pool *GrpcClientPool) getConn() (conn *grpc.ClientConn, err error) {
 	if next > MaxNext {
 		atomic.SwapInt64(&pool.next, 0)
 	}
-	idx = next % pool.capacity
-	lconn = pool.conns[idx]
+	conns := pool.connsSnapshot()
+	idx = next % int64(len(conns))
+	if balancedIdx, ok := pool.balancedIdx(conns, key, next); ok {
+		idx = balancedIdx
+	} else {
+		idx = pool.readyIdx(conns, idx)
+	}
+	lconn = conns[idx]
 
 	if err = pool.checkState(lconn); err == nil && lconn != nil {
 		return lconn.conn, nil
@@ -352,10 +641,7 @@ func (pool *GrpcClientPool) getConn() (conn *grpc.ClientConn, err error) {
 	}
 
 	// gc old conn
-	if lconn != nil && lconn.conn != nil {
-		_ = lconn.conn.Close()
-		pool.debugConn("close", lconn.conn)
-	}
+	pool.closeLongConn(lconn)
 
 	pool.mtx.Lock()
 	defer pool.mtx.Unlock()
@@ -373,10 +659,83 @@ func (pool *GrpcClientPool) getConn() (conn *grpc.ClientConn, err error) {
 	return lconn.conn, nil
 }
 
+// connsSnapshot copies the conns, checkLongConns swaps them under mtx
+func (pool *GrpcClientPool) connsSnapshot() []*longConn {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+	return append([]*longConn{}, pool.conns...)
+}
+
+// readyIdx skips conns whose addr breaker is open, idx is kept if none is ready
+func (pool *GrpcClientPool) readyIdx(conns []*longConn, idx int64) int64 {
+	for i := int64(0); i < int64(len(conns)); i++ {
+		cur := (idx + i) % int64(len(conns))
+		lconn := conns[cur]
+		if lconn == nil || lconn.addrStat == nil || lconn.addrStat.isReady() {
+			return cur
+		}
+	}
+	return idx
+}
+
+// balancedIdx lets the balancer pick the addr among the healthy ones holding a
+// conn, the conns of the picked addr are used in turn
+func (pool *GrpcClientPool) balancedIdx(conns []*longConn, key string, next int64) (idx int64, ok bool) {
+	if pool.balancer == nil {
+		return
+	}
+	idxMap := map[*addrStats][]int64{}
+	nodes := []BalancerNode{}
+	for i, lconn := range conns {
+		if lconn == nil || lconn.addrStat == nil {
+			continue
+		}
+		stat := lconn.addrStat
+		if _, exist := idxMap[stat]; !exist {
+			if stat.isRemoved() || !stat.isReady() || atomic.LoadInt64(stat.loadScore) >= UNHEALTH_LOAD_SCORE {
+				continue
+			}
+			nodes = append(nodes, stat)
+		}
+		idxMap[stat] = append(idxMap[stat], int64(i))
+	}
+	if len(nodes) == 0 {
+		return
+	}
+	picked, _ := pool.balancer.Pick(nodes, key).(*addrStats)
+	idxs, exist := idxMap[picked]
+	if !exist {
+		return
+	}
+	return idxs[next%int64(len(idxs))], true
+}
+
+// Get leases a conn of the pool, with TrackLeases Put it back once the rpcs
+// are done so that it can be drained when recycled
 func (pool *GrpcClientPool) Get() (conn *grpc.ClientConn, err error) {
+	if atomic.LoadInt32(&pool.closed) == 1 {
+		return nil, ErrPoolClosed
+	}
+	return pool.lease(pool.get())
+}
+
+func (pool *GrpcClientPool) lease(conn *grpc.ClientConn, err error) (*grpc.ClientConn, error) {
+	if err != nil || conn == nil {
+		return conn, err
+	}
+	if !pool.conf.TrackLeases {
+		return conn, nil
+	}
+	if v, ok := pool.leases.Load(conn); ok {
+		atomic.AddInt64(&v.(*longConn).leases, 1)
+	}
+	return conn, nil
+}
+
+func (pool *GrpcClientPool) get() (conn *grpc.ClientConn, err error) {
 
 	for i := 0; i < get_conn_retry; i++ {
-		conn, err = pool.getConn()
+		conn, err = pool.getConn("")
 		if conn != nil {
 			return
 		}
@@ -388,20 +747,219 @@ func (pool *GrpcClientPool) Get() (conn *grpc.ClientConn, err error) {
 	return
 }
 
-func (pool *GrpcClientPool) Put(conn *grpc.ClientConn) error {
+// GetByKey returns a conn dialed to the addr key is hashed to, a key sticks to
+// its addr as long as the addr stays healthy and in the addr set
+func (pool *GrpcClientPool) GetByKey(key string) (conn *grpc.ClientConn, err error) {
+	if atomic.LoadInt32(&pool.closed) == 1 {
+		return nil, ErrPoolClosed
+	}
+	return pool.lease(pool.getByKey(key))
+}
+
+func (pool *GrpcClientPool) getByKey(key string) (conn *grpc.ClientConn, err error) {
+	if key == "" {
+		return pool.get()
+	}
+	pool.mapMtx.RLock()
+	nodes := []BalancerNode{}
+	for _, stat := range pool.connStats {
+		if stat.isReady() && atomic.LoadInt64(stat.loadScore) < UNHEALTH_LOAD_SCORE {
+			nodes = append(nodes, stat)
+		}
+	}
+	pool.mapMtx.RUnlock()
+	if len(nodes) == 0 {
+		return pool.get()
+	}
+	stat, _ := pool.keyBalancer.Pick(nodes, key).(*addrStats)
+	if stat == nil {
+		return pool.get()
+	}
+	return pool.getConnOfAddr(stat)
+}
 
+func connsOfAddr(conns []*longConn, stat *addrStats) (idxs []int64) {
+	for i, lconn := range conns {
+		if lconn == nil || lconn.conn == nil || lconn.addrStat != stat {
+			continue
+		}
+		switch lconn.conn.GetState() {
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			continue
+		}
+		idxs = append(idxs, int64(i))
+	}
+	return
+}
+
+// getConnOfAddr uses the conns of the addr in turn, a slot of the pool is taken
+// over for the addr when it holds none, see takeOverIdxLocked
+func (pool *GrpcClientPool) getConnOfAddr(stat *addrStats) (conn *grpc.ClientConn, err error) {
+	next := atomic.AddInt64(&pool.next, 1)
+	if next > MaxNext {
+		atomic.SwapInt64(&pool.next, 0)
+	}
+	conns := pool.connsSnapshot()
+	if idxs := connsOfAddr(conns, stat); len(idxs) > 0 {
+		return conns[idxs[next%int64(len(idxs))]].conn, nil
+	}
+
+	lconn, err := pool.connectAddr(stat)
+	if err != nil {
+		xlog.Error("failed to connect to %v for key||err=%v", stat.addr, err)
+		return nil, err
+	}
+
+	pool.mtx.Lock()
+	if idxs := connsOfAddr(pool.conns, stat); len(idxs) > 0 {
+		// dialed by another caller meanwhile
+		pool.mtx.Unlock()
+		pool.closeLongConn(lconn)
+		return pool.conns[idxs[0]].conn, nil
+	}
+	idx := pool.takeOverIdxLocked(next)
+	old := pool.conns[idx]
+	pool.conns[idx] = lconn
+	pool.mtx.Unlock()
+
+	xlog.Info("_grpc_pool_key||slot taken over||idx=%v||addr=%v", idx, stat.addr)
+	pool.drain(old, drainGrace)
+	return lconn.conn, nil
+}
+
+// takeOverIdxLocked returns a slot which can go to another addr: an empty one,
+// one of a removed addr or one of an addr holding more than one conn. the pool
+// grows by a slot when every addr holds a single conn
+func (pool *GrpcClientPool) takeOverIdxLocked(next int64) int64 {
+	connCnt := map[*addrStats]int{}
+	for _, lconn := range pool.conns {
+		if lconn != nil && lconn.addrStat != nil {
+			connCnt[lconn.addrStat]++
+		}
+	}
+	size := int64(len(pool.conns))
+	for i := int64(0); i < size; i++ {
+		idx := (next + i) % size
+		lconn := pool.conns[idx]
+		if lconn == nil || lconn.addrStat == nil || lconn.addrStat.isRemoved() || connCnt[lconn.addrStat] > 1 {
+			return idx
+		}
+	}
+	pool.growLocked(len(pool.conns) + 1)
+	return size
+}
+
+// growLocked adds empty slots up to size, they are dialed by the next balance round
+func (pool *GrpcClientPool) growLocked(size int) {
+	for len(pool.conns) < size {
+		pool.conns = append(pool.conns, nil)
+	}
+	atomic.StoreInt64(&pool.capacity, int64(len(pool.conns)))
+	xlog.Info("_grpc_pool_grow||svrname=%v||capacity=%v", pool.conf.SvrName, len(pool.conns))
+}
+
+func (pool *GrpcClientPool) Stats() (stats PoolStats) {
+	nowTs := time.Now().Unix()
+	stats = PoolStats{
+		SvrName:        pool.conf.SvrName,
+		Caller:         pool.conf.Caller,
+		LongConnection: true,
+		Balancer:       pool.conf.Balancer,
+		Capacity:       int(atomic.LoadInt64(&pool.capacity)),
+		RecycledCnt:    atomic.LoadInt64(&pool.recycledCnt),
+		LastBalanceTs:  atomic.LoadInt64(&pool.lastBalanceTs),
+	}
+	if stats.Balancer == "" {
+		stats.Balancer = BalancerRoundRobin
+	}
+
+	connCnt := map[*addrStats]int{}
+	pool.mtx.Lock()
+	for idx, lconn := range pool.conns {
+		s := PoolConnStats{Idx: idx}
+		if lconn != nil && lconn.conn != nil {
+			s.State = lconn.conn.GetState().String()
+			s.Ts = lconn.ts
+			s.AgeSec = nowTs - lconn.ts
+			s.Leases = atomic.LoadInt64(&lconn.leases)
+			s.InFlight = atomic.LoadInt64(&lconn.inflight)
+		}
+		if lconn != nil && lconn.addrStat != nil {
+			s.Addr = lconn.addrStat.addr
+			connCnt[lconn.addrStat]++
+		}
+		stats.Conns = append(stats.Conns, s)
+	}
+	stats.Draining = len(pool.draining)
+	pool.mtx.Unlock()
+
+	pool.mapMtx.RLock()
+	for _, stat := range pool.connStats {
+		s := stat.poolAddrStats()
+		s.Conns = connCnt[stat]
+		stats.Addrs = append(stats.Addrs, s)
+	}
+	pool.mapMtx.RUnlock()
+	return
+}
+
+// Put ends the lease taken by Get, the conn stays in the pool
+func (pool *GrpcClientPool) Put(conn *grpc.ClientConn) error {
+	if conn == nil {
+		return nil
+	}
+	if v, ok := pool.leases.Load(conn); ok {
+		lconn := v.(*longConn)
+		if atomic.AddInt64(&lconn.leases, -1) < 0 {
+			// put twice
+			atomic.StoreInt64(&lconn.leases, 0)
+		}
+	}
 	return nil
 }
 
+// Close closes all the conns at once, in-flight rpcs are cut
 func (pool *GrpcClientPool) Close() {
+	atomic.StoreInt32(&pool.closed, 1)
+	pool.cancel()
+	pool.forceOnce.Do(func() { close(pool.forceDone) })
+	pool.mtx.Lock()
+	lconns := append([]*longConn{}, pool.conns...)
+	for lconn := range pool.draining {
+		lconns = append(lconns, lconn)
+	}
+	pool.mtx.Unlock()
+	for _, lconn := range lconns {
+		pool.closeLongConn(lconn)
+	}
+}
+
+// Shutdown refuses new Gets and closes every conn once its rpcs, and leases
+// with TrackLeases, are done, conns still busy when ctx is done are closed at once
+func (pool *GrpcClientPool) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&pool.closed, 1)
 	pool.cancel()
 	pool.mtx.Lock()
-	defer pool.mtx.Unlock()
 	for _, lconn := range pool.conns {
-		if lconn == nil || lconn.conn == nil {
-			continue
+		if lconn != nil && lconn.conn != nil {
+			pool.drainLocked(lconn, 0)
 		}
-		pool.debugConn("close", lconn.conn)
-		_ = lconn.conn.Close()
+	}
+	// drainWg is waited below, no drain is added from now on
+	pool.drainStopped = true
+	pool.mtx.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		pool.drainWg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		xlog.Warn("_grpc_pool_shutdown||drain not finished||svrname=%v||err=%v", pool.conf.SvrName, ctx.Err())
+		pool.Close()
+		return ctx.Err()
 	}
 }
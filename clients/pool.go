@@ -1,17 +1,40 @@
 package clients
 
 import (
+	"context"
 	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/smallnest/weighted"
+
+	"github.com/xutils/lib-common/metrics"
+	"github.com/xutils/lib-common/xlog"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
 )
 
 const get_conn_retry = 3
 
 type GrpcPool interface {
 	Get() (conn *grpc.ClientConn, err error)
+	// GetByKey sticks the same key to the same addr
+	GetByKey(key string) (conn *grpc.ClientConn, err error)
 	Put(conn *grpc.ClientConn) error
 	Close()
+	// Shutdown stops handing out conns and waits for the ones in use to be done
+	// until ctx is done
+	Shutdown(ctx context.Context) error
+	// Stats returns a snapshot of the conns and addrs of the pool
+	Stats() PoolStats
+}
+
+// AddrUpdater is implemented by pools following the addr changes pushed by a Resolver
+type AddrUpdater interface {
+	UpdateAddrs(addrs []Address)
 }
 
 // TODO: add health check optimize for short conn
@@ -27,41 +50,439 @@ func randAddr(addrs []string) (string, int) {
 /**
 ####################################################################################
 USE SHORT CONNECTION
+conns are dialed per addr on demand, put back ones are kept idle for reuse up to
+PoolSize and closed after IdleTimeoutSec. MaxInFlight bounds the conns handed
+out at once, Get waits up to MaxWaitMs for one to be put back
 */
 
+const defaultShortPoolSize = 10
+
+// ErrPoolExhausted is returned by Get when MaxInFlight conns are in use
+var ErrPoolExhausted = status.Error(codes.ResourceExhausted, "grpc pool exhausted")
+
+// ErrPoolClosed is returned by Get once the pool is closed
+var ErrPoolClosed = status.Error(codes.Unavailable, "grpc pool closed")
+
 func newShortGrpcClientPool(conf GrpcClientConfig, opt ...grpc.DialOption) (pool *ShortGrpcPool, err error) {
+	if conf.PoolSize <= 0 {
+		conf.PoolSize = defaultShortPoolSize
+	}
+	if conf.IdleTimeoutSec <= 0 {
+		conf.IdleTimeoutSec = 60
+	}
+	keyHash, err := keyHashOf(conf)
+	if err != nil {
+		return nil, err
+	}
+	keyBalancer, err := newKeyBalancer(keyHash)
+	if err != nil {
+		return nil, err
+	}
 	pool = &ShortGrpcPool{
-		conf:     conf,
-		dialOpts: opt,
+		conf:        conf,
+		dialOpts:    opt,
+		mtx:         &sync.Mutex{},
+		addrs:       normalizeAddrs(addrsFromStrings(conf.Addrs)),
+		keyBalancer: keyBalancer,
+		idle:        map[string][]*idleConn{},
+		leased:      map[*grpc.ClientConn]string{},
+		done:        make(chan struct{}),
 	}
 	if len(pool.dialOpts) == 0 {
 		pool.dialOpts = []grpc.DialOption{grpc.WithInsecure()}
 	}
+	if conf.DialTimeoutMs > 0 {
+		pool.dialOpts = append(append([]grpc.DialOption{}, pool.dialOpts...), grpc.WithBlock())
+	}
+	if conf.MaxInFlight > 0 {
+		pool.sem = make(chan struct{}, conf.MaxInFlight)
+	}
+	go pool.evictWorker()
 	return
 }
 
+type idleConn struct {
+	conn *grpc.ClientConn
+	ts   time.Time
+}
+
 type ShortGrpcPool struct {
 	conf     GrpcClientConfig
 	dialOpts []grpc.DialOption
+
+	mtx *sync.Mutex
+	// weighted addrs, only set once addrs are pushed by a resolver
+	w     *weighted.SW
+	addrs []Address
+
+	keyBalancer Balancer
+
+	// idle conns by addr, the latest put back last
+	idle    map[string][]*idleConn
+	idleCnt int
+	// conns handed out and not put back yet, to their addr
+	leased map[*grpc.ClientConn]string
+	// one token per conn handed out, nil without MaxInFlight
+	sem    chan struct{}
+	closed bool
+	done   chan struct{}
 }
 
 func (pool *ShortGrpcPool) randAddr() string {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+	if pool.w != nil {
+		addr, _ := pool.w.Next().(string)
+		return addr
+	}
 	addr, _ := randAddr(pool.conf.Addrs)
 	return addr
 }
 
+func (pool *ShortGrpcPool) UpdateAddrs(addrs []Address) {
+	addrs = normalizeAddrs(addrs)
+	if len(addrs) == 0 {
+		xlog.Warn("_short_grpc_pool_update||empty addrs||skip||svrname=%v", pool.conf.SvrName)
+		return
+	}
+	w := &weighted.SW{}
+	for _, addr := range addrs {
+		w.Add(addr.Addr, addrWeight(addr))
+	}
+	pool.mtx.Lock()
+	pool.w = w
+	pool.addrs = addrs
+	pool.conf.Addrs = addrStrings(addrs)
+	// idle conns of the removed addrs are dropped
+	removed := []*idleConn{}
+	for addr, conns := range pool.idle {
+		if !pool.hasAddrLocked(addr) {
+			removed = append(removed, conns...)
+			pool.idleCnt -= len(conns)
+			delete(pool.idle, addr)
+		}
+	}
+	pool.mtx.Unlock()
+	closeIdleConns(removed)
+	pool.reportOccupancy()
+	xlog.Info("_short_grpc_pool_update||svrname=%v||addrs=%v", pool.conf.SvrName, pool.conf.Addrs)
+}
+
+func (pool *ShortGrpcPool) hasAddrLocked(addr string) bool {
+	for _, a := range pool.addrs {
+		if a.Addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
 func (pool *ShortGrpcPool) Get() (conn *grpc.ClientConn, err error) {
-	conn, err = grpc.Dial(pool.randAddr(), pool.dialOpts...)
+	if err = pool.acquire(); err != nil {
+		return nil, err
+	}
+	conn, err = pool.getConn(pool.randAddr())
+	if err != nil {
+		conn, err = pool.getConn(pool.randAddr())
+	}
 	if err != nil {
-		conn, err = grpc.Dial(pool.randAddr(), pool.dialOpts...)
+		pool.release()
+		return nil, err
 	}
 	return
 }
 
+func (pool *ShortGrpcPool) GetByKey(key string) (conn *grpc.ClientConn, err error) {
+	if key == "" {
+		return pool.Get()
+	}
+	pool.mtx.Lock()
+	nodes := make([]BalancerNode, 0, len(pool.addrs))
+	for _, addr := range pool.addrs {
+		nodes = append(nodes, &staticNode{addr: addr})
+	}
+	pool.mtx.Unlock()
+	if len(nodes) == 0 {
+		return pool.Get()
+	}
+	if err = pool.acquire(); err != nil {
+		return nil, err
+	}
+	if conn, err = pool.getConn(pool.keyBalancer.Pick(nodes, key).Addr()); err != nil {
+		pool.release()
+		return nil, err
+	}
+	return
+}
+
+// getConn reuses an idle conn of addr or dials a new one
+func (pool *ShortGrpcPool) getConn(addr string) (conn *grpc.ClientConn, err error) {
+	if conn = pool.takeIdle(addr); conn == nil {
+		if conn, err = pool.dial(addr); err != nil {
+			xlog.Warn("_short_grpc_pool_dial||addr=%v||err=%v", addr, err)
+			shortPoolMetrics.ObserveCounter(1, pool.conf.SvrName, "dial_err")
+			return nil, err
+		}
+	}
+	pool.mtx.Lock()
+	pool.leased[conn] = addr
+	pool.mtx.Unlock()
+	pool.reportOccupancy()
+	return
+}
+
+func (pool *ShortGrpcPool) dial(addr string) (*grpc.ClientConn, error) {
+	if pool.conf.DialTimeoutMs <= 0 {
+		return grpc.Dial(addr, pool.dialOpts...)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(pool.conf.DialTimeoutMs)*time.Millisecond)
+	defer cancel()
+	return grpc.DialContext(ctx, addr, pool.dialOpts...)
+}
+
+func connUsable(conn *grpc.ClientConn) bool {
+	switch conn.GetState() {
+	case connectivity.TransientFailure, connectivity.Shutdown:
+		return false
+	}
+	return true
+}
+
+// takeIdle pops the latest idle conn of addr, expired or broken ones are closed
+func (pool *ShortGrpcPool) takeIdle(addr string) (conn *grpc.ClientConn) {
+	expireTs := time.Now().Add(-time.Duration(pool.conf.IdleTimeoutSec) * time.Second)
+	dropped := []*idleConn{}
+	pool.mtx.Lock()
+	conns := pool.idle[addr]
+	for len(conns) > 0 && conn == nil {
+		ic := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		pool.idleCnt--
+		if ic.ts.Before(expireTs) || !connUsable(ic.conn) {
+			dropped = append(dropped, ic)
+			continue
+		}
+		conn = ic.conn
+	}
+	pool.idle[addr] = conns
+	pool.mtx.Unlock()
+	closeIdleConns(dropped)
+	return
+}
+
+func (pool *ShortGrpcPool) acquire() error {
+	pool.mtx.Lock()
+	closed := pool.closed
+	pool.mtx.Unlock()
+	if closed {
+		return ErrPoolClosed
+	}
+	if pool.sem == nil {
+		return nil
+	}
+	select {
+	case pool.sem <- struct{}{}:
+		return nil
+	case <-pool.done:
+		return ErrPoolClosed
+	default:
+	}
+	if pool.conf.MaxWaitMs > 0 {
+		timer := time.NewTimer(time.Duration(pool.conf.MaxWaitMs) * time.Millisecond)
+		defer timer.Stop()
+		select {
+		case pool.sem <- struct{}{}:
+			return nil
+		case <-pool.done:
+			return ErrPoolClosed
+		case <-timer.C:
+		}
+	}
+	xlog.Warn("_short_grpc_pool_exhausted||svrname=%v||max_in_flight=%v||max_wait_ms=%v",
+		pool.conf.SvrName, pool.conf.MaxInFlight, pool.conf.MaxWaitMs)
+	shortPoolMetrics.ObserveCounter(1, pool.conf.SvrName, "exhausted")
+	return ErrPoolExhausted
+}
+
+func (pool *ShortGrpcPool) release() {
+	if pool.sem != nil {
+		<-pool.sem
+	}
+}
+
+// Put keeps conn idle for reuse unless the pool is full, closed or conn is broken
 func (pool *ShortGrpcPool) Put(conn *grpc.ClientConn) error {
-	return conn.Close()
+	if conn == nil {
+		return nil
+	}
+	pool.mtx.Lock()
+	addr, ok := pool.leased[conn]
+	if !ok {
+		// not handed out by the pool or put twice
+		pool.mtx.Unlock()
+		return nil
+	}
+	delete(pool.leased, conn)
+	keep := !pool.closed &&
+		pool.idleCnt < pool.conf.PoolSize &&
+		pool.hasAddrLocked(addr) &&
+		connUsable(conn)
+	if keep {
+		pool.idle[addr] = append(pool.idle[addr], &idleConn{conn: conn, ts: time.Now()})
+		pool.idleCnt++
+	}
+	pool.mtx.Unlock()
+	pool.release()
+	pool.reportOccupancy()
+	if !keep {
+		return conn.Close()
+	}
+	return nil
+}
+
+func (pool *ShortGrpcPool) evictWorker() {
+	interval := time.Duration(pool.conf.IdleTimeoutSec) * time.Second / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pool.done:
+			return
+		case <-ticker.C:
+			pool.evictIdle()
+		}
+	}
+}
+
+func (pool *ShortGrpcPool) evictIdle() {
+	expireTs := time.Now().Add(-time.Duration(pool.conf.IdleTimeoutSec) * time.Second)
+	evicted := []*idleConn{}
+	pool.mtx.Lock()
+	for addr, conns := range pool.idle {
+		kept := conns[:0]
+		for _, ic := range conns {
+			if ic.ts.Before(expireTs) || !connUsable(ic.conn) {
+				evicted = append(evicted, ic)
+			} else {
+				kept = append(kept, ic)
+			}
+		}
+		pool.idle[addr] = kept
+	}
+	pool.idleCnt -= len(evicted)
+	pool.mtx.Unlock()
+	if len(evicted) > 0 {
+		xlog.Debug("_short_grpc_pool_evict||svrname=%v||cnt=%v", pool.conf.SvrName, len(evicted))
+		closeIdleConns(evicted)
+		pool.reportOccupancy()
+	}
 }
 
+func closeIdleConns(conns []*idleConn) {
+	for _, ic := range conns {
+		_ = ic.conn.Close()
+	}
+}
+
+// Close closes the idle conns, the leased ones are closed once put back
 func (pool *ShortGrpcPool) Close() {
+	pool.mtx.Lock()
+	if pool.closed {
+		pool.mtx.Unlock()
+		return
+	}
+	pool.closed = true
+	close(pool.done)
+	idle := []*idleConn{}
+	for _, conns := range pool.idle {
+		idle = append(idle, conns...)
+	}
+	pool.idle = map[string][]*idleConn{}
+	pool.idleCnt = 0
+	pool.mtx.Unlock()
+	closeIdleConns(idle)
+	pool.reportOccupancy()
+}
+
+func (pool *ShortGrpcPool) Stats() (stats PoolStats) {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+	stats = PoolStats{
+		SvrName:     pool.conf.SvrName,
+		Caller:      pool.conf.Caller,
+		Balancer:    BalancerRoundRobin,
+		Capacity:    pool.conf.PoolSize,
+		InUse:       len(pool.leased),
+		Idle:        pool.idleCnt,
+		MaxInFlight: pool.conf.MaxInFlight,
+	}
+	inUse := map[string]int{}
+	for _, addr := range pool.leased {
+		inUse[addr]++
+	}
+	for _, addr := range pool.addrs {
+		idle := len(pool.idle[addr.Addr])
+		stats.Addrs = append(stats.Addrs, PoolAddrStats{
+			Addr:    addr.Addr,
+			Weight:  addrWeight(addr),
+			Healthy: true,
+			Conns:   inUse[addr.Addr] + idle,
+			Idle:    idle,
+		})
+	}
+	return
+}
 
+// Shutdown closes the pool and waits for the leased conns to be put back
+func (pool *ShortGrpcPool) Shutdown(ctx context.Context) error {
+	pool.Close()
+	ticker := time.NewTicker(time.Millisecond * 50)
+	defer ticker.Stop()
+	for {
+		pool.mtx.Lock()
+		inUse := len(pool.leased)
+		pool.mtx.Unlock()
+		if inUse == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			xlog.Warn("_short_grpc_pool_shutdown||conns not put back||svrname=%v||in_use=%v||err=%v",
+				pool.conf.SvrName, inUse, ctx.Err())
+			return ctx.Err()
+		}
+	}
+}
+
+/**
+####################################################################################
+SHORT POOL METRICS
+*/
+
+var shortPoolMetrics = &metrics.MetricsBase{}
+
+// InitShortPoolMetrics creates and registers the occupancy gauge of the short
+// connection pools (state in_use or idle) and the counter of failed Gets
+// (reason exhausted or dial_err)
+func InitShortPoolMetrics(prefix string) {
+	shortPoolMetrics.CreateMetricsGaugeVec(prefix, "grpc_client_short_pool", "conns", []string{"svr_name", "state"})
+	shortPoolMetrics.CreateMetricsCountVec(prefix, "grpc_client_short_pool", "fail_cnt", []string{"svr_name", "reason"})
+	if err := shortPoolMetrics.Register(); err != nil {
+		xlog.Error("failed to register short pool metrics||prefix=%v||err=%v", prefix, err)
+	}
+}
+
+func (pool *ShortGrpcPool) reportOccupancy() {
+	if shortPoolMetrics.GetMetricsGauge() == nil {
+		return
+	}
+	pool.mtx.Lock()
+	inUse, idle := len(pool.leased), pool.idleCnt
+	pool.mtx.Unlock()
+	shortPoolMetrics.SetGauge(float64(inUse), pool.conf.SvrName, "in_use")
+	shortPoolMetrics.SetGauge(float64(idle), pool.conf.SvrName, "idle")
 }
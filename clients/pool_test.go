@@ -0,0 +1,260 @@
+package clients
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestShortGrpcPoolReuse(t *testing.T) {
+	addr, stop := startFlakyServer(t, &flakyHealthServer{})
+	defer stop()
+
+	pool, err := newShortGrpcClientPool(GrpcClientConfig{
+		Addrs:          []string{addr},
+		DialTimeoutMs:  500,
+		IdleTimeoutSec: 1,
+		PoolSize:       1,
+	})
+	assert.Nil(t, err)
+	defer pool.Close()
+
+	conn1, err := pool.Get()
+	assert.Nil(t, err)
+	conn2, err := pool.Get()
+	assert.Nil(t, err)
+	assert.NotEqual(t, conn1, conn2)
+
+	// only PoolSize conns are kept idle
+	assert.Nil(t, pool.Put(conn1))
+	assert.Nil(t, pool.Put(conn2))
+	assert.Equal(t, 1, pool.idleCnt)
+
+	conn3, err := pool.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, conn1, conn3)
+	assert.Nil(t, pool.Put(conn3))
+
+	// evicted once idle for IdleTimeoutSec
+	time.Sleep(time.Millisecond * 1100)
+	pool.evictIdle()
+	assert.Equal(t, 0, pool.idleCnt)
+}
+
+func TestShortGrpcPoolClosed(t *testing.T) {
+	addr, stop := startFlakyServer(t, &flakyHealthServer{})
+	defer stop()
+
+	for _, maxInFlight := range []int{0, 1} {
+		pool, err := newShortGrpcClientPool(GrpcClientConfig{
+			Addrs:         []string{addr},
+			DialTimeoutMs: 500,
+			MaxInFlight:   maxInFlight,
+		})
+		assert.Nil(t, err)
+		pool.Close()
+
+		_, err = pool.Get()
+		assert.Equal(t, ErrPoolClosed, err, maxInFlight)
+		_, err = pool.GetByKey("user_1")
+		assert.Equal(t, ErrPoolClosed, err, maxInFlight)
+	}
+}
+
+func TestShortGrpcPoolMaxInFlight(t *testing.T) {
+	addr, stop := startFlakyServer(t, &flakyHealthServer{})
+	defer stop()
+
+	pool, err := newShortGrpcClientPool(GrpcClientConfig{
+		Addrs:         []string{addr},
+		DialTimeoutMs: 500,
+		MaxInFlight:   1,
+		MaxWaitMs:     50,
+	})
+	assert.Nil(t, err)
+	defer pool.Close()
+
+	conn, err := pool.Get()
+	assert.Nil(t, err)
+
+	t0 := time.Now()
+	_, err = pool.Get()
+	assert.Equal(t, ErrPoolExhausted, err)
+	assert.True(t, time.Since(t0) >= time.Millisecond*50)
+
+	// a waiting Get takes the conn put back meanwhile
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		time.Sleep(time.Millisecond * 10)
+		_ = pool.Put(conn)
+	}()
+	conn2, err := pool.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, conn, conn2)
+	assert.Nil(t, pool.Put(conn2))
+	<-done
+}
+
+func TestInitShortPoolMetricsTwice(t *testing.T) {
+	InitShortPoolMetrics("test_short_pool")
+	assert.NotPanics(t, func() { InitShortPoolMetrics("test_short_pool") })
+
+	addr, stop := startFlakyServer(t, &flakyHealthServer{})
+	defer stop()
+	pool, err := newShortGrpcClientPool(GrpcClientConfig{
+		SvrName:       "short_svr",
+		Addrs:         []string{addr},
+		DialTimeoutMs: 500,
+	})
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn, err := pool.Get()
+	assert.Nil(t, err)
+	assert.Nil(t, pool.Put(conn))
+}
+
+func TestShortGrpcPoolDialTimeout(t *testing.T) {
+	// a listener never serving grpc
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := lis.Addr().String()
+	assert.Nil(t, lis.Close())
+
+	pool, err := newShortGrpcClientPool(GrpcClientConfig{
+		Addrs:         []string{addr},
+		DialTimeoutMs: 50,
+		MaxInFlight:   1,
+	})
+	assert.Nil(t, err)
+	defer pool.Close()
+
+	t0 := time.Now()
+	_, err = pool.Get()
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(t0) < time.Second)
+	// the failed Get does not hold a token
+	assert.Equal(t, 0, len(pool.sem))
+}
+
+func TestGrpcClientPoolDrain(t *testing.T) {
+	svr := &flakyHealthServer{slowN: 1, slowDur: time.Millisecond * 300}
+	addr, stop := startFlakyServer(t, svr)
+	defer stop()
+
+	pool, err := NewGrpcClientPool(GrpcClientConfig{
+		Addrs:           []string{addr},
+		PoolSize:        1,
+		DrainTimeoutSec: 2,
+		TrackLeases:     true,
+	})
+	assert.Nil(t, err)
+	defer pool.Close()
+
+	conn, err := pool.Get()
+	assert.Nil(t, err)
+	lconn := pool.conns[0]
+	assert.Equal(t, int64(1), lconn.leases)
+
+	// the conn is recycled while a slow rpc is in flight
+	rspCh := make(chan error, 1)
+	go func() {
+		_, err := grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+		rspCh <- err
+	}()
+	time.Sleep(time.Millisecond * 50)
+	assert.Nil(t, pool.Put(conn))
+	pool.drain(lconn, 0)
+	assert.Nil(t, <-rspCh)
+
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, connectivity.Shutdown, conn.GetState())
+}
+
+func TestGrpcClientPoolDrainNoLeases(t *testing.T) {
+	addr, stop := startFlakyServer(t, &flakyHealthServer{})
+	defer stop()
+
+	pool, err := NewGrpcClientPool(GrpcClientConfig{
+		Addrs:           []string{addr},
+		PoolSize:        1,
+		DrainTimeoutSec: 2,
+	})
+	assert.Nil(t, err)
+	defer pool.Close()
+
+	// a conn never Put does not hold the drain without TrackLeases
+	conn, err := pool.Get()
+	assert.Nil(t, err)
+	lconn := pool.conns[0]
+	assert.Equal(t, int64(0), lconn.leases)
+	pool.drain(lconn, 0)
+
+	time.Sleep(time.Millisecond * 200)
+	assert.Equal(t, connectivity.Shutdown, conn.GetState())
+}
+
+func TestGrpcClientPoolShutdown(t *testing.T) {
+	addr, stop := startFlakyServer(t, &flakyHealthServer{})
+	defer stop()
+
+	pool, err := NewGrpcClientPool(GrpcClientConfig{
+		Addrs:       []string{addr},
+		PoolSize:    2,
+		TrackLeases: true,
+	})
+	assert.Nil(t, err)
+
+	conn, err := pool.Get()
+	assert.Nil(t, err)
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		_ = pool.Put(conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, pool.Shutdown(ctx))
+	assert.Equal(t, connectivity.Shutdown, conn.GetState())
+
+	_, err = pool.Get()
+	assert.Equal(t, ErrPoolClosed, err)
+
+	// drains after Shutdown close the conn at once
+	lconn, err := pool.connectAddr(pool.connStats[0])
+	assert.Nil(t, err)
+	pool.drain(lconn, drainGrace)
+	assert.Equal(t, connectivity.Shutdown, lconn.conn.GetState())
+	assert.Equal(t, 0, len(pool.draining))
+}
+
+func TestGrpcClientPoolUpdateAddrsGrow(t *testing.T) {
+	addrs := []Address{}
+	for i := 0; i < 3; i++ {
+		addr, stop := startFlakyServer(t, &flakyHealthServer{})
+		defer stop()
+		addrs = append(addrs, Address{Addr: addr})
+	}
+
+	pool, err := NewGrpcClientPool(GrpcClientConfig{
+		Addrs:    []string{addrs[0].Addr},
+		PoolSize: 1,
+	})
+	assert.Nil(t, err)
+	defer pool.Close()
+
+	pool.UpdateAddrs(addrs)
+	assert.Equal(t, 3, pool.Stats().Capacity)
+
+	// the new slots are dialed by the balance round
+	time.Sleep(time.Millisecond * 500)
+	for _, lconn := range pool.connsSnapshot() {
+		assert.NotNil(t, lconn)
+	}
+}
@@ -0,0 +1,258 @@
+package clients
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xutils/lib-common/xlog"
+)
+
+/*
+####################################################################################
+SERVICE DISCOVERY
+a resolver feeds the full address set of a service to the pools, pools add and
+drain connections when the set changes
+*/
+
+const defaultResolveIntervalSec = 5
+
+// Address is a single backend resolved for a service
+type Address struct {
+	Addr     string            `toml:"addr"`
+	Weight   int               `toml:"weight"`
+	Metadata map[string]string `toml:"metadata"`
+}
+
+type Resolver interface {
+	// Resolve returns the current address set of svrName
+	Resolve(svrName string) ([]Address, error)
+	// Watch pushes the full address set of svrName every time it changes,
+	// the channel is closed once ctx is done
+	Watch(ctx context.Context, svrName string) (<-chan []Address, error)
+}
+
+var (
+	resolverMtx = &sync.RWMutex{}
+	resolverMap = map[string]Resolver{}
+)
+
+// RegisterResolver makes r available to GrpcClientConfig.Resolver by name
+func RegisterResolver(name string, r Resolver) {
+	resolverMtx.Lock()
+	defer resolverMtx.Unlock()
+	resolverMap[name] = r
+}
+
+func GetResolver(name string) (r Resolver, ok bool) {
+	resolverMtx.RLock()
+	defer resolverMtx.RUnlock()
+	r, ok = resolverMap[name]
+	return
+}
+
+func addrsFromStrings(addrs []string) (out []Address) {
+	out = make([]Address, 0, len(addrs))
+	for _, addr := range addrs {
+		out = append(out, Address{Addr: addr, Weight: 1})
+	}
+	return
+}
+
+func addrStrings(addrs []Address) (out []string) {
+	out = make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		out = append(out, addr.Addr)
+	}
+	return
+}
+
+func addrWeight(addr Address) int {
+	if addr.Weight <= 0 {
+		return 1
+	}
+	return addr.Weight
+}
+
+// normalizeAddrs drops empty and duplicated addrs and sorts the rest so that
+// two address sets can be compared
+func normalizeAddrs(addrs []Address) (out []Address) {
+	seen := map[string]bool{}
+	out = make([]Address, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr.Addr == "" || seen[addr.Addr] {
+			continue
+		}
+		seen[addr.Addr] = true
+		addr.Weight = addrWeight(addr)
+		out = append(out, addr)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Addr < out[j].Addr })
+	return
+}
+
+func addrsEqual(a, b []Address) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx].Addr != b[idx].Addr || a[idx].Weight != b[idx].Weight {
+			return false
+		}
+		if len(a[idx].Metadata) != len(b[idx].Metadata) {
+			return false
+		}
+		for k, v := range a[idx].Metadata {
+			if b[idx].Metadata[k] != v {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// pollWatch calls resolve every interval and pushes the result when it differs
+// from the last one pushed, failed or empty resolutions are skipped so that a
+// broken source never drains a pool
+func pollWatch(
+	ctx context.Context,
+	svrName string,
+	interval time.Duration,
+	resolve func(svrName string) ([]Address, error)) (<-chan []Address, error) {
+
+	addrs, err := resolve(svrName)
+	if err != nil {
+		return nil, err
+	}
+	last := normalizeAddrs(addrs)
+	ch := make(chan []Address, 1)
+	ch <- last
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				addrs, err := resolve(svrName)
+				if err != nil {
+					xlog.Warn("_resolver_watch||svrname=%v||failed to resolve||err=%v", svrName, err)
+					continue
+				}
+				addrs = normalizeAddrs(addrs)
+				if len(addrs) == 0 || addrsEqual(addrs, last) {
+					continue
+				}
+				xlog.Info("_resolver_watch||svrname=%v||addrs changed||old=%v||new=%v",
+					svrName, addrStrings(last), addrStrings(addrs))
+				last = addrs
+				select {
+				case ch <- addrs:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+/**
+####################################################################################
+STATIC RESOLVER
+*/
+
+// StaticResolver serves fixed address sets, mostly useful for tests
+type StaticResolver map[string][]Address
+
+func (r StaticResolver) Resolve(svrName string) ([]Address, error) {
+	addrs, ok := r[svrName]
+	if !ok {
+		return nil, fmt.Errorf("svr not found||svrname=%v", svrName)
+	}
+	return addrs, nil
+}
+
+func (r StaticResolver) Watch(ctx context.Context, svrName string) (<-chan []Address, error) {
+	addrs, err := r.Resolve(svrName)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan []Address, 1)
+	ch <- normalizeAddrs(addrs)
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch, nil
+}
+
+/**
+####################################################################################
+FILE RESOLVER
+*/
+
+// NewFileResolver watches a toml file in the ClientAddrConf layout, see ClientAddrMgr
+func NewFileResolver(filepath string, intervalSec int) (r *ClientAddrMgr, err error) {
+	return NewClientAddrMgr(filepath, intervalSec)
+}
+
+/**
+####################################################################################
+DNS SRV RESOLVER
+svrName is looked up as _service._proto.svrName, the SRV weight is used as the
+address weight
+*/
+
+type DNSResolver struct {
+	Service  string
+	Proto    string
+	Interval time.Duration
+}
+
+func NewDNSResolver(service, proto string, intervalSec int) *DNSResolver {
+	if intervalSec <= 0 {
+		intervalSec = defaultResolveIntervalSec
+	}
+	return &DNSResolver{
+		Service:  service,
+		Proto:    proto,
+		Interval: time.Duration(intervalSec) * time.Second,
+	}
+}
+
+var lookupSRV = net.LookupSRV
+
+func (r *DNSResolver) Resolve(svrName string) (addrs []Address, err error) {
+	_, srvs, err := lookupSRV(r.Service, r.Proto, svrName)
+	if err != nil {
+		return
+	}
+	for _, srv := range srvs {
+		host := srv.Target
+		if len(host) > 0 && host[len(host)-1] == '.' {
+			host = host[:len(host)-1]
+		}
+		addrs = append(addrs, Address{
+			Addr:   net.JoinHostPort(host, strconv.Itoa(int(srv.Port))),
+			Weight: int(srv.Weight),
+			Metadata: map[string]string{
+				"priority": strconv.Itoa(int(srv.Priority)),
+			},
+		})
+	}
+	if len(addrs) == 0 {
+		err = fmt.Errorf("no srv record||svrname=%v", svrName)
+	}
+	return
+}
+
+func (r *DNSResolver) Watch(ctx context.Context, svrName string) (<-chan []Address, error) {
+	return pollWatch(ctx, svrName, r.Interval, r.Resolve)
+}
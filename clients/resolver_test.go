@@ -0,0 +1,111 @@
+package clients
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolver")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "addrs.toml")
+	err = ioutil.WriteFile(file, []byte(`
+[addr_map.test_svr]
+addrs = ["127.0.0.1:8001", "127.0.0.1:8001"]
+
+[[addr_map.test_svr.nodes]]
+addr = "127.0.0.1:8002"
+weight = 3
+`), 0644)
+	assert.Nil(t, err)
+
+	r, err := NewFileResolver(file, 1)
+	assert.Nil(t, err)
+	defer r.Close()
+
+	addrs, err := r.Resolve("test_svr")
+	assert.Nil(t, err)
+	assert.Equal(t, []Address{
+		{Addr: "127.0.0.1:8001", Weight: 1},
+		{Addr: "127.0.0.1:8002", Weight: 3},
+	}, addrs)
+
+	_, err = r.Resolve("unknown_svr")
+	assert.NotNil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := r.Watch(ctx, "test_svr")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(<-ch))
+
+	// make sure mtime moves forward on coarse filesystems
+	time.Sleep(time.Millisecond * 10)
+	err = ioutil.WriteFile(file, []byte(`
+[addr_map.test_svr]
+addrs = ["127.0.0.1:8003"]
+`), 0644)
+	assert.Nil(t, err)
+
+	select {
+	case addrs = <-ch:
+		assert.Equal(t, []string{"127.0.0.1:8003"}, addrStrings(addrs))
+	case <-time.After(time.Second * 3):
+		t.Fatal("addrs change not pushed")
+	}
+
+	cancel()
+	for range ch {
+	}
+}
+
+func TestStaticResolver(t *testing.T) {
+	r := StaticResolver{
+		"test_svr": addrsFromStrings([]string{"b:1", "a:1"}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := r.Watch(ctx, "test_svr")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a:1", "b:1"}, addrStrings(<-ch))
+	cancel()
+	_, ok := <-ch
+	assert.False(t, ok)
+}
+
+// chanResolver pushes the addr sets sent to ch
+type chanResolver struct {
+	addrs []Address
+	ch    chan []Address
+}
+
+func (r *chanResolver) Resolve(svrName string) ([]Address, error) {
+	return r.addrs, nil
+}
+
+func (r *chanResolver) Watch(ctx context.Context, svrName string) (<-chan []Address, error) {
+	return r.ch, nil
+}
+
+func TestWatchAddrsEmpty(t *testing.T) {
+	r := &chanResolver{addrs: addrsFromStrings([]string{"a:1"}), ch: make(chan []Address)}
+	cli, err := NewGrpcClientBaseWithResolver(GrpcClientConfig{SvrName: "test_svr"}, r)
+	assert.Nil(t, err)
+	defer cli.Close()
+
+	// an empty set is skipped, the second send waits for the first to be handled
+	r.ch <- nil
+	r.ch <- []Address{}
+	assert.Equal(t, "a:1", cli.GetAddr())
+
+	r.ch <- addrsFromStrings([]string{"b:1"})
+	close(r.ch)
+	assert.Eventually(t, func() bool { return cli.GetAddr() == "b:1" }, time.Second, time.Millisecond*10)
+}
@@ -0,0 +1,556 @@
+package clients
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/xutils/lib-common/xlog"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+/*
+####################################################################################
+RETRY AND HEDGING
+every extra attempt is sent on a conn freshly taken from the pool, so it goes
+through the whole interceptor chain of that conn (breaker etc.) again. retries
+and hedges are all paid from one budget so they never amplify an outage
+
+[[retry.policies]]
+method = "AddLocs"            # full method, method name, or "*" for all
+max_attempts = 3
+retryable_codes = ["UNAVAILABLE", "RESOURCE_EXHAUSTED"]
+initial_backoff_ms = 20
+max_backoff_ms = 200
+hedging_percentile = 0.95     # send a hedge once the attempt is slower than p95
+*/
+
+type RetryPolicy struct {
+	Method              string   `toml:"method"`
+	MaxAttempts         int      `toml:"max_attempts"`
+	RetryableCodes      []string `toml:"retryable_codes"`
+	InitialBackoffMs    int      `toml:"initial_backoff_ms"`
+	MaxBackoffMs        int      `toml:"max_backoff_ms"`
+	BackoffMultiplier   float64  `toml:"backoff_multiplier"`
+	Jitter              float64  `toml:"jitter"`
+	PerAttemptTimeoutMs int      `toml:"per_attempt_timeout_ms"`
+
+	// hedging is enabled when either is set, the delay is used until enough
+	// latency samples are collected for the percentile
+	HedgingDelayMs    int     `toml:"hedging_delay_ms"`
+	HedgingPercentile float64 `toml:"hedging_percentile"`
+}
+
+type RetryConfig struct {
+	Policies []*RetryPolicy `toml:"policies"`
+	// extra attempts allowed as a ratio of the requests in the last budgetWindowSec,
+	// plus BudgetMinPerSec which is always allowed
+	BudgetRatio     float64 `toml:"budget_ratio"`
+	BudgetMinPerSec int     `toml:"budget_min_per_sec"`
+}
+
+const (
+	defaultRetryMaxAttempts = 2
+	maxRetryAttempts        = 5
+	budgetWindowSec         = 10
+	latencySampleSize       = 128
+	latencyMinSamples       = 20
+)
+
+type retryAttemptKey struct{}
+
+type retryPolicy struct {
+	maxAttempts       int
+	retryableCodes    map[codes.Code]bool
+	initialBackoff    time.Duration
+	maxBackoff        time.Duration
+	multiplier        float64
+	jitter            float64
+	perAttemptTimeout time.Duration
+	hedgingDelay      time.Duration
+	hedgingPercentile float64
+}
+
+// parseCode accepts both "UNAVAILABLE" and "Unavailable"
+func parseCode(name string) (code codes.Code, ok bool) {
+	name = strings.ToLower(strings.ReplaceAll(name, "_", ""))
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if strings.ToLower(c.String()) == name {
+			return c, true
+		}
+	}
+	return
+}
+
+func newRetryPolicy(p *RetryPolicy) *retryPolicy {
+	policy := &retryPolicy{
+		maxAttempts:       p.MaxAttempts,
+		retryableCodes:    map[codes.Code]bool{},
+		initialBackoff:    time.Duration(p.InitialBackoffMs) * time.Millisecond,
+		maxBackoff:        time.Duration(p.MaxBackoffMs) * time.Millisecond,
+		multiplier:        p.BackoffMultiplier,
+		jitter:            p.Jitter,
+		perAttemptTimeout: time.Duration(p.PerAttemptTimeoutMs) * time.Millisecond,
+		hedgingDelay:      time.Duration(p.HedgingDelayMs) * time.Millisecond,
+		hedgingPercentile: p.HedgingPercentile,
+	}
+	if policy.maxAttempts <= 0 {
+		policy.maxAttempts = defaultRetryMaxAttempts
+	}
+	if policy.maxAttempts > maxRetryAttempts {
+		policy.maxAttempts = maxRetryAttempts
+	}
+	if policy.initialBackoff <= 0 {
+		policy.initialBackoff = 10 * time.Millisecond
+	}
+	if policy.maxBackoff < policy.initialBackoff {
+		policy.maxBackoff = 10 * policy.initialBackoff
+	}
+	if policy.multiplier < 1 {
+		policy.multiplier = 2
+	}
+	if policy.jitter <= 0 || policy.jitter > 1 {
+		policy.jitter = 0.2
+	}
+	if policy.hedgingPercentile < 0 || policy.hedgingPercentile >= 1 {
+		policy.hedgingPercentile = 0
+	}
+	for _, name := range p.RetryableCodes {
+		code, ok := parseCode(name)
+		if !ok {
+			xlog.Warn("_grpc_retry||unknown code||method=%v||code=%v", p.Method, name)
+			continue
+		}
+		policy.retryableCodes[code] = true
+	}
+	if len(policy.retryableCodes) == 0 {
+		policy.retryableCodes[codes.Unavailable] = true
+	}
+	return policy
+}
+
+func (p *retryPolicy) hedging() bool {
+	return p.hedgingDelay > 0 || p.hedgingPercentile > 0
+}
+
+func (p *retryPolicy) retryable(err error) bool {
+	return p.retryableCodes[status.Code(err)]
+}
+
+// backoff before the nth retry (n starts at 1) with jitter
+func (p *retryPolicy) backoff(n int) time.Duration {
+	backoff := float64(p.initialBackoff) * math.Pow(p.multiplier, float64(n-1))
+	if backoff > float64(p.maxBackoff) {
+		backoff = float64(p.maxBackoff)
+	}
+	backoff *= 1 + p.jitter*(rand.Float64()*2-1)
+	return time.Duration(backoff)
+}
+
+/**
+####################################################################################
+RETRY BUDGET
+*/
+
+type budgetBucket struct {
+	sec     int64
+	reqs    int64
+	retries int64
+}
+
+type retryBudget struct {
+	mtx       *sync.Mutex
+	ratio     float64
+	minPerSec int
+	buckets   [budgetWindowSec]budgetBucket
+	now       func() time.Time
+}
+
+func newRetryBudget(ratio float64, minPerSec int) *retryBudget {
+	if ratio <= 0 {
+		ratio = 0.1
+	}
+	if minPerSec < 0 {
+		minPerSec = 0
+	}
+	return &retryBudget{
+		mtx:       &sync.Mutex{},
+		ratio:     ratio,
+		minPerSec: minPerSec,
+		now:       time.Now,
+	}
+}
+
+func (b *retryBudget) bucketLocked() *budgetBucket {
+	sec := b.now().Unix()
+	bucket := &b.buckets[sec%budgetWindowSec]
+	if bucket.sec != sec {
+		*bucket = budgetBucket{sec: sec}
+	}
+	return bucket
+}
+
+func (b *retryBudget) deposit() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.bucketLocked().reqs++
+}
+
+// withdraw takes an extra attempt from the budget, false when it is used up
+func (b *retryBudget) withdraw() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	bucket := b.bucketLocked()
+	minSec := b.now().Unix() - budgetWindowSec
+	var reqs, retries int64
+	for _, bk := range b.buckets {
+		if bk.sec > minSec {
+			reqs += bk.reqs
+			retries += bk.retries
+		}
+	}
+	if float64(retries) >= float64(b.minPerSec*budgetWindowSec)+b.ratio*float64(reqs) {
+		return false
+	}
+	bucket.retries++
+	return true
+}
+
+/**
+####################################################################################
+LATENCY SAMPLER used for the hedging percentile
+*/
+
+type latencySampler struct {
+	mtx     *sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (s *latencySampler) add(d time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.samples) < latencySampleSize {
+		s.samples = append(s.samples, d)
+		return
+	}
+	s.samples[s.next] = d
+	s.next = (s.next + 1) % latencySampleSize
+}
+
+func (s *latencySampler) percentile(p float64) (d time.Duration, ok bool) {
+	s.mtx.Lock()
+	sorted := append([]time.Duration{}, s.samples...)
+	s.mtx.Unlock()
+	if len(sorted) < latencyMinSamples {
+		return
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(float64(len(sorted)-1)*p)], true
+}
+
+/**
+####################################################################################
+RETRIER
+*/
+
+type retrier struct {
+	cli            *GrpcClientBase
+	policies       map[string]*retryPolicy
+	defaultPolicy  *retryPolicy
+	budget         *retryBudget
+	samplerMtx     *sync.Mutex
+	latencySampler map[string]*latencySampler
+}
+
+func newRetrier(cli *GrpcClientBase, conf RetryConfig) (r *retrier) {
+	r = &retrier{
+		cli:            cli,
+		policies:       map[string]*retryPolicy{},
+		budget:         newRetryBudget(conf.BudgetRatio, conf.BudgetMinPerSec),
+		samplerMtx:     &sync.Mutex{},
+		latencySampler: map[string]*latencySampler{},
+	}
+	for _, p := range conf.Policies {
+		if p == nil {
+			continue
+		}
+		if p.Method == "" || p.Method == "*" {
+			r.defaultPolicy = newRetryPolicy(p)
+			continue
+		}
+		r.policies[p.Method] = newRetryPolicy(p)
+	}
+	return
+}
+
+// policy matches the full method first and the method name then
+func (r *retrier) policy(method string) *retryPolicy {
+	if p, ok := r.policies[method]; ok {
+		return p
+	}
+	if idx := strings.LastIndex(method, "/"); idx >= 0 {
+		if p, ok := r.policies[method[idx+1:]]; ok {
+			return p
+		}
+	}
+	return r.defaultPolicy
+}
+
+func (r *retrier) sampler(method string) *latencySampler {
+	r.samplerMtx.Lock()
+	defer r.samplerMtx.Unlock()
+	s, ok := r.latencySampler[method]
+	if !ok {
+		s = &latencySampler{mtx: &sync.Mutex{}}
+		r.latencySampler[method] = s
+	}
+	return s
+}
+
+func (r *retrier) hedgingDelay(policy *retryPolicy, method string) time.Duration {
+	if policy.hedgingPercentile > 0 {
+		if d, ok := r.sampler(method).percentile(policy.hedgingPercentile); ok {
+			return d
+		}
+	}
+	if policy.hedgingDelay > 0 {
+		return policy.hedgingDelay
+	}
+	return time.Duration(r.cli.conf.ReadTimeoutMs) * time.Millisecond / 2
+}
+
+// attempt sends the nth attempt, the first one goes on through the chain of cc,
+// the others are sent on a conn picked from the pool again
+func (r *retrier) attempt(
+	ctx context.Context,
+	n int,
+	policy *retryPolicy,
+	method string,
+	req, reply interface{},
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption) (err error) {
+
+	if policy.perAttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.perAttemptTimeout)
+		defer cancel()
+	}
+	t0 := time.Now()
+	defer func() {
+		if err == nil {
+			r.sampler(method).add(time.Since(t0))
+		}
+	}()
+	if n == 0 {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
+	conn, err := r.cli.Get()
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "failed to get conn for retry||err=%v", err)
+	}
+	defer r.cli.Put(conn)
+	ctx = context.WithValue(ctx, retryAttemptKey{}, n)
+	return conn.Invoke(ctx, method, req, reply, opts...)
+}
+
+func (r *retrier) unaryInterceptor(
+	ctx context.Context,
+	method string,
+	req, reply interface{},
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption) error {
+
+	// an extra attempt sent by ourselves
+	if _, ok := ctx.Value(retryAttemptKey{}).(int); ok {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	policy := r.policy(method)
+	if policy == nil {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	r.budget.deposit()
+
+	if protoReply, ok := reply.(proto.Message); ok && policy.hedging() {
+		return r.hedge(ctx, policy, method, req, protoReply, cc, invoker, opts...)
+	}
+
+	var err error
+	for n := 0; n < policy.maxAttempts; n++ {
+		if n > 0 {
+			backoff := policy.backoff(n)
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+				break
+			}
+			if !r.budget.withdraw() {
+				xlog.Warn("_grpc_retry||retry budget exhausted||method=%v||err=%v", method, err)
+				break
+			}
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return err
+			}
+		}
+		err = r.attempt(ctx, n, policy, method, req, reply, cc, invoker, opts...)
+		if err == nil || !policy.retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		xlog.Debug("_grpc_retry||method=%v||attempt=%v||err=%v", method, n, err)
+	}
+	return err
+}
+
+type hedgeResult struct {
+	reply proto.Message
+	// copies the header, trailer and peer of the attempt to the caller
+	commit func()
+	err    error
+}
+
+// attemptCallOpts gives an attempt its own copies of the options grpc writes
+// the call results to, concurrent attempts would race on the caller's ones
+func attemptCallOpts(opts []grpc.CallOption) (attemptOpts []grpc.CallOption, commit func()) {
+	copies := []func(){}
+	attemptOpts = make([]grpc.CallOption, 0, len(opts))
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case grpc.HeaderCallOption:
+			md, dst := &metadata.MD{}, o.HeaderAddr
+			copies = append(copies, func() { *dst = *md })
+			opt = grpc.Header(md)
+		case grpc.TrailerCallOption:
+			md, dst := &metadata.MD{}, o.TrailerAddr
+			copies = append(copies, func() { *dst = *md })
+			opt = grpc.Trailer(md)
+		case grpc.PeerCallOption:
+			p, dst := &peer.Peer{}, o.PeerAddr
+			copies = append(copies, func() { *dst = *p })
+			opt = grpc.Peer(p)
+		}
+		attemptOpts = append(attemptOpts, opt)
+	}
+	commit = func() {
+		for _, c := range copies {
+			c()
+		}
+	}
+	return
+}
+
+// hedge sends a new attempt every time the outstanding ones are slower than
+// the hedging delay or one fails with a retryable code, the first success wins
+func (r *retrier) hedge(
+	ctx context.Context,
+	policy *retryPolicy,
+	method string,
+	req interface{},
+	reply proto.Message,
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption) (err error) {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hedgeResult, policy.maxAttempts)
+	launched, inflight := 0, 0
+	launch := func() {
+		n := launched
+		launched++
+		inflight++
+		attemptReply := proto.Clone(reply)
+		attemptReply.Reset()
+		attemptOpts, commit := attemptCallOpts(opts)
+		go func() {
+			err := r.attempt(ctx, n, policy, method, req, attemptReply, cc, invoker, attemptOpts...)
+			results <- hedgeResult{reply: attemptReply, commit: commit, err: err}
+		}()
+	}
+
+	var last hedgeResult
+	launch()
+	delay := r.hedgingDelay(policy, method)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for inflight > 0 {
+		select {
+		case res := <-results:
+			inflight--
+			if res.err == nil {
+				reply.Reset()
+				proto.Merge(reply, res.reply)
+				res.commit()
+				return nil
+			}
+			err, last = res.err, res
+			if !policy.retryable(err) {
+				res.commit()
+				return err
+			}
+			if launched < policy.maxAttempts && r.budget.withdraw() {
+				launch()
+				timer.Reset(delay)
+			}
+		case <-timer.C:
+			if launched < policy.maxAttempts && r.budget.withdraw() {
+				xlog.Debug("_grpc_hedge||method=%v||attempt=%v||delay=%v", method, launched, delay)
+				launch()
+				timer.Reset(delay)
+			}
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	// every attempt failed, the caller sees the last one
+	last.commit()
+	return err
+}
+
+// streamInterceptor only retries the creation of the stream, messages already
+// sent on a stream can't be replayed
+func (r *retrier) streamInterceptor(
+	ctx context.Context,
+	desc *grpc.StreamDesc,
+	cc *grpc.ClientConn,
+	method string,
+	streamer grpc.Streamer,
+	opts ...grpc.CallOption) (stream grpc.ClientStream, err error) {
+
+	policy := r.policy(method)
+	if policy == nil {
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+	r.budget.deposit()
+	for n := 0; n < policy.maxAttempts; n++ {
+		if n > 0 {
+			if !r.budget.withdraw() {
+				break
+			}
+			select {
+			case <-time.After(policy.backoff(n)):
+			case <-ctx.Done():
+				return nil, err
+			}
+		}
+		stream, err = streamer(ctx, desc, cc, method, opts...)
+		if err == nil || !policy.retryable(err) {
+			return
+		}
+	}
+	return
+}
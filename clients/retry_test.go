@@ -0,0 +1,147 @@
+package clients
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// flakyHealthServer fails the first failN calls, the first slowN calls take slowDur
+type flakyHealthServer struct {
+	grpc_health_v1.UnimplementedHealthServer
+	calls   int64
+	failN   int64
+	slowN   int64
+	slowDur time.Duration
+}
+
+func (s *flakyHealthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	n := atomic.AddInt64(&s.calls, 1)
+	if n <= s.slowN {
+		select {
+		case <-time.After(s.slowDur):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if n <= s.failN {
+		return nil, status.Error(codes.Unavailable, "flaky")
+	}
+	return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+}
+
+func startFlakyServer(t *testing.T, svr *flakyHealthServer) (addr string, stop func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(s, svr)
+	go func() {
+		_ = s.Serve(lis)
+	}()
+	return lis.Addr().String(), s.Stop
+}
+
+func TestRetryInterceptor(t *testing.T) {
+	svr := &flakyHealthServer{failN: 2}
+	addr, stop := startFlakyServer(t, svr)
+	defer stop()
+
+	cli, err := NewGrpcClientBase(GrpcClientConfig{
+		Addrs:         []string{addr},
+		ReadTimeoutMs: 1000,
+		Retry: RetryConfig{
+			BudgetMinPerSec: 10,
+			Policies: []*RetryPolicy{
+				{Method: "Check", MaxAttempts: 3, RetryableCodes: []string{"UNAVAILABLE"}},
+			},
+		},
+	})
+	assert.Nil(t, err)
+	defer cli.Close()
+
+	conn, err := cli.Get()
+	assert.Nil(t, err)
+	defer cli.Put(conn)
+
+	rsp, err := grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, rsp.Status)
+	assert.Equal(t, int64(3), atomic.LoadInt64(&svr.calls))
+}
+
+func TestHedgingInterceptor(t *testing.T) {
+	svr := &flakyHealthServer{slowN: 1, slowDur: time.Second}
+	addr, stop := startFlakyServer(t, svr)
+	defer stop()
+
+	cli, err := NewGrpcClientBase(GrpcClientConfig{
+		Addrs:          []string{addr},
+		LongConnection: true,
+		PoolSize:       2,
+		Retry: RetryConfig{
+			BudgetMinPerSec: 10,
+			Policies: []*RetryPolicy{
+				{Method: "*", MaxAttempts: 2, HedgingDelayMs: 20},
+			},
+		},
+	})
+	assert.Nil(t, err)
+	defer cli.Close()
+
+	conn, err := cli.Get()
+	assert.Nil(t, err)
+
+	t0 := time.Now()
+	header, p := metadata.MD{}, peer.Peer{}
+	rsp, err := grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{},
+		grpc.Header(&header), grpc.Peer(&p))
+	assert.Nil(t, err)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, rsp.Status)
+	assert.True(t, time.Since(t0) < time.Millisecond*500)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&svr.calls))
+	// the winning attempt fills the call options of the caller
+	assert.NotNil(t, p.Addr)
+	assert.Equal(t, addr, p.Addr.String())
+}
+
+func TestRetryBudget(t *testing.T) {
+	now := time.Now()
+	b := newRetryBudget(0.5, 0)
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 4; i++ {
+		b.deposit()
+	}
+	assert.True(t, b.withdraw())
+	assert.True(t, b.withdraw())
+	assert.False(t, b.withdraw())
+
+	// the window has passed
+	now = now.Add(time.Second * budgetWindowSec)
+	assert.False(t, b.withdraw())
+	b.deposit()
+	b.deposit()
+	assert.True(t, b.withdraw())
+}
+
+func TestParseCode(t *testing.T) {
+	code, ok := parseCode("DEADLINE_EXCEEDED")
+	assert.True(t, ok)
+	assert.Equal(t, codes.DeadlineExceeded, code)
+	code, ok = parseCode("Unavailable")
+	assert.True(t, ok)
+	assert.Equal(t, codes.Unavailable, code)
+	_, ok = parseCode("not_a_code")
+	assert.False(t, ok)
+}
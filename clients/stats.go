@@ -0,0 +1,129 @@
+package clients
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xutils/lib-common/utils"
+)
+
+/**
+####################################################################################
+POOL STATS
+a snapshot of what a pool holds, every pool created by NewGrpcClientBase is
+registered until Close so that PoolStatsHandler can render them on a debug port
+*/
+
+type PoolStats struct {
+	SvrName        string          `json:"svr_name"`
+	Caller         string          `json:"caller"`
+	LongConnection bool            `json:"long_connection"`
+	Balancer       string          `json:"balancer"`
+	Capacity       int             `json:"capacity"`
+	Addrs          []PoolAddrStats `json:"addrs"`
+	// long connection pool only
+	Conns         []PoolConnStats `json:"conns,omitempty"`
+	RecycledCnt   int64           `json:"recycled_cnt"`
+	LastBalanceTs int64           `json:"last_balance_ts"`
+	// recycled conns waiting for their rpcs to end
+	Draining int `json:"draining"`
+	// short connection pool only
+	InUse       int `json:"in_use"`
+	Idle        int `json:"idle"`
+	MaxInFlight int `json:"max_in_flight"`
+}
+
+type PoolAddrStats struct {
+	Addr      string `json:"addr"`
+	Weight    int    `json:"weight"`
+	LoadScore int64  `json:"load_score"`
+	Healthy   bool   `json:"healthy"`
+	// empty without breaker
+	Breaker     string  `json:"breaker,omitempty"`
+	Outstanding int64   `json:"outstanding"`
+	LatencyMs   float64 `json:"latency_ms"`
+	// conns dialed to the addr, in use or idle
+	Conns int `json:"conns"`
+	Idle  int `json:"idle"`
+}
+
+type PoolConnStats struct {
+	Idx    int    `json:"idx"`
+	Addr   string `json:"addr"`
+	State  string `json:"state"`
+	Ts     int64  `json:"ts"`
+	AgeSec int64  `json:"age_sec"`
+	// Gets not followed by a Put yet
+	Leases   int64 `json:"leases"`
+	InFlight int64 `json:"in_flight"`
+}
+
+var (
+	clientRegistryMtx = &sync.RWMutex{}
+	clientRegistry    = map[*GrpcClientBase]struct{}{}
+)
+
+func registerClient(cli *GrpcClientBase) {
+	clientRegistryMtx.Lock()
+	defer clientRegistryMtx.Unlock()
+	clientRegistry[cli] = struct{}{}
+}
+
+func unregisterClient(cli *GrpcClientBase) {
+	clientRegistryMtx.Lock()
+	defer clientRegistryMtx.Unlock()
+	delete(clientRegistry, cli)
+}
+
+// AllPoolStats returns the stats of all the living clients sorted by svr name
+func AllPoolStats() (stats []PoolStats) {
+	clientRegistryMtx.RLock()
+	clis := make([]*GrpcClientBase, 0, len(clientRegistry))
+	for cli := range clientRegistry {
+		clis = append(clis, cli)
+	}
+	clientRegistryMtx.RUnlock()
+
+	stats = make([]PoolStats, 0, len(clis))
+	for _, cli := range clis {
+		stats = append(stats, cli.Stats())
+	}
+	sort.SliceStable(stats, func(i, j int) bool { return stats[i].SvrName < stats[j].SvrName })
+	return
+}
+
+// PoolStatsHandler renders AllPoolStats as json, ?svr_name= keeps the pools of
+// one svr only
+func PoolStatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := AllPoolStats()
+		if svrName := r.URL.Query().Get("svr_name"); svrName != "" {
+			filtered := []PoolStats{}
+			for _, s := range stats {
+				if s.SvrName == svrName {
+					filtered = append(filtered, s)
+				}
+			}
+			stats = filtered
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(utils.MustBytes(stats))
+	})
+}
+
+func (stat *addrStats) poolAddrStats() PoolAddrStats {
+	s := PoolAddrStats{
+		Addr:        stat.addr,
+		Weight:      stat.weight,
+		LoadScore:   stat.score(),
+		Outstanding: stat.Outstanding(),
+		LatencyMs:   float64(stat.Latency()) / float64(time.Millisecond),
+	}
+	s.Healthy = !stat.isRemoved() && stat.isReady() && s.LoadScore < UNHEALTH_LOAD_SCORE
+	if stat.breaker != nil {
+		s.Breaker = stat.breaker.State().String()
+	}
+	return s
+}
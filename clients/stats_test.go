@@ -0,0 +1,58 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolStatsHandler(t *testing.T) {
+	addr, stop := startFlakyServer(t, &flakyHealthServer{})
+	defer stop()
+
+	longCli, err := NewGrpcClientBase(GrpcClientConfig{
+		SvrName:        "stats_long",
+		Addrs:          []string{addr},
+		LongConnection: true,
+		PoolSize:       2,
+	})
+	assert.Nil(t, err)
+	defer longCli.Close()
+
+	shortCli, err := NewGrpcClientBase(GrpcClientConfig{
+		SvrName: "stats_short",
+		Addrs:   []string{addr},
+	})
+	assert.Nil(t, err)
+	conn, err := shortCli.Get()
+	assert.Nil(t, err)
+	shortCli.Put(conn)
+
+	rec := httptest.NewRecorder()
+	PoolStatsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/grpc_pools?svr_name=stats_long", nil))
+	stats := []PoolStats{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+	assert.Equal(t, 1, len(stats))
+	assert.True(t, stats[0].LongConnection)
+	assert.Equal(t, 2, len(stats[0].Conns))
+	assert.Equal(t, addr, stats[0].Conns[0].Addr)
+	assert.Equal(t, 1, len(stats[0].Addrs))
+	assert.Equal(t, 2, stats[0].Addrs[0].Conns)
+	assert.True(t, stats[0].Addrs[0].Healthy)
+
+	assert.Nil(t, longCli.HealthCheck(context.Background()))
+	assert.Nil(t, shortCli.HealthCheck(context.Background()))
+
+	short := shortCli.Stats()
+	assert.Equal(t, 1, short.Idle)
+	assert.Equal(t, 0, short.InUse)
+
+	// closed clients are unregistered
+	shortCli.Close()
+	for _, s := range AllPoolStats() {
+		assert.NotEqual(t, "stats_short", s.SvrName)
+	}
+}
@@ -0,0 +1,215 @@
+package clients
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/xutils/lib-common/xlog"
+
+	"google.golang.org/grpc/credentials"
+)
+
+/**
+####################################################################################
+TLS
+transport credentials built from TLSConfig, shared by the client pools and the
+servers of middleware. the files are checked on handshake at most once every
+ReloadIntervalSec and reloaded once changed, so rotated certs apply to the new
+conns without restart
+*/
+
+type TLSConfig struct {
+	Enable bool `toml:"enable"`
+	// ca bundle verifying the peer, the system roots when empty on client side
+	CAFile string `toml:"ca_file"`
+	// cert and key presented to the peer, required on server side and for mtls
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	// client only, overrides the name checked against the server cert
+	ServerName string `toml:"server_name"`
+	// server only, clients must present a cert signed by CAFile
+	RequireClientCert bool `toml:"require_client_cert"`
+	// 0 disables reloading
+	ReloadIntervalSec int `toml:"reload_interval_sec"`
+}
+
+// NewClientTLSCredentials returns the credentials to dial with
+func NewClientTLSCredentials(conf TLSConfig) (credentials.TransportCredentials, error) {
+	files, err := newTLSFiles(conf, false)
+	if err != nil {
+		return nil, err
+	}
+	return &reloadingCreds{files: files, serverName: conf.ServerName}, nil
+}
+
+// NewServerTLSCredentials returns the credentials to serve with, see grpc.Creds
+func NewServerTLSCredentials(conf TLSConfig) (credentials.TransportCredentials, error) {
+	if conf.CertFile == "" || conf.KeyFile == "" {
+		return nil, fmt.Errorf("cert_file and key_file are required on server side")
+	}
+	files, err := newTLSFiles(conf, true)
+	if err != nil {
+		return nil, err
+	}
+	return &reloadingCreds{files: files}, nil
+}
+
+type tlsFiles struct {
+	conf   TLSConfig
+	server bool
+
+	mtx      *sync.Mutex
+	checkTs  time.Time
+	modTimes map[string]time.Time
+	tlsConf  *tls.Config
+}
+
+func newTLSFiles(conf TLSConfig, server bool) (f *tlsFiles, err error) {
+	f = &tlsFiles{
+		conf:    conf,
+		server:  server,
+		mtx:     &sync.Mutex{},
+		checkTs: time.Now(),
+	}
+	if f.modTimes, err = f.stat(); err != nil {
+		return nil, err
+	}
+	if f.tlsConf, err = f.load(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (f *tlsFiles) stat() (modTimes map[string]time.Time, err error) {
+	modTimes = map[string]time.Time{}
+	for _, file := range []string{f.conf.CAFile, f.conf.CertFile, f.conf.KeyFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[file] = info.ModTime()
+	}
+	return
+}
+
+func (f *tlsFiles) load() (tlsConf *tls.Config, err error) {
+	tlsConf = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if f.conf.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(f.conf.CertFile, f.conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+
+	var caPool *x509.CertPool
+	if f.conf.CAFile != "" {
+		pem, err := ioutil.ReadFile(f.conf.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no cert found in ca file||ca_file=%v", f.conf.CAFile)
+		}
+	}
+
+	if f.server {
+		tlsConf.ClientCAs = caPool
+		if f.conf.RequireClientCert {
+			tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+		} else if caPool != nil {
+			tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	} else {
+		tlsConf.RootCAs = caPool
+		tlsConf.ServerName = f.conf.ServerName
+	}
+	return
+}
+
+// current reloads the files if the reload interval has passed and they changed,
+// the last good config is kept when the new files fail to load
+func (f *tlsFiles) current() *tls.Config {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	interval := time.Duration(f.conf.ReloadIntervalSec) * time.Second
+	if interval <= 0 || time.Since(f.checkTs) < interval {
+		return f.tlsConf
+	}
+	f.checkTs = time.Now()
+
+	modTimes, err := f.stat()
+	if err != nil {
+		xlog.Error("_tls_reload||failed to stat||err=%v", err)
+		return f.tlsConf
+	}
+	changed := false
+	for file, modTime := range modTimes {
+		if !modTime.Equal(f.modTimes[file]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return f.tlsConf
+	}
+	tlsConf, err := f.load()
+	if err != nil {
+		xlog.Error("_tls_reload||failed to load||cert_file=%v||ca_file=%v||err=%v",
+			f.conf.CertFile, f.conf.CAFile, err)
+		return f.tlsConf
+	}
+	xlog.Info("_tls_reload||reloaded||cert_file=%v||ca_file=%v", f.conf.CertFile, f.conf.CAFile)
+	f.modTimes, f.tlsConf = modTimes, tlsConf
+	return f.tlsConf
+}
+
+// reloadingCreds handshakes with the current config of files
+type reloadingCreds struct {
+	files      *tlsFiles
+	serverName string
+}
+
+func (c *reloadingCreds) creds() credentials.TransportCredentials {
+	tlsConf := c.files.current().Clone()
+	if c.serverName != "" {
+		tlsConf.ServerName = c.serverName
+	}
+	return credentials.NewTLS(tlsConf)
+}
+
+func (c *reloadingCreds) ClientHandshake(
+	ctx context.Context,
+	authority string,
+	rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return c.creds().ClientHandshake(ctx, authority, rawConn)
+}
+
+func (c *reloadingCreds) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return c.creds().ServerHandshake(rawConn)
+}
+
+func (c *reloadingCreds) Info() credentials.ProtocolInfo {
+	return c.creds().Info()
+}
+
+func (c *reloadingCreds) Clone() credentials.TransportCredentials {
+	return &reloadingCreds{files: c.files, serverName: c.serverName}
+}
+
+func (c *reloadingCreds) OverrideServerName(serverName string) error {
+	c.serverName = serverName
+	return nil
+}
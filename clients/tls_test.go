@@ -0,0 +1,181 @@
+package clients
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test_ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue writes the cert and key signed by ca to dir/name.crt and dir/name.key
+func (ca *testCA) issue(t *testing.T, dir, name string, serial int64) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	assert.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return
+}
+
+func (ca *testCA) write(t *testing.T, dir string) (caFile string) {
+	caFile = filepath.Join(dir, "ca.crt")
+	assert.Nil(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600))
+	return
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	caFile := ca.write(t, dir)
+	svrCert, svrKey := ca.issue(t, dir, "server", 2)
+	cliCert, cliKey := ca.issue(t, dir, "client", 3)
+
+	creds, err := NewServerTLSCredentials(TLSConfig{
+		Enable:            true,
+		CAFile:            caFile,
+		CertFile:          svrCert,
+		KeyFile:           svrKey,
+		RequireClientCert: true,
+	})
+	assert.Nil(t, err)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := grpc.NewServer(grpc.Creds(creds))
+	grpc_health_v1.RegisterHealthServer(s, &flakyHealthServer{})
+	go func() {
+		_ = s.Serve(lis)
+	}()
+	defer s.Stop()
+
+	check := func(conf TLSConfig) error {
+		cli, err := NewGrpcClientBase(GrpcClientConfig{
+			Addrs:         []string{lis.Addr().String()},
+			ReadTimeoutMs: 1000,
+			TLS:           conf,
+		})
+		if err != nil {
+			return err
+		}
+		defer cli.Close()
+		conn, err := cli.Get()
+		if err != nil {
+			return err
+		}
+		defer cli.Put(conn)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		return err
+	}
+
+	assert.Nil(t, check(TLSConfig{Enable: true, CAFile: caFile, CertFile: cliCert, KeyFile: cliKey}))
+	// no client cert
+	assert.NotNil(t, check(TLSConfig{Enable: true, CAFile: caFile}))
+	// server cert not trusted
+	other := newTestCA(t)
+	otherDir := filepath.Join(dir, "other")
+	assert.Nil(t, os.Mkdir(otherDir, 0700))
+	assert.NotNil(t, check(TLSConfig{Enable: true, CAFile: other.write(t, otherDir), CertFile: cliCert, KeyFile: cliKey}))
+
+	// hmac tokens go over tls only
+	assert.True(t, NewHmacCredentials("svr_a", "secret_a").RequireTransportSecurity())
+	_, err = NewGrpcClientBase(GrpcClientConfig{
+		Addrs:      []string{lis.Addr().String()},
+		Caller:     "svr_a",
+		HmacSecret: "secret_a",
+	})
+	assert.NotNil(t, err)
+	cli, err := NewGrpcClientBase(GrpcClientConfig{
+		Addrs:      []string{lis.Addr().String()},
+		Caller:     "svr_a",
+		HmacSecret: "secret_a",
+		TLS:        TLSConfig{Enable: true, CAFile: caFile, CertFile: cliCert, KeyFile: cliKey},
+	})
+	assert.Nil(t, err)
+	defer cli.Close()
+	conn, err := cli.Get()
+	assert.Nil(t, err)
+	defer cli.Put(conn)
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.Nil(t, err)
+}
+
+func TestTLSReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, dir, "server", 2)
+	files, err := newTLSFiles(TLSConfig{CertFile: certFile, KeyFile: keyFile, ReloadIntervalSec: 1}, true)
+	assert.Nil(t, err)
+	old := files.current()
+
+	// rotated cert, picked up once the interval has passed
+	ca.issue(t, dir, "server", 4)
+	future := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(certFile, future, future))
+	assert.Equal(t, old, files.current())
+	files.checkTs = time.Now().Add(-time.Second * 2)
+	cur := files.current()
+	assert.NotEqual(t, old, cur)
+	leaf, err := x509.ParseCertificate(cur.Certificates[0].Certificate[0])
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), leaf.SerialNumber.Int64())
+}
@@ -0,0 +1,102 @@
+package errors
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Code is either a grpc code (1 to 16) or a business code declared by
+// Register, business codes should be >= 1000 to be told from the grpc codes
+// and from json_rsp_unmarshal.CodeSucc
+type Code int32
+
+const (
+	OK Code = 0
+
+	// codes of the json responses
+	CodeSucc        Code = 200
+	CodeDecodeError Code = 100000
+)
+
+type codeInfo struct {
+	name     string
+	grpcCode codes.Code
+}
+
+var (
+	codesMtx = &sync.RWMutex{}
+	codeMap  = map[Code]codeInfo{
+		CodeDecodeError: {name: "DECODE_ERROR", grpcCode: codes.Internal},
+	}
+)
+
+// Register declares code, named name, mapped to grpcCode and so to the http
+// status of grpcCode. it panics on a code registered twice or a grpc code
+func Register(code Code, grpcCode codes.Code, name string) Code {
+	codesMtx.Lock()
+	defer codesMtx.Unlock()
+	if code.IsGRPC() {
+		panic(fmt.Sprintf("grpc code registered as business code||code=%d", int32(code)))
+	}
+	if info, ok := codeMap[code]; ok {
+		panic(fmt.Sprintf("code registered twice||code=%d||name=%v||registered=%v", int32(code), name, info.name))
+	}
+	codeMap[code] = codeInfo{name: name, grpcCode: grpcCode}
+	return code
+}
+
+// IsGRPC tells if c is one of the grpc codes
+func (c Code) IsGRPC() bool {
+	return c >= 0 && c <= Code(codes.Unauthenticated)
+}
+
+// IsOK tells if c is a success code
+func (c Code) IsOK() bool {
+	return c == OK || c == CodeSucc
+}
+
+// GRPCCode returns the grpc code c maps to, codes.Unknown for the business
+// codes not registered
+func (c Code) GRPCCode() codes.Code {
+	if c.IsOK() {
+		return codes.OK
+	}
+	if c.IsGRPC() {
+		return codes.Code(c)
+	}
+	codesMtx.RLock()
+	defer codesMtx.RUnlock()
+	if info, ok := codeMap[c]; ok {
+		return info.grpcCode
+	}
+	return codes.Unknown
+}
+
+// HTTPStatus returns the http status c maps to, the one the gateway uses for
+// the grpc code of c
+func (c Code) HTTPStatus() int {
+	if c.IsOK() {
+		return http.StatusOK
+	}
+	return runtime.HTTPStatusFromCode(c.GRPCCode())
+}
+
+func (c Code) String() string {
+	if c.IsOK() {
+		return "OK"
+	}
+	if c.IsGRPC() {
+		return codes.Code(c).String()
+	}
+	codesMtx.RLock()
+	defer codesMtx.RUnlock()
+	if info, ok := codeMap[c]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("CODE_%d", int32(c))
+}
@@ -0,0 +1,186 @@
+package errors
+
+import (
+	stderrors "errors"
+	"fmt"
+	"strconv"
+
+	protoV1 "github.com/golang/protobuf/proto"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/**
+####################################################################################
+ERRORS
+one error model for grpc statuses, the Error field of the responses and the
+code of the json responses: an Error has a Code, a message, an optional cause
+and details. over grpc the business code travels in an errdetails.ErrorInfo of
+ErrorDomain, over http as the code of the json response
+*/
+
+const (
+	ErrorDomain  = "lib-common"
+	metadataCode = "code"
+)
+
+type Error struct {
+	Code    Code
+	Message string
+	Details []protoV1.Message
+	cause   error
+}
+
+func New(code Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func Newf(code Code, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Wrap returns an Error of code caused by err, nil when err is nil
+func Wrap(err error, code Code, message string) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Code: code, Message: message, cause: err}
+}
+
+func Wrapf(err error, code Code, format string, args ...interface{}) error {
+	return Wrap(err, code, fmt.Sprintf(format, args...))
+}
+
+func (e *Error) Error() string {
+	if e.cause != nil {
+		return fmt.Sprintf("%v: %v", e.Message, e.cause)
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// Is matches the Errors of the same code, so that errors.Is(err, ErrNotFound)
+// holds for any Error of the code of ErrNotFound
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// WithDetails returns a copy of e with details appended
+func (e *Error) WithDetails(details ...protoV1.Message) *Error {
+	dup := *e
+	dup.Details = append(append([]protoV1.Message{}, e.Details...), details...)
+	return &dup
+}
+
+func (e *Error) HTTPStatus() int {
+	return e.Code.HTTPStatus()
+}
+
+// GRPCStatus returns the status of the grpc code of e, with an ErrorInfo
+// holding the business code followed by the details of e
+func (e *Error) GRPCStatus() *status.Status {
+	st := status.New(e.Code.GRPCCode(), e.Error())
+	if st.Code() == codes.OK {
+		return st
+	}
+	details := e.Details
+	if !e.Code.IsGRPC() {
+		details = append([]protoV1.Message{&errdetails.ErrorInfo{
+			Reason:   e.Code.String(),
+			Domain:   ErrorDomain,
+			Metadata: map[string]string{metadataCode: strconv.Itoa(int(e.Code))},
+		}}, details...)
+	}
+	if len(details) == 0 {
+		return st
+	}
+	withDetails, err := st.WithDetails(details...)
+	if err != nil {
+		return st
+	}
+	return withDetails
+}
+
+// FromStatus returns the Error of st, nil for OK. the business code is read
+// from the ErrorInfo of ErrorDomain, and codes out of the grpc range, e.g. the
+// ones of the json responses, are taken as business codes
+func FromStatus(st *status.Status) *Error {
+	if st == nil || Code(st.Code()).IsOK() {
+		return nil
+	}
+	e := &Error{Code: Code(st.Code()), Message: st.Message()}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Domain == ErrorDomain {
+			if code, err := strconv.Atoi(info.Metadata[metadataCode]); err == nil {
+				e.Code = Code(code)
+				continue
+			}
+		}
+		if msg, ok := detail.(protoV1.Message); ok {
+			e.Details = append(e.Details, msg)
+		}
+	}
+	return e
+}
+
+// FromError returns the Error err is or wraps, or the one of its grpc status,
+// the other errs are Unknown. nil for nil
+func FromError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if stderrors.As(err, &e) {
+		return e
+	}
+	if st, ok := status.FromError(err); ok {
+		return FromStatus(st)
+	}
+	return &Error{Code: Code(codes.Unknown), Message: err.Error(), cause: err}
+}
+
+// ToGRPC returns an err grpc gets the status of, the Error err wraps is
+// otherwise missed by grpc. the message is the one of the whole chain
+func ToGRPC(err error) error {
+	if _, ok := err.(interface{ GRPCStatus() *status.Status }); ok {
+		return err
+	}
+	var e *Error
+	if !stderrors.As(err, &e) {
+		return err
+	}
+	return &Error{Code: e.Code, Message: err.Error(), Details: e.Details}
+}
+
+// CodeOf returns the code of err, OK for nil
+func CodeOf(err error) Code {
+	if e := FromError(err); e != nil {
+		return e.Code
+	}
+	return OK
+}
+
+// FromCode returns the Error of the code and message of a response, e.g. the
+// Error field or a json response, nil for the success codes
+func FromCode(code int64, message string) *Error {
+	if Code(code).IsOK() {
+		return nil
+	}
+	return New(Code(code), message)
+}
+
+// As and Is are the ones of the standard errors, for the callers importing
+// this package as errors
+func As(err error, target interface{}) bool {
+	return stderrors.As(err, target)
+}
+
+func Is(err, target error) bool {
+	return stderrors.Is(err, target)
+}
@@ -0,0 +1,76 @@
+package errors
+
+import (
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	protoV1 "github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var codeUserNotFound = Register(10404, codes.NotFound, "USER_NOT_FOUND")
+
+func TestCode(t *testing.T) {
+	assert.Equal(t, codes.NotFound, codeUserNotFound.GRPCCode())
+	assert.Equal(t, http.StatusNotFound, codeUserNotFound.HTTPStatus())
+	assert.Equal(t, "USER_NOT_FOUND", codeUserNotFound.String())
+
+	assert.Equal(t, codes.InvalidArgument, Code(codes.InvalidArgument).GRPCCode())
+	assert.Equal(t, http.StatusBadRequest, Code(codes.InvalidArgument).HTTPStatus())
+	assert.Equal(t, codes.OK, CodeSucc.GRPCCode())
+	assert.Equal(t, codes.Internal, CodeDecodeError.GRPCCode())
+	assert.Equal(t, codes.Unknown, Code(20000).GRPCCode())
+	assert.Equal(t, "CODE_20000", Code(20000).String())
+
+	assert.Panics(t, func() { Register(10404, codes.NotFound, "DUP") })
+	assert.Panics(t, func() { Register(Code(codes.NotFound), codes.NotFound, "GRPC") })
+}
+
+func TestWrap(t *testing.T) {
+	cause := stderrors.New("record not found")
+	err := Wrap(cause, codeUserNotFound, "no such user")
+	assert.Equal(t, "no such user: record not found", err.Error())
+	assert.True(t, Is(err, cause))
+	assert.True(t, Is(err, New(codeUserNotFound, "")))
+	assert.False(t, Is(err, New(Code(codes.NotFound), "")))
+	assert.Nil(t, Wrap(nil, codeUserNotFound, "no such user"))
+
+	// wrapped by fmt, the code is still found
+	wrapped := fmt.Errorf("get user: %w", err)
+	assert.Equal(t, codeUserNotFound, CodeOf(wrapped))
+	assert.Equal(t, codes.NotFound, status.Code(ToGRPC(wrapped)))
+	assert.Equal(t, "get user: no such user: record not found", status.Convert(ToGRPC(wrapped)).Message())
+	assert.Equal(t, OK, CodeOf(nil))
+	assert.Equal(t, Code(codes.Unknown), CodeOf(cause))
+}
+
+func TestGRPCRoundTrip(t *testing.T) {
+	err := New(codeUserNotFound, "no such user").WithDetails(&errdetails.ResourceInfo{ResourceName: "user_1"})
+
+	// as sent over the wire
+	data, _err := protoV1.Marshal(status.Convert(err).Proto())
+	assert.Nil(t, _err)
+	pb := &spb.Status{}
+	assert.Nil(t, protoV1.Unmarshal(data, pb))
+	st := status.FromProto(pb)
+	assert.Equal(t, codes.NotFound, st.Code())
+
+	e := FromError(st.Err())
+	assert.Equal(t, codeUserNotFound, e.Code)
+	assert.Equal(t, "no such user", e.Message)
+	assert.Equal(t, 1, len(e.Details))
+	assert.Equal(t, "user_1", e.Details[0].(*errdetails.ResourceInfo).ResourceName)
+
+	// codes of the json responses
+	assert.Nil(t, FromStatus(status.New(codes.Code(CodeSucc), "success")))
+	assert.Equal(t, codeUserNotFound, FromStatus(status.New(codes.Code(codeUserNotFound), "no such user")).Code)
+	assert.Nil(t, FromCode(0, ""))
+	assert.Equal(t, codeUserNotFound, FromCode(10404, "no such user").Code)
+}
@@ -1,6 +1,7 @@
 package gorm_helper
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"runtime/debug"
@@ -13,6 +14,7 @@ import (
 	"github.com/jinzhu/gorm"
 	"github.com/xutils/lib-common/iowrapper/model"
 	"github.com/xutils/lib-common/local_context"
+	"github.com/xutils/lib-common/tracing"
 	"github.com/xutils/lib-common/xlog"
 	"github.com/smallnest/weighted"
 )
@@ -100,6 +102,22 @@ func (m *GormModelBase) SlaveDB(ctx ...local_context.TraceContext) *gorm.DB {
 	return db
 }
 
+// HealthCheck pings the master and the slaves, see health.Checker
+func (m *GormModelBase) HealthCheck(ctx context.Context) error {
+	if err := m.db.DB().PingContext(ctx); err != nil {
+		return fmt.Errorf("failed to ping master||err=%v", err)
+	}
+	for idx, db := range m.slaveDbs {
+		if db == nil {
+			return fmt.Errorf("slave not inited||idx=%v", idx)
+		}
+		if err := db.DB().PingContext(ctx); err != nil {
+			return fmt.Errorf("failed to ping slave||idx=%v||err=%v", idx, err)
+		}
+	}
+	return nil
+}
+
 func (m *GormModelBase) SetTrace(ctx local_context.TraceContext, db *gorm.DB) (dbOut *gorm.DB) {
 	dbOut = db
 	if ctx.LogId() != "" {
@@ -109,6 +127,26 @@ func (m *GormModelBase) SetTrace(ctx local_context.TraceContext, db *gorm.DB) (d
 	return
 }
 
+// startDbSpan starts the span of a db operation, child of the span of ctx
+func startDbSpan(ctx *local_context.LocalContext, operation, table string) *tracing.Span {
+	_, span := tracing.StartSpan(ctx, "gorm."+operation, tracing.SpanKindClient)
+	if span.IsRecording() {
+		span.SetAttribute(tracing.AttrDbSystem, "mysql")
+		span.SetAttribute(tracing.AttrDbOperation, operation)
+		span.SetAttribute(tracing.AttrDbTable, table)
+		span.SetAttribute(tracing.AttrLogId, ctx.LogId())
+	}
+	return span
+}
+
+// writeActionsTable returns the table of the first action
+func writeActionsTable(actions []DataWriteAction) string {
+	if entity := actions[0].Entity(); entity != nil {
+		return entity.TableName()
+	}
+	return ""
+}
+
 func (m *GormModelBase) Cache() *model.BaseCacheModel {
 	return m.cache
 }
@@ -124,6 +162,10 @@ func (m *GormModelBase) ProcWriteActions(ctx *local_context.LocalContext, action
 		err = fmt.Errorf("action is empty")
 		return
 	}
+	span := startDbSpan(ctx, "write", writeActionsTable(actions))
+	defer func() {
+		span.Finish(err)
+	}()
 	db := m.DB(ctx)
 	defer func() {
 		if rslt != nil && err == nil {
@@ -277,6 +319,10 @@ func (m *GormModelBase) ProcQuery(
 	ctx *local_context.LocalContext,
 	action *DataQueryAction,
 	out interface{}) (rslt *gorm.DB, totalCnt int64, err error) {
+	span := startDbSpan(ctx, "query", action.TableName)
+	defer func() {
+		span.Finish(err)
+	}()
 
 	if !action.SkipCount {
 		c, err := m.CountQuery(ctx, action)
@@ -309,6 +355,10 @@ func (m *GormModelBase) ProcQuery(
 func (m *GormModelBase) CountQuery(
 	ctx *local_context.LocalContext,
 	action *DataQueryAction) (c *DataQueryCache, err error) {
+	span := startDbSpan(ctx, "count", action.TableName)
+	defer func() {
+		span.Finish(err)
+	}()
 	c = &DataQueryCache{}
 	key, err := action.cacheKey(totalCntCacheKey)
 
@@ -352,6 +402,10 @@ func (m *GormModelBase) CountQuery(
 func (m *GormModelBase) ProcAggregation(
 	ctx *local_context.LocalContext,
 	action *DataAggregationAction) (output [][]ValAny, err error) {
+	span := startDbSpan(ctx, "aggregation", action.TableName)
+	defer func() {
+		span.Finish(err)
+	}()
 
 	rslt := m.SlaveDB(ctx).Table(action.TableName).
 		Select(strings.Join(action.Fields, ","))
@@ -0,0 +1,469 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xutils/lib-common/xlog"
+
+	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+/**
+####################################################################################
+HEALTH
+the checkers of the components, e.g. GormModelBase, redis clients, kafka
+consumers and grpc client pools, run periodically, their results aggregated into
+the serving status of the grpc.health.v1 service and of the /healthz and
+/readyz handlers
+*/
+
+const (
+	PATH_HEALTHZ = "/healthz"
+	PATH_READYZ  = "/readyz"
+
+	// the service of the status of the whole server
+	SERVICE_ALL = ""
+
+	defaultIntervalMs = 5000
+	defaultTimeoutMs  = 1000
+)
+
+// Checker is implemented by the components, nil when healthy
+type Checker interface {
+	HealthCheck(ctx context.Context) error
+}
+
+// CheckerFunc is a func as Checker
+type CheckerFunc func(ctx context.Context) error
+
+func (f CheckerFunc) HealthCheck(ctx context.Context) error {
+	return f(ctx)
+}
+
+type Config struct {
+	// period of the checks, 5000 when not set
+	IntervalMs int `toml:"interval_ms"`
+	// timeout of a check, 1000 when not set
+	TimeoutMs int `toml:"timeout_ms"`
+	// consecutive failures of a checker before it turns not serving, 1 when
+	// not set, a success turns it serving at once
+	FailureThreshold int `toml:"failure_threshold"`
+}
+
+type CheckerOpt func(c *checker)
+
+// OptServices limits the checker to the grpc services given, it gates all of
+// them without it
+func OptServices(services ...string) CheckerOpt {
+	return func(c *checker) {
+		c.services = append(c.services, services...)
+	}
+}
+
+// OptLiveness makes /healthz fail along the checker too, it is meant for the
+// failures only a restart fixes, e.g. a deadlock
+func OptLiveness() CheckerOpt {
+	return func(c *checker) {
+		c.liveness = true
+	}
+}
+
+type checker struct {
+	name     string
+	checker  Checker
+	services []string
+	liveness bool
+	// consecutive failures
+	failures int
+	serving  bool
+	err      error
+	latency  time.Duration
+	checked  bool
+}
+
+func (c *checker) gates(service string) bool {
+	if service == SERVICE_ALL || len(c.services) == 0 {
+		return true
+	}
+	for _, s := range c.services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+// Health aggregates the results of its checkers, Start runs them
+type Health struct {
+	mtx      *sync.Mutex
+	conf     Config
+	server   *grpchealth.Server
+	checkers []*checker
+	services map[string]bool
+	shutdown bool
+	started  bool
+	// once CheckNow ran
+	checked bool
+	stop    chan struct{}
+	wg      *sync.WaitGroup
+}
+
+func NewHealth(conf Config) *Health {
+	if conf.IntervalMs <= 0 {
+		conf.IntervalMs = defaultIntervalMs
+	}
+	if conf.TimeoutMs <= 0 {
+		conf.TimeoutMs = defaultTimeoutMs
+	}
+	if conf.FailureThreshold <= 0 {
+		conf.FailureThreshold = 1
+	}
+	h := &Health{
+		mtx:      &sync.Mutex{},
+		conf:     conf,
+		server:   grpchealth.NewServer(),
+		services: map[string]bool{SERVICE_ALL: true},
+		stop:     make(chan struct{}),
+		wg:       &sync.WaitGroup{},
+	}
+	// not ready until checked by Start
+	h.server.SetServingStatus(SERVICE_ALL, healthpb.HealthCheckResponse_NOT_SERVING)
+	return h
+}
+
+// AddChecker registers c under name, before Start
+func (h *Health) AddChecker(name string, c Checker, opts ...CheckerOpt) {
+	ch := &checker{name: name, checker: c}
+	for _, opt := range opts {
+		opt(ch)
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.checkers = append(h.checkers, ch)
+	for _, service := range ch.services {
+		h.addServiceLocked(service)
+	}
+	xlog.Info("_health||checker registered||name=%v||services=%v||liveness=%v", name, ch.services, ch.liveness)
+}
+
+// AddServices adds grpc services the status of is reported, the services of
+// the checkers are added already
+func (h *Health) AddServices(services ...string) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for _, service := range services {
+		h.addServiceLocked(service)
+	}
+}
+
+func (h *Health) addServiceLocked(service string) {
+	if h.services[service] {
+		return
+	}
+	h.services[service] = true
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if h.checked && !h.shutdown && h.servingLocked(service) {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	h.server.SetServingStatus(service, status)
+}
+
+// RegisterGrpc registers the grpc.health.v1 service on s, reporting the
+// status of the services registered on s so far as well
+func (h *Health) RegisterGrpc(s *grpc.Server) {
+	healthpb.RegisterHealthServer(s, h.server)
+	services := []string{}
+	for service := range s.GetServiceInfo() {
+		if service != healthpb.Health_ServiceDesc.ServiceName {
+			services = append(services, service)
+		}
+	}
+	h.AddServices(services...)
+}
+
+// Start checks once, then every IntervalMs until Shutdown
+func (h *Health) Start() {
+	h.CheckNow(context.Background())
+	h.mtx.Lock()
+	if h.started || h.shutdown {
+		h.mtx.Unlock()
+		return
+	}
+	h.started = true
+	h.mtx.Unlock()
+	h.wg.Add(1)
+	go h.checkWorker()
+	xlog.Info("_health||started||interval_ms=%v||checkers=%v", h.conf.IntervalMs, len(h.checkers))
+}
+
+func (h *Health) checkWorker() {
+	defer h.wg.Done()
+	ticker := time.NewTicker(time.Duration(h.conf.IntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			h.CheckNow(context.Background())
+		}
+	}
+}
+
+// Shutdown turns all the services not serving for good, e.g. at the start of
+// a graceful shutdown so that the load balancers stop sending requests
+func (h *Health) Shutdown() {
+	h.mtx.Lock()
+	if h.shutdown {
+		h.mtx.Unlock()
+		return
+	}
+	h.shutdown = true
+	h.mtx.Unlock()
+	close(h.stop)
+	h.wg.Wait()
+	h.server.Shutdown()
+	xlog.Info("_health||shutdown")
+}
+
+// CheckNow runs all the checkers concurrently and updates the statuses
+func (h *Health) CheckNow(ctx context.Context) {
+	h.mtx.Lock()
+	checkers := append([]*checker{}, h.checkers...)
+	h.mtx.Unlock()
+
+	errs := make([]error, len(checkers))
+	latencies := make([]time.Duration, len(checkers))
+	wg := &sync.WaitGroup{}
+	for i, c := range checkers {
+		wg.Add(1)
+		go func(i int, c *checker) {
+			defer wg.Done()
+			t0 := time.Now()
+			errs[i] = h.check(ctx, c)
+			latencies[i] = time.Since(t0)
+		}(i, c)
+	}
+	wg.Wait()
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for i, c := range checkers {
+		c.update(errs[i], latencies[i], h.conf.FailureThreshold)
+	}
+	h.checked = true
+	if h.shutdown {
+		return
+	}
+	for service := range h.services {
+		status := healthpb.HealthCheckResponse_NOT_SERVING
+		if h.servingLocked(service) {
+			status = healthpb.HealthCheckResponse_SERVING
+		}
+		h.server.SetServingStatus(service, status)
+	}
+}
+
+// check runs c within TimeoutMs, the checkers ignoring ctx are given up on
+func (h *Health) check(ctx context.Context, c *checker) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(h.conf.TimeoutMs)*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				done <- fmt.Errorf("panic=%v", e)
+			}
+		}()
+		done <- c.checker.HealthCheck(ctx)
+	}()
+	select {
+	case err = <-done:
+		return
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *checker) update(err error, latency time.Duration, threshold int) {
+	wasServing := c.serving || !c.checked
+	c.err = err
+	c.latency = latency
+	c.checked = true
+	if err == nil {
+		if !c.serving && c.failures > 0 {
+			xlog.Info("_health||check recovered||name=%v||failures=%v", c.name, c.failures)
+		}
+		c.failures = 0
+		c.serving = true
+		return
+	}
+	c.failures++
+	if c.failures >= threshold {
+		c.serving = false
+	}
+	if wasServing {
+		xlog.Warn("_health||check failed||name=%v||failures=%v||serving=%v||err=%v", c.name, c.failures, c.serving, err)
+	}
+}
+
+// servingLocked tells if the checkers gating service all serve, the ones not
+// checked yet do not
+func (h *Health) servingLocked(service string) bool {
+	for _, c := range h.checkers {
+		if c.gates(service) && !c.serving {
+			return false
+		}
+	}
+	return true
+}
+
+// Status returns the status of service as reported by the grpc service,
+// SERVICE_UNKNOWN for the services not added
+func (h *Health) Status(service string) healthpb.HealthCheckResponse_ServingStatus {
+	rsp, err := h.server.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		return healthpb.HealthCheckResponse_SERVICE_UNKNOWN
+	}
+	return rsp.Status
+}
+
+// Live tells if the liveness checkers all serve
+func (h *Health) Live() bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for _, c := range h.checkers {
+		if c.liveness && c.checked && !c.serving {
+			return false
+		}
+	}
+	return true
+}
+
+// Ready tells if the server serves, i.e. was checked, all its checkers serve
+// and it is not shut down
+func (h *Health) Ready() bool {
+	return h.Status(SERVICE_ALL) == healthpb.HealthCheckResponse_SERVING
+}
+
+/** ### HTTP */
+
+type CheckReport struct {
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latency_ms"`
+	// consecutive failures, the errs are logged only
+	Failures int `json:"failures,omitempty"`
+}
+
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckReport `json:"checks"`
+}
+
+// Report returns the results of the last checks
+func (h *Health) Report(live bool) (report Report) {
+	status := healthpb.HealthCheckResponse_SERVING
+	if (live && !h.Live()) || (!live && !h.Ready()) {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	report.Status = status.String()
+	report.Checks = map[string]CheckReport{}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for _, c := range h.checkers {
+		if live && !c.liveness {
+			continue
+		}
+		st := healthpb.HealthCheckResponse_NOT_SERVING
+		if c.serving {
+			st = healthpb.HealthCheckResponse_SERVING
+		} else if !c.checked {
+			st = healthpb.HealthCheckResponse_UNKNOWN
+		}
+		report.Checks[c.name] = CheckReport{
+			Status:    st.String(),
+			LatencyMs: c.latency.Milliseconds(),
+			Failures:  c.failures,
+		}
+	}
+	return
+}
+
+// LivenessHandler serves PATH_HEALTHZ, 503 once a liveness checker fails
+func (h *Health) LivenessHandler() http.Handler {
+	return h.handler(true)
+}
+
+// ReadinessHandler serves PATH_READYZ, 503 unless Ready, ?service= reports
+// the status of a grpc service instead
+func (h *Health) ReadinessHandler() http.Handler {
+	return h.handler(false)
+}
+
+func (h *Health) handler(live bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := h.Report(live)
+		if service := r.URL.Query().Get("service"); !live && service != "" {
+			report.Status = h.Status(service).String()
+			for name := range report.Checks {
+				if !h.gates(name, service) {
+					delete(report.Checks, name)
+				}
+			}
+		}
+		code := http.StatusOK
+		if report.Status != healthpb.HealthCheckResponse_SERVING.String() {
+			code = http.StatusServiceUnavailable
+			if report.Status == healthpb.HealthCheckResponse_SERVICE_UNKNOWN.String() {
+				code = http.StatusNotFound
+			}
+		}
+		data, _ := json.Marshal(report)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		if r.Method != http.MethodHead {
+			_, _ = w.Write(data)
+		}
+	})
+}
+
+func (h *Health) gates(name, service string) bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for _, c := range h.checkers {
+		if c.name == name {
+			return c.gates(service)
+		}
+	}
+	return false
+}
+
+// Handle serves PATH_HEALTHZ and PATH_READYZ, true when r is one of them
+func (h *Health) Handle(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case PATH_HEALTHZ:
+		h.LivenessHandler().ServeHTTP(w, r)
+	case PATH_READYZ:
+		h.ReadinessHandler().ServeHTTP(w, r)
+	default:
+		return false
+	}
+	return true
+}
+
+// IsHealthMethod tells if fullMethod is an rpc of the grpc.health.v1 service
+func IsHealthMethod(fullMethod string) bool {
+	return strings.HasPrefix(fullMethod, "/"+healthpb.Health_ServiceDesc.ServiceName+"/")
+}
@@ -0,0 +1,204 @@
+package health
+
+import (
+	"context"
+	stdjson "encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+var errDown = errors.New("down")
+
+// flag is a checker failing while down is set
+type flag struct {
+	down int32
+}
+
+func (f *flag) set(down bool) {
+	v := int32(0)
+	if down {
+		v = 1
+	}
+	atomic.StoreInt32(&f.down, v)
+}
+
+func (f *flag) HealthCheck(ctx context.Context) error {
+	if atomic.LoadInt32(&f.down) == 1 {
+		return errDown
+	}
+	return nil
+}
+
+func TestHealthStatus(t *testing.T) {
+	h := NewHealth(Config{FailureThreshold: 2})
+	db, cache := &flag{}, &flag{}
+	h.AddChecker("db", db)
+	h.AddChecker("cache", cache, OptServices("svc.Cached"))
+	h.AddServices("svc.Plain")
+
+	// not ready until checked
+	assert.False(t, h.Ready())
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, h.Status("svc.Plain"))
+	h.CheckNow(context.Background())
+	assert.True(t, h.Ready())
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, h.Status("svc.Cached"))
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVICE_UNKNOWN, h.Status("svc.Unknown"))
+
+	// the failures below the threshold are tolerated
+	cache.set(true)
+	h.CheckNow(context.Background())
+	assert.True(t, h.Ready())
+	h.CheckNow(context.Background())
+	assert.False(t, h.Ready())
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, h.Status("svc.Cached"))
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, h.Status("svc.Plain"))
+
+	// a success recovers at once
+	cache.set(false)
+	h.CheckNow(context.Background())
+	assert.True(t, h.Ready())
+
+	// the checkers without services gate all of them
+	db.set(true)
+	h.CheckNow(context.Background())
+	h.CheckNow(context.Background())
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, h.Status("svc.Plain"))
+	assert.True(t, h.Live())
+
+	h.Shutdown()
+	db.set(false)
+	h.CheckNow(context.Background())
+	assert.False(t, h.Ready())
+}
+
+func TestHealthCheckTimeoutAndPanic(t *testing.T) {
+	h := NewHealth(Config{TimeoutMs: 20})
+	h.AddChecker("slow", CheckerFunc(func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}))
+	h.AddChecker("panic", CheckerFunc(func(ctx context.Context) error {
+		panic("boom")
+	}))
+	t0 := time.Now()
+	h.CheckNow(context.Background())
+	assert.True(t, time.Since(t0) < 500*time.Millisecond)
+	assert.False(t, h.Ready())
+	report := h.Report(false)
+	assert.Equal(t, "NOT_SERVING", report.Checks["slow"].Status)
+	assert.Equal(t, "NOT_SERVING", report.Checks["panic"].Status)
+}
+
+func TestHealthStart(t *testing.T) {
+	h := NewHealth(Config{IntervalMs: 10})
+	db := &flag{}
+	h.AddChecker("db", db)
+	h.Start()
+	assert.True(t, h.Ready())
+	db.set(true)
+	assert.Eventually(t, func() bool { return !h.Ready() }, time.Second, 5*time.Millisecond)
+	h.Shutdown()
+	h.Shutdown()
+}
+
+func TestHealthHandlers(t *testing.T) {
+	h := NewHealth(Config{})
+	db, loop := &flag{}, &flag{}
+	h.AddChecker("db", db, OptServices("svc.Db"))
+	h.AddChecker("loop", loop, OptLiveness())
+	h.CheckNow(context.Background())
+
+	serve := func(method, target string) (*httptest.ResponseRecorder, bool) {
+		w := httptest.NewRecorder()
+		handled := h.Handle(w, httptest.NewRequest(method, target, nil))
+		return w, handled
+	}
+	w, handled := serve(http.MethodGet, PATH_READYZ)
+	assert.True(t, handled)
+	assert.Equal(t, http.StatusOK, w.Code)
+	report := Report{}
+	assert.Nil(t, stdjson.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, "SERVING", report.Status)
+	assert.Equal(t, 2, len(report.Checks))
+
+	db.set(true)
+	h.CheckNow(context.Background())
+	w, _ = serve(http.MethodGet, PATH_READYZ)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.NotContains(t, w.Body.String(), errDown.Error())
+	// liveness only fails along its checkers
+	w, _ = serve(http.MethodGet, PATH_HEALTHZ+"/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	report = Report{}
+	assert.Nil(t, stdjson.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, []string{"loop"}, keys(report.Checks))
+
+	w, _ = serve(http.MethodGet, PATH_READYZ+"?service=svc.Db")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	w, _ = serve(http.MethodGet, PATH_READYZ+"?service=svc.Unknown")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	loop.set(true)
+	h.CheckNow(context.Background())
+	w, _ = serve(http.MethodHead, PATH_HEALTHZ)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, 0, w.Body.Len())
+
+	_, handled = serve(http.MethodPost, PATH_READYZ)
+	assert.False(t, handled)
+	_, handled = serve(http.MethodGet, "/v1/users")
+	assert.False(t, handled)
+}
+
+func keys(checks map[string]CheckReport) (names []string) {
+	for name := range checks {
+		names = append(names, name)
+	}
+	return
+}
+
+func TestHealthGrpc(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := grpc.NewServer()
+	h := NewHealth(Config{})
+	db := &flag{}
+	h.AddChecker("db", db)
+	h.RegisterGrpc(s)
+	go s.Serve(lis)
+	defer s.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	assert.Nil(t, err)
+	defer conn.Close()
+	cli := healthpb.NewHealthClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rsp, err := cli.Check(ctx, &healthpb.HealthCheckRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, rsp.Status)
+	h.CheckNow(context.Background())
+	rsp, err = cli.Check(ctx, &healthpb.HealthCheckRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, rsp.Status)
+
+	db.set(true)
+	h.CheckNow(context.Background())
+	rsp, err = cli.Check(ctx, &healthpb.HealthCheckRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, rsp.Status)
+
+	assert.True(t, IsHealthMethod("/grpc.health.v1.Health/Check"))
+	assert.False(t, IsHealthMethod("/svc.Health/Check"))
+}
@@ -2,6 +2,7 @@ package http_clients
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -9,9 +10,11 @@ import (
 	"time"
 
 	"github.com/xutils/lib-common/clients"
+	"github.com/xutils/lib-common/errors"
 
 	"github.com/xutils/lib-common/local_context"
 	"github.com/xutils/lib-common/metrics"
+	"github.com/xutils/lib-common/tracing"
 	"github.com/xutils/lib-common/utils"
 	"github.com/xutils/lib-common/xlog"
 
@@ -106,9 +109,11 @@ func (cli *HttpClient) PostJsonBody(
 	proxyReq.Header.Set("content-type", CONTENT_TYPE_JSON)
 	proxyReq.Header.Set(clients.HEADER_CALLER, cli.conf.Caller)
 	proxyReq.Header.Set(clients.HEADER_TRACE, ctx.LogId())
+	span := startHttpSpan(ctx, proxyReq)
 
 	xlog.Info("proxyReq.Header=%+v", proxyReq.Header)
 	rspBody, err := cli.Client.Do(proxyReq)
+	endHttpSpan(span, rspBody, err)
 	/*
 		rspBody, err := cli.Client.Post(
 			url,
@@ -132,6 +137,8 @@ func (cli *HttpClient) PostJsonBody(
 	return
 }
 
+// GetJsonBody gets path and decodes the rsp into rspPtr, when ctx holds a span
+// the request also carries the caller, trace and traceparent headers
 func (cli *HttpClient) GetJsonBody(
 	ctx *local_context.LocalContext,
 	path string,
@@ -156,7 +163,21 @@ func (cli *HttpClient) GetJsonBody(
 		url = fmt.Sprintf("https://%v%v", host, path)
 	}
 
-	rspBody, err := cli.Client.Get(url)
+	proxyReq, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+	// the caller, trace and traceparent headers are only sent within a span,
+	// a get without one goes out bare as before
+	var span *tracing.Span
+	if tracing.SpanFromContext(ctx) != nil {
+		proxyReq.Header.Set(clients.HEADER_CALLER, cli.conf.Caller)
+		proxyReq.Header.Set(clients.HEADER_TRACE, ctx.LogId())
+		span = startHttpSpan(ctx, proxyReq)
+	}
+
+	rspBody, err := cli.Client.Do(proxyReq)
+	endHttpSpan(span, rspBody, err)
 	if err != nil {
 		return
 	}
@@ -174,6 +195,28 @@ func (cli *HttpClient) GetJsonBody(
 	return
 }
 
+// startHttpSpan starts the span of req, child of the span of ctx, and sets
+// its traceparent header
+func startHttpSpan(ctx context.Context, req *http.Request) *tracing.Span {
+	spanCtx, span := tracing.StartSpan(ctx, "HTTP "+req.Method, tracing.SpanKindClient)
+	tracing.InjectHTTP(spanCtx, req.Header)
+	if span.IsRecording() {
+		span.SetAttribute(tracing.AttrHttpMethod, req.Method)
+		span.SetAttribute(tracing.AttrHttpUrl, req.URL.String())
+	}
+	return span
+}
+
+func endHttpSpan(span *tracing.Span, rsp *http.Response, err error) {
+	if rsp != nil {
+		span.SetAttribute(tracing.AttrHttpStatusCode, rsp.StatusCode)
+		if err == nil && rsp.StatusCode >= http.StatusInternalServerError {
+			err = fmt.Errorf("%v", rsp.Status)
+		}
+	}
+	span.Finish(err)
+}
+
 func (cli *HttpClient) decodeRsp(respBytes []byte, v interface{}, marshalerOpt ...RespMarshaler) (err error) {
 	var marshaler RespMarshaler
 	if len(marshalerOpt) == 0 {
@@ -181,9 +224,9 @@ func (cli *HttpClient) decodeRsp(respBytes []byte, v interface{}, marshalerOpt .
 	} else {
 		marshaler = marshalerOpt[0]
 	}
-	errStatus := marshaler.Unmarshal(respBytes, v)
-	if errStatus != nil {
-		err = errStatus.Err()
+	// an *errors.Error holding the code of the response
+	if e := errors.FromStatus(marshaler.Unmarshal(respBytes, v)); e != nil {
+		err = e
 	}
 	return
 }
@@ -2,12 +2,14 @@ package kafka_wrapper
 
 import (
 	"context"
+	"fmt"
 	"runtime/debug"
 	"sync"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/xutils/lib-common/local_context"
+	"github.com/xutils/lib-common/tracing"
 	"github.com/xutils/lib-common/utils"
 	"github.com/xutils/lib-common/xlog"
 )
@@ -26,13 +28,29 @@ type KafkaConsumer struct {
 	consumer *kafka.Consumer
 	conf     KafkaConsumerConfig
 	wg       *sync.WaitGroup
-	msgQueue chan []byte
-	callback func(data []byte)
+	msgQueue chan *kafka.Message
+	callback func(ctx *local_context.LocalContext, data []byte)
+
+	mtx     *sync.Mutex
+	running bool
+	// err of the last read, cleared by the next successful one
+	readErr error
 }
 
 func NewKafkaConsumer(
 	conf KafkaConsumerConfig,
 	callback func(data []byte)) (*KafkaConsumer, error) {
+	return NewTracedKafkaConsumer(conf, func(ctx *local_context.LocalContext, data []byte) {
+		callback(data)
+	})
+}
+
+// NewTracedKafkaConsumer calls callback in a consumer span, child of the one
+// of the traceparent header of the msg, see KafkaProducer.SendMessageWithContext,
+// ctx holds the span and the trace id as log id
+func NewTracedKafkaConsumer(
+	conf KafkaConsumerConfig,
+	callback func(ctx *local_context.LocalContext, data []byte)) (*KafkaConsumer, error) {
 	ctx := local_context.NewLocalContext()
 	cc, err := kafka.NewConsumer(
 		&kafka.ConfigMap{
@@ -53,7 +71,8 @@ func NewKafkaConsumer(
 		callback: callback,
 		conf:     conf,
 		wg:       &sync.WaitGroup{},
-		msgQueue: make(chan []byte, 32),
+		msgQueue: make(chan *kafka.Message, 32),
+		mtx:      &sync.Mutex{},
 	}
 
 	consumer.ctx.Context, consumer.cancel = context.WithCancel(context.Background())
@@ -62,11 +81,13 @@ func NewKafkaConsumer(
 }
 
 func (consumer *KafkaConsumer) Start() {
+	consumer.setRunning(true)
 	consumer.run()
 	xlog.Info(" %s|| kafka consumer started||conf=%v", consumer.ctx.LogId(), utils.MustString(consumer.conf))
 }
 
 func (consumer *KafkaConsumer) Stop() {
+	consumer.setRunning(false)
 	err := consumer.consumer.Unsubscribe()
 	if err != nil {
 		xlog.Error(" %s||failed to Unsubscribe kafka consumer safely||err=%v", consumer.ctx.LogId(), err)
@@ -80,13 +101,60 @@ func (consumer *KafkaConsumer) Stop() {
 	}
 }
 
-func (consumer *KafkaConsumer) msgCallback(data []byte) {
+func (consumer *KafkaConsumer) setRunning(running bool) {
+	consumer.mtx.Lock()
+	defer consumer.mtx.Unlock()
+	consumer.running = running
+}
+
+func (consumer *KafkaConsumer) setReadErr(err error) {
+	consumer.mtx.Lock()
+	defer consumer.mtx.Unlock()
+	consumer.readErr = err
+}
+
+// HealthCheck fails unless the consumer is started and its last read
+// succeeded or timed out, see health.Checker
+func (consumer *KafkaConsumer) HealthCheck(ctx context.Context) error {
+	consumer.mtx.Lock()
+	defer consumer.mtx.Unlock()
+	if !consumer.running {
+		return fmt.Errorf("kafka consumer not running||topics=%v", consumer.conf.Topics)
+	}
+	if consumer.readErr != nil {
+		return fmt.Errorf("failed to read msg||topics=%v||err=%v", consumer.conf.Topics, consumer.readErr)
+	}
+	return nil
+}
+
+func (consumer *KafkaConsumer) msgCallback(msg *kafka.Message) {
+	var parent tracing.SpanContext
+	for _, header := range msg.Headers {
+		if header.Key == tracing.HEADER_TRACEPARENT {
+			parent, _ = tracing.ParseTraceparent(string(header.Value))
+		}
+	}
+	topic := ""
+	if msg.TopicPartition.Topic != nil {
+		topic = *msg.TopicPartition.Topic
+	}
+	spanCtx, span := tracing.StartRemoteSpan(context.Background(), parent, "kafka.consume "+topic, tracing.SpanKindConsumer)
+	if span.IsRecording() {
+		span.SetAttribute(tracing.AttrMsgSystem, "kafka")
+		span.SetAttribute(tracing.AttrMsgDestination, topic)
+	}
+	ctx := local_context.NewLocalContextWithCtx(spanCtx)
+	if parent.IsValid() {
+		ctx.SetLogId(parent.TraceID.String())
+	}
 	defer func() {
 		if e := recover(); e != nil {
 			xlog.Fatal("panic=%v||\n%s", e, debug.Stack())
+			span.SetError(fmt.Errorf("panic=%v", e))
 		}
+		span.End()
 	}()
-	consumer.callback(data)
+	consumer.callback(ctx, msg.Value)
 }
 
 func (consumer *KafkaConsumer) run() {
@@ -143,15 +211,18 @@ func (consumer *KafkaConsumer) receive() {
 			if err != nil {
 				if kafkaErr, ok := err.(kafka.Error); ok {
 					if kafkaErr.Code() == kafka.ErrTimedOut {
+						consumer.setReadErr(nil)
 						continue
 					}
 				}
+				consumer.setReadErr(err)
 				xlog.Warn(" %v|| failed to read msg||err=%v",
 					consumer.ctx.LogId(), err)
 				time.Sleep(3 * time.Second)
 				continue
 			}
-			consumer.msgQueue <- msg.Value
+			consumer.setReadErr(nil)
+			consumer.msgQueue <- msg
 		}
 	}
 }
@@ -1,6 +1,9 @@
 package kafka_wrapper
 
 import (
+	"context"
+
+	"github.com/xutils/lib-common/tracing"
 	"github.com/xutils/lib-common/xlog"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
@@ -50,6 +53,25 @@ func (producer *KafkaProducer) SendMessage(topic string, data []byte) {
 		Value:          data}
 }
 
+// SendMessageWithContext sends data in a producer span, child of the span of
+// ctx, with the traceparent header the consumers continue the trace from
+func (producer *KafkaProducer) SendMessageWithContext(ctx context.Context, topic string, data []byte) {
+	_, span := tracing.StartSpan(ctx, "kafka.produce "+topic, tracing.SpanKindProducer)
+	defer span.End()
+	if span.IsRecording() {
+		span.SetAttribute(tracing.AttrMsgSystem, "kafka")
+		span.SetAttribute(tracing.AttrMsgDestination, topic)
+	}
+	xlog.Debug("msg produced||topic=%v||data=%v", topic, string(data))
+	producer.producer.ProduceChannel() <- &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Value:          data,
+		Headers: []kafka.Header{{
+			Key:   tracing.HEADER_TRACEPARENT,
+			Value: []byte(span.Context.Traceparent()),
+		}}}
+}
+
 func (producer *KafkaProducer) Close() {
 	producer.producer.Close()
 }
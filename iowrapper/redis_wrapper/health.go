@@ -0,0 +1,16 @@
+package redis_wrapper
+
+import (
+	"context"
+
+	"github.com/go-redis/redis"
+
+	"github.com/xutils/lib-common/health"
+)
+
+// HealthChecker pings client, e.g. health.AddChecker("redis", HealthChecker(client))
+func HealthChecker(client *redis.Client) health.Checker {
+	return health.CheckerFunc(func(ctx context.Context) error {
+		return client.WithContext(ctx).Ping().Err()
+	})
+}
@@ -0,0 +1,17 @@
+package redis_wrapper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthChecker(t *testing.T) {
+	// nothing listens there
+	client, err := NewRedisClientWithTimeout(&RedisConfig{Addrs: []string{"127.0.0.1:1"}}, 100*time.Millisecond)
+	assert.Nil(t, err)
+	defer client.Close()
+	assert.NotNil(t, HealthChecker(client).HealthCheck(context.Background()))
+}
@@ -0,0 +1,48 @@
+package redis_wrapper
+
+import (
+	"context"
+
+	"github.com/go-redis/redis"
+
+	"github.com/xutils/lib-common/tracing"
+)
+
+// WithTrace returns a copy of client running its commands in child spans of
+// the span of ctx, e.g. RedisGet(WithTrace(lctx, client), key). the args of
+// the commands are not recorded
+func WithTrace(ctx context.Context, client *redis.Client) *redis.Client {
+	traced := client.WithContext(ctx)
+	traced.WrapProcess(func(process func(cmd redis.Cmder) error) func(cmd redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			span := startRedisSpan(ctx, "redis."+cmd.Name())
+			err := process(cmd)
+			finishRedisSpan(span, err)
+			return err
+		}
+	})
+	traced.WrapProcessPipeline(func(process func(cmds []redis.Cmder) error) func(cmds []redis.Cmder) error {
+		return func(cmds []redis.Cmder) error {
+			span := startRedisSpan(ctx, "redis.pipeline")
+			span.SetAttribute("db.redis.cmd_cnt", len(cmds))
+			err := process(cmds)
+			finishRedisSpan(span, err)
+			return err
+		}
+	})
+	return traced
+}
+
+func startRedisSpan(ctx context.Context, name string) *tracing.Span {
+	_, span := tracing.StartSpan(ctx, name, tracing.SpanKindClient)
+	span.SetAttribute(tracing.AttrDbSystem, "redis")
+	return span
+}
+
+// finishRedisSpan ends span, a missing key is not an err
+func finishRedisSpan(span *tracing.Span, err error) {
+	if err == redis.Nil {
+		err = nil
+	}
+	span.Finish(err)
+}
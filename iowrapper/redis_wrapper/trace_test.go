@@ -0,0 +1,44 @@
+package redis_wrapper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xutils/lib-common/tracing"
+)
+
+func TestWithTrace(t *testing.T) {
+	exporter := tracing.NewInMemoryExporter()
+	defer tracing.SetTracer(tracing.DefaultTracer())
+	tracing.SetTracer(tracing.NewTracer("test", tracing.AlwaysSample(), exporter))
+
+	// nothing listens there, the cmds fail on dial
+	client, err := NewRedisClientWithTimeout(&RedisConfig{Addrs: []string{"127.0.0.1:1"}}, 100*time.Millisecond)
+	assert.Nil(t, err)
+	defer client.Close()
+
+	ctx, parent := tracing.StartSpan(context.Background(), "handler", tracing.SpanKindServer)
+	traced := WithTrace(ctx, client)
+	assert.Equal(t, "", RedisGet(traced, "key"))
+	_, err = traced.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.Get("a")
+		pipe.Get("b")
+		return nil
+	})
+	assert.NotNil(t, err)
+	// not traced
+	RedisGet(client, "key")
+
+	spans := exporter.Spans()
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, "redis.get", spans[0].Name)
+	assert.Equal(t, parent.Context.SpanID, spans[0].ParentID)
+	assert.Equal(t, "redis", spans[0].Attributes[tracing.AttrDbSystem])
+	assert.Equal(t, "all redis down", spans[0].Err)
+	assert.Equal(t, "redis.pipeline", spans[1].Name)
+	assert.Equal(t, 2, spans[1].Attributes["db.redis.cmd_cnt"])
+}
@@ -33,6 +33,25 @@ func (ctx *LocalContext) Get(key string) (data interface{}) {
 	return ctx.data[key]
 }
 
+type localContextKey struct{}
+
+// Value makes the LocalContext reachable from contexts derived from it, see FromContext
+func (ctx *LocalContext) Value(key interface{}) interface{} {
+	if _, ok := key.(localContextKey); ok {
+		return ctx
+	}
+	return ctx.Context.Value(key)
+}
+
+// FromContext returns the closest LocalContext ctx is derived from
+func FromContext(ctx context.Context) (lctx *LocalContext, ok bool) {
+	if ctx == nil {
+		return
+	}
+	lctx, ok = ctx.Value(localContextKey{}).(*LocalContext)
+	return
+}
+
 func NewLocalContext() *LocalContext {
 	return &LocalContext{
 		Context: context.Background(),
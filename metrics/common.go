@@ -152,6 +152,18 @@ func (metrics *MetricsBase) ObserveGauge(count float64, labels ...interface{}) {
 	metrics.MetricsGaugeVec.WithLabelValues(labelStr...).Add(count)
 }
 
+func (metrics *MetricsBase) SetGauge(value float64, labels ...interface{}) {
+
+	if metrics.MetricsGaugeVec == nil {
+		return
+	}
+	labelStr := make([]string, len(labels))
+	for idx, lable := range labels {
+		labelStr[idx] = fmt.Sprintf("%v", lable)
+	}
+	metrics.MetricsGaugeVec.WithLabelValues(labelStr...).Set(value)
+}
+
 func (metrics *MetricsBase) GetMetricsVectors() (collectors []prometheus.Collector) {
 	collectors = []prometheus.Collector{}
 	if metrics.timecostMetricSummeryVec != nil {
@@ -168,3 +180,39 @@ func (metrics *MetricsBase) GetMetricsVectors() (collectors []prometheus.Collect
 	}
 	return
 }
+
+// Register registers the created vectors to the default registry, a vector
+// registered before with the same desc is reused so that several owners can
+// share metrics
+func (metrics *MetricsBase) Register() (err error) {
+	register := func(c prometheus.Collector) prometheus.Collector {
+		if _err := prometheus.Register(c); _err != nil {
+			if are, ok := _err.(prometheus.AlreadyRegisteredError); ok {
+				return are.ExistingCollector
+			}
+			err = _err
+		}
+		return c
+	}
+	if metrics.timecostMetricSummeryVec != nil {
+		if vec, ok := register(metrics.timecostMetricSummeryVec).(*prometheus.SummaryVec); ok {
+			metrics.timecostMetricSummeryVec = vec
+		}
+	}
+	if metrics.timecostMetricVec != nil {
+		if vec, ok := register(metrics.timecostMetricVec).(*prometheus.HistogramVec); ok {
+			metrics.timecostMetricVec = vec
+		}
+	}
+	if metrics.MetricsCountVec != nil {
+		if vec, ok := register(metrics.MetricsCountVec).(*prometheus.CounterVec); ok {
+			metrics.MetricsCountVec = vec
+		}
+	}
+	if metrics.MetricsGaugeVec != nil {
+		if vec, ok := register(metrics.MetricsGaugeVec).(*prometheus.GaugeVec); ok {
+			metrics.MetricsGaugeVec = vec
+		}
+	}
+	return
+}
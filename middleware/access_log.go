@@ -0,0 +1,178 @@
+package middleware
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	protoV1 "github.com/golang/protobuf/proto"
+
+	"github.com/xutils/lib-common/utils"
+	"github.com/xutils/lib-common/xlog"
+
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	protoV2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+/**
+####################################################################################
+ACCESS LOG
+one line per rpc to xlog.Public, payloads are rendered as proto json with the
+fields of RedactFields masked at any depth and cut at MaxPayloadBytes
+*/
+
+const (
+	defaultMaxPayloadBytes = 1024
+	redactedValue          = "***"
+)
+
+type AccessLogConfig struct {
+	// proto field names masked in the payloads, e.g. password, token
+	RedactFields []string `toml:"redact_fields"`
+	// max bytes of each rendered payload, 1024 when not set
+	MaxPayloadBytes int `toml:"max_payload_bytes"`
+	// log method, caller, trace id, latency and status only
+	NoPayload bool `toml:"no_payload"`
+	// short method names not logged, e.g. health checks
+	SkipMethods []string `toml:"skip_methods"`
+}
+
+// OptAccessLog writes an access log line per rpc, or per stream without payload
+func OptAccessLog(conf AccessLogConfig) GrpcInterceptorOpt {
+	l := newAccessLogger(conf)
+	return func(opts *grpcInterceptorOptions) {
+		opts.accessLogger = l
+		xlog.Info("access log registered||redact_fields=%v", conf.RedactFields)
+	}
+}
+
+var accessLogMarshalOptions = protojson.MarshalOptions{
+	UseProtoNames: true,
+}
+
+type accessLogger struct {
+	conf   AccessLogConfig
+	redact map[protoreflect.Name]bool
+	skip   map[string]bool
+}
+
+func newAccessLogger(conf AccessLogConfig) *accessLogger {
+	if conf.MaxPayloadBytes <= 0 {
+		conf.MaxPayloadBytes = defaultMaxPayloadBytes
+	}
+	l := &accessLogger{
+		conf:   conf,
+		redact: map[protoreflect.Name]bool{},
+		skip:   map[string]bool{},
+	}
+	for _, field := range conf.RedactFields {
+		l.redact[protoreflect.Name(field)] = true
+	}
+	for _, method := range conf.SkipMethods {
+		l.skip[method] = true
+	}
+	return l
+}
+
+func accessLogCode(err error) string {
+	return status.Code(err).String()
+}
+
+func (l *accessLogger) logUnary(method, caller, traceId string, t0 time.Time, req, rsp interface{}, err error) {
+	if l.skip[method] {
+		return
+	}
+	if l.conf.NoPayload {
+		xlog.Public("_grpc_access||method=%v||caller=%v||trace_id=%v||timecost=%.2f||code=%v||err=%v",
+			method, caller, traceId, utils.CalTimecost(t0), accessLogCode(err), err)
+		return
+	}
+	xlog.Public("_grpc_access||method=%v||caller=%v||trace_id=%v||timecost=%.2f||code=%v||err=%v||req=%s||rsp=%s",
+		method, caller, traceId, utils.CalTimecost(t0), accessLogCode(err), err, l.render(req), l.render(rsp))
+}
+
+func (l *accessLogger) logStream(method, caller, traceId string, t0 time.Time, recvCnt, sendCnt int64, err error) {
+	if l.skip[method] {
+		return
+	}
+	xlog.Public("_grpc_access||method=%v||caller=%v||trace_id=%v||timecost=%.2f||code=%v||err=%v||stream||recv=%v||send=%v",
+		method, caller, traceId, utils.CalTimecost(t0), accessLogCode(err), err, recvCnt, sendCnt)
+}
+
+// render returns the payload as proto json, the redacted fields masked
+func (l *accessLogger) render(payload interface{}) (out string) {
+	if payload == nil {
+		return "null"
+	}
+	switch v := payload.(type) {
+	case protoV1.Message:
+		msg := protoV1.MessageV2(v)
+		if len(l.redact) > 0 {
+			msg = protoV2.Clone(msg)
+			l.redactMessage(msg.ProtoReflect())
+		}
+		data, err := accessLogMarshalOptions.Marshal(msg)
+		if err != nil {
+			out = fmt.Sprintf("%v", payload)
+		} else {
+			out = string(data)
+		}
+	default:
+		out = utils.MustString(payload)
+	}
+	return l.truncate(out)
+}
+
+func (l *accessLogger) truncate(out string) string {
+	if len(out) <= l.conf.MaxPayloadBytes {
+		return out
+	}
+	// back off to a rune boundary so that a multi-byte char is not split
+	n := l.conf.MaxPayloadBytes
+	for n > 0 && !utf8.RuneStart(out[n]) {
+		n--
+	}
+	return fmt.Sprintf("%s...(%v bytes truncated)", out[:n], len(out)-n)
+}
+
+func (l *accessLogger) redactMessage(msg protoreflect.Message) {
+	msg.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if l.redact[fd.Name()] {
+			redactField(msg, fd)
+			return true
+		}
+		switch {
+		case fd.IsList() && fd.Message() != nil:
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				l.redactMessage(list.Get(i).Message())
+			}
+		case fd.IsMap() && fd.MapValue().Message() != nil:
+			v.Map().Range(func(_ protoreflect.MapKey, mv protoreflect.Value) bool {
+				l.redactMessage(mv.Message())
+				return true
+			})
+		case !fd.IsList() && !fd.IsMap() && fd.Message() != nil:
+			l.redactMessage(v.Message())
+		}
+		return true
+	})
+}
+
+// redactField masks strings and bytes, other kinds are cleared
+func redactField(msg protoreflect.Message, fd protoreflect.FieldDescriptor) {
+	if fd.IsList() || fd.IsMap() {
+		msg.Clear(fd)
+		return
+	}
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		msg.Set(fd, protoreflect.ValueOfString(redactedValue))
+	case protoreflect.BytesKind:
+		msg.Set(fd, protoreflect.ValueOfBytes([]byte(redactedValue)))
+	default:
+		msg.Clear(fd)
+	}
+}
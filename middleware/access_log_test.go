@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xutils/lib-common/metrics"
+	"github.com/xutils/lib-common/xlog"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+)
+
+// captureWriter keeps the access log lines
+type captureWriter struct {
+	mtx   sync.Mutex
+	lines []string
+}
+
+func (w *captureWriter) Init() error { return nil }
+
+func (w *captureWriter) Write(r *xlog.Record) error {
+	if line := r.String(); strings.Contains(line, "_grpc_access") {
+		w.mtx.Lock()
+		w.lines = append(w.lines, line)
+		w.mtx.Unlock()
+	}
+	return nil
+}
+
+func (w *captureWriter) wait(n int) []string {
+	for i := 0; i < 100; i++ {
+		w.mtx.Lock()
+		lines := append([]string{}, w.lines...)
+		w.mtx.Unlock()
+		if len(lines) >= n {
+			return lines
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return nil
+}
+
+func TestAccessLog(t *testing.T) {
+	w := &captureWriter{}
+	xlog.Register(w)
+
+	interceptor := GrpcInterceptor(metrics.MetricsBase{}, OptAccessLog(AccessLogConfig{
+		RedactFields:    []string{"description"},
+		MaxPayloadBytes: 100,
+	}))
+	req := &errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{
+		{Field: "password", Description: "secret_value"},
+	}}
+	_, err := interceptor(context.Background(), req, &grpc.UnaryServerInfo{FullMethod: "/test.Svr/Login"},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return &errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{
+				{Field: strings.Repeat("x", 200)},
+			}}, nil
+		})
+	assert.Nil(t, err)
+
+	lines := w.wait(1)
+	assert.Equal(t, 1, len(lines))
+	line := lines[0]
+	assert.Contains(t, line, "method=Login")
+	assert.Contains(t, line, "code=OK")
+	assert.Contains(t, line, `"field":"password"`)
+	// redacted at any depth, the req itself is untouched
+	assert.NotContains(t, line, "secret_value")
+	assert.Contains(t, line, `"description":"***"`)
+	assert.Equal(t, "secret_value", req.FieldViolations[0].Description)
+	// truncated rsp
+	assert.Contains(t, line, "bytes truncated")
+}
+
+func TestAccessLogTruncateRune(t *testing.T) {
+	l := &accessLogger{conf: AccessLogConfig{MaxPayloadBytes: 4}}
+	assert.Equal(t, "ab", l.truncate("ab"))
+
+	// "中" is 3 bytes, the cut at 4 bytes falls inside the second one
+	out := l.truncate("中文字")
+	assert.True(t, utf8.ValidString(out))
+	assert.Equal(t, "中...(6 bytes truncated)", out)
+}
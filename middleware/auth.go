@@ -0,0 +1,236 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xutils/lib-common/clients"
+	"github.com/xutils/lib-common/local_context"
+	"github.com/xutils/lib-common/xlog"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/**
+####################################################################################
+AUTH
+HMAC caller tokens (see clients.HmacToken) and JWT bearer tokens read from the
+authorization md, which the gateway mux passes through from the Authorization
+header, then the ACL of the method is checked against the caller
+*/
+
+const (
+	ERR_UNAUTHENTICATED   = "unauthenticated"
+	ERR_PERMISSION_DENIED = "permission_denied"
+
+	AUTH_SCHEME_BEARER = "Bearer"
+
+	defaultHmacMaxSkewSec = 300
+	principalKey          = "_principal"
+)
+
+var (
+	errUnauthenticated  = status.Error(codes.Unauthenticated, "unauthenticated")
+	errPermissionDenied = status.Error(codes.PermissionDenied, "permission denied")
+
+	// reasons logged, the callers only get errUnauthenticated
+	errUnsupportedScheme = errors.New("unsupported scheme")
+	errMalformedToken    = errors.New("malformed token")
+	errUnknownCaller     = errors.New("unknown caller")
+	errTokenExpired      = errors.New("token expired")
+	errBadSignature      = errors.New("bad signature")
+	errCallerMismatch    = errors.New("caller mismatch")
+	errMissingCaller     = errors.New("missing caller claim")
+	errBadIssuer         = errors.New("bad issuer")
+	errBadAudience       = errors.New("bad audience")
+)
+
+type AuthConfig struct {
+	// secrets of the HMAC caller tokens by caller
+	HmacSecrets map[string]string `toml:"hmac_secrets"`
+	// max difference between the ts of an HMAC token and now, 300 when not set
+	HmacMaxSkewSec int `toml:"hmac_max_skew_sec"`
+	// JWKS of the keys the JWT bearer tokens are signed with, reloaded once changed
+	JwksFile string `toml:"jwks_file"`
+	// iss and aud the JWTs must have, not checked when empty
+	JwtIssuer   string `toml:"jwt_issuer"`
+	JwtAudience string `toml:"jwt_audience"`
+	// claim of the JWT holding the caller checked against the ACL, sub when not
+	// set, the HEADER_CALLER sent along must match it
+	JwtCallerClaim string `toml:"jwt_caller_claim"`
+	// callers allowed by short method name, "*" for any authenticated caller,
+	// the methods not listed are open to any authenticated caller
+	ACL map[string][]string `toml:"acl"`
+	// short method names served without credentials, e.g. health checks
+	SkipMethods []string `toml:"skip_methods"`
+}
+
+// Principal is the identity authenticated by OptAuth, see PrincipalFromContext
+type Principal struct {
+	// clients.AUTH_SCHEME_HMAC or AUTH_SCHEME_BEARER
+	Scheme string
+	// caller of the HMAC token or sub claim of the JWT
+	Subject string
+	// caller checked against the ACL, the one of the HMAC token or the
+	// JwtCallerClaim of the JWT
+	Caller string
+	// claims of the JWT
+	Claims map[string]interface{}
+}
+
+// PrincipalFromContext returns the principal of the rpc ctx belongs to
+func PrincipalFromContext(ctx context.Context) (p *Principal, ok bool) {
+	lctx, ok := local_context.FromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	p, ok = lctx.Get(principalKey).(*Principal)
+	return
+}
+
+// OptAuth rejects the rpcs without valid credentials with codes.Unauthenticated
+// and the ones denied by the ACL with codes.PermissionDenied, they are counted
+// with the err ERR_UNAUTHENTICATED or ERR_PERMISSION_DENIED
+func OptAuth(conf AuthConfig) GrpcInterceptorOpt {
+	a := newAuthenticator(conf)
+	return func(opts *grpcInterceptorOptions) {
+		opts.authenticator = a
+		xlog.Info("auth registered||hmac_callers=%v||jwks_file=%v||acl=%v", len(conf.HmacSecrets), conf.JwksFile, conf.ACL)
+	}
+}
+
+type authenticator struct {
+	conf AuthConfig
+	jwks *jwks
+	acl  map[string]map[string]bool
+	skip map[string]bool
+	now  func() time.Time
+}
+
+func newAuthenticator(conf AuthConfig) *authenticator {
+	if conf.HmacMaxSkewSec <= 0 {
+		conf.HmacMaxSkewSec = defaultHmacMaxSkewSec
+	}
+	if conf.JwtCallerClaim == "" {
+		conf.JwtCallerClaim = "sub"
+	}
+	a := &authenticator{
+		conf: conf,
+		acl:  map[string]map[string]bool{},
+		skip: map[string]bool{},
+		now:  time.Now,
+	}
+	if conf.JwksFile != "" {
+		a.jwks = newJwks(conf.JwksFile)
+	}
+	for method, callers := range conf.ACL {
+		a.acl[method] = map[string]bool{}
+		for _, caller := range callers {
+			a.acl[method][caller] = true
+		}
+	}
+	for _, method := range conf.SkipMethods {
+		a.skip[method] = true
+	}
+	return a
+}
+
+// authenticate returns the principal of the rpc, nil for the skipped methods
+func (a *authenticator) authenticate(ctx context.Context, method, caller string) (p *Principal, err error) {
+	if a.skip[method] {
+		return nil, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	vals := md.Get(clients.HEADER_AUTHORIZATION)
+	if len(vals) == 0 {
+		xlog.Warn("_grpc_auth||method=%v||caller=%v||no credentials", method, caller)
+		return nil, errUnauthenticated
+	}
+	scheme, cred := vals[0], ""
+	if idx := strings.IndexByte(vals[0], ' '); idx > 0 {
+		scheme, cred = vals[0][:idx], strings.TrimSpace(vals[0][idx+1:])
+	}
+
+	var _err error
+	switch {
+	case strings.EqualFold(scheme, clients.AUTH_SCHEME_HMAC):
+		p, _err = a.verifyHmac(cred, caller)
+	case strings.EqualFold(scheme, AUTH_SCHEME_BEARER) && a.jwks != nil:
+		p, _err = a.verifyBearer(cred, caller)
+	default:
+		_err = errUnsupportedScheme
+	}
+	if _err != nil {
+		xlog.Warn("_grpc_auth||method=%v||caller=%v||scheme=%v||err=%v", method, caller, scheme, _err)
+		return nil, errUnauthenticated
+	}
+
+	if allowed, ok := a.acl[method]; ok && !allowed["*"] && !allowed[p.Caller] {
+		xlog.Warn("_grpc_auth||method=%v||caller=%v||subject=%v||denied by acl", method, p.Caller, p.Subject)
+		return nil, errPermissionDenied
+	}
+	return p, nil
+}
+
+func (a *authenticator) verifyHmac(cred, caller string) (*Principal, error) {
+	parts := strings.Split(cred, ":")
+	if len(parts) != 3 {
+		return nil, errMalformedToken
+	}
+	tokenCaller, sig := parts[0], parts[2]
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, errMalformedToken
+	}
+	secret, ok := a.conf.HmacSecrets[tokenCaller]
+	if !ok {
+		return nil, errUnknownCaller
+	}
+	if skew := a.now().Unix() - ts; skew > int64(a.conf.HmacMaxSkewSec) || -skew > int64(a.conf.HmacMaxSkewSec) {
+		return nil, errTokenExpired
+	}
+	if !hmac.Equal([]byte(sig), []byte(clients.HmacSignature(tokenCaller, ts, secret))) {
+		return nil, errBadSignature
+	}
+	if caller != "" && caller != tokenCaller {
+		return nil, errCallerMismatch
+	}
+	return &Principal{
+		Scheme:  clients.AUTH_SCHEME_HMAC,
+		Subject: tokenCaller,
+		Caller:  tokenCaller,
+	}, nil
+}
+
+func (a *authenticator) verifyBearer(cred, caller string) (*Principal, error) {
+	claims, err := verifyJwt(cred, a.jwks, a.now())
+	if err != nil {
+		return nil, err
+	}
+	if a.conf.JwtIssuer != "" && claims.issuer() != a.conf.JwtIssuer {
+		return nil, errBadIssuer
+	}
+	if a.conf.JwtAudience != "" && !claims.hasAudience(a.conf.JwtAudience) {
+		return nil, errBadAudience
+	}
+	// the caller header is up to the client, only the signed claim is trusted
+	tokenCaller := claims.str(a.conf.JwtCallerClaim)
+	if tokenCaller == "" {
+		return nil, errMissingCaller
+	}
+	if caller != "" && caller != tokenCaller {
+		return nil, errCallerMismatch
+	}
+	return &Principal{
+		Scheme:  AUTH_SCHEME_BEARER,
+		Subject: claims.subject(),
+		Caller:  tokenCaller,
+		Claims:  claims,
+	}, nil
+}
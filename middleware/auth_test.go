@@ -0,0 +1,234 @@
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	stdjson "encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xutils/lib-common/clients"
+	"github.com/xutils/lib-common/metrics"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func authCtx(caller, authorization string) context.Context {
+	md := metadata.New(map[string]string{clients.HEADER_AUTHORIZATION: authorization})
+	if caller != "" {
+		md.Set(clients.HEADER_CALLER, caller)
+	}
+	return metadata.NewIncomingContext(context.Background(), md)
+}
+
+func hmacCtx(t *testing.T, caller, secret string) context.Context {
+	md, err := clients.NewHmacCredentials(caller, secret).GetRequestMetadata(context.Background())
+	assert.Nil(t, err)
+	return authCtx(caller, md[clients.HEADER_AUTHORIZATION])
+}
+
+func mustJson(t *testing.T, v interface{}) []byte {
+	data, err := stdjson.Marshal(v)
+	assert.Nil(t, err)
+	return data
+}
+
+func signJwt(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString(mustJson(t, map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"}))
+	payload := enc.EncodeToString(mustJson(t, claims))
+	digest := sha256.Sum256([]byte(header + "." + payload))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	assert.Nil(t, err)
+	return header + "." + payload + "." + enc.EncodeToString(sig)
+}
+
+func writeJwks(t *testing.T, dir string, key *rsa.PrivateKey, kid string) string {
+	enc := base64.RawURLEncoding
+	path := filepath.Join(dir, "jwks.json")
+	data := mustJson(t, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": kid,
+			"use": "sig",
+			"n":   enc.EncodeToString(key.N.Bytes()),
+			"e":   enc.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+	assert.Nil(t, ioutil.WriteFile(path, data, 0600))
+	return path
+}
+
+func TestAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	m := &metrics.MetricsBase{}
+	InitRpcMetrics(m, "unitTestAuth")
+	interceptor := GrpcInterceptor(*m, OptAuth(AuthConfig{
+		HmacSecrets: map[string]string{"svr_a": "secret_a", "svr_b": "secret_b"},
+		JwksFile:    writeJwks(t, dir, key, "k1"),
+		JwtIssuer:   "test_issuer",
+		ACL:         map[string][]string{"Admin": {"svr_a"}},
+		SkipMethods: []string{"Health"},
+	}))
+	var principal *Principal
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		principal, _ = PrincipalFromContext(ctx)
+		return "rsp", nil
+	}
+	call := func(ctx context.Context, method string) error {
+		principal = nil
+		_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/test.Svr/" + method}, handler)
+		return err
+	}
+
+	// hmac
+	assert.Nil(t, call(hmacCtx(t, "svr_a", "secret_a"), "Admin"))
+	assert.Equal(t, "svr_a", principal.Caller)
+	assert.Equal(t, clients.AUTH_SCHEME_HMAC, principal.Scheme)
+	assert.Equal(t, codes.PermissionDenied, status.Code(call(hmacCtx(t, "svr_b", "secret_b"), "Admin")))
+	assert.Nil(t, call(hmacCtx(t, "svr_b", "secret_b"), "Other"))
+	assert.Equal(t, codes.Unauthenticated, status.Code(call(hmacCtx(t, "svr_b", "wrong"), "Other")))
+	old := clients.HmacToken("svr_a", "secret_a", time.Now().Add(-time.Hour))
+	assert.Equal(t, codes.Unauthenticated, status.Code(call(authCtx("svr_a", old), "Other")))
+	// the caller header must match the token
+	token := clients.HmacToken("svr_b", "secret_b", time.Now())
+	assert.Equal(t, codes.Unauthenticated, status.Code(call(authCtx("svr_a", token), "Admin")))
+
+	// jwt, the caller is the sub claim
+	claims := map[string]interface{}{"sub": "svr_a", "iss": "test_issuer", "exp": time.Now().Add(time.Hour).Unix()}
+	assert.Nil(t, call(authCtx("svr_a", "Bearer "+signJwt(t, key, "k1", claims)), "Admin"))
+	assert.Equal(t, "svr_a", principal.Subject)
+	assert.Equal(t, "svr_a", principal.Caller)
+	assert.Equal(t, "test_issuer", principal.Claims["iss"])
+	assert.Nil(t, call(authCtx("", "Bearer "+signJwt(t, key, "k1", claims)), "Admin"))
+	assert.Equal(t, "svr_a", principal.Caller)
+	// the caller header cannot get another caller past the acl
+	claims["sub"] = "user_1"
+	assert.Equal(t, codes.Unauthenticated, status.Code(call(authCtx("svr_a", "Bearer "+signJwt(t, key, "k1", claims)), "Admin")))
+	assert.Equal(t, codes.PermissionDenied, status.Code(call(authCtx("", "Bearer "+signJwt(t, key, "k1", claims)), "Admin")))
+	assert.Nil(t, call(authCtx("", "Bearer "+signJwt(t, key, "k1", claims)), "Other"))
+	assert.Equal(t, "user_1", principal.Caller)
+	// exp is required
+	delete(claims, "exp")
+	assert.Equal(t, codes.Unauthenticated, status.Code(call(authCtx("", "Bearer "+signJwt(t, key, "k1", claims)), "Other")))
+	claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	assert.Equal(t, codes.Unauthenticated, status.Code(call(authCtx("", "Bearer "+signJwt(t, key, "k1", claims)), "Other")))
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	claims["exp"] = time.Now().Add(time.Hour).Unix()
+	assert.Equal(t, codes.Unauthenticated, status.Code(call(authCtx("", "Bearer "+signJwt(t, other, "k1", claims)), "Other")))
+
+	// no credentials
+	assert.Equal(t, codes.Unauthenticated, status.Code(call(context.Background(), "Other")))
+	assert.Nil(t, call(context.Background(), "Health"))
+	assert.Nil(t, principal)
+	assert.Equal(t, float64(1), testutil.ToFloat64(
+		m.GetTimeoutMetricsCounter().WithLabelValues("Admin", ERR_PERMISSION_DENIED, "svr_b")))
+
+	// through the gateway mux, the Authorization header is passed as md
+	req, err := http.NewRequest(http.MethodPost, "/v1/admin", nil)
+	assert.Nil(t, err)
+	req.Header.Set("Authorization", clients.HmacToken("svr_a", "secret_a", time.Now()))
+	req.Header.Set("Grpc-Caller", "svr_a")
+	mux := runtime.NewServeMux(TracedIncomingHeaderMatcherMuxOption())
+	ctx, err := runtime.AnnotateIncomingContext(context.Background(), mux, req)
+	assert.Nil(t, err)
+	assert.Nil(t, call(ctx, "Admin"))
+	assert.Equal(t, "svr_a", principal.Caller)
+}
+
+func TestAuthJwtCallerClaim(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	a := newAuthenticator(AuthConfig{
+		JwksFile:       writeJwks(t, dir, key, "k1"),
+		JwtCallerClaim: "azp",
+	})
+	claims := map[string]interface{}{"sub": "user_1", "azp": "svr_a", "exp": time.Now().Add(time.Hour).Unix()}
+	p, err := a.verifyBearer(signJwt(t, key, "k1", claims), "")
+	assert.Nil(t, err)
+	assert.Equal(t, "svr_a", p.Caller)
+	assert.Equal(t, "user_1", p.Subject)
+	_, err = a.verifyBearer(signJwt(t, key, "k1", claims), "user_1")
+	assert.Equal(t, errCallerMismatch, err)
+	delete(claims, "azp")
+	_, err = a.verifyBearer(signJwt(t, key, "k1", claims), "")
+	assert.Equal(t, errMissingCaller, err)
+}
+
+func signJwtES(t *testing.T, key *ecdsa.PrivateKey, alg, kid string, hash crypto.Hash, claims map[string]interface{}) string {
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString(mustJson(t, map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}))
+	payload := enc.EncodeToString(mustJson(t, claims))
+	h := hash.New()
+	h.Write([]byte(header + "." + payload))
+	r, s, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+	assert.Nil(t, err)
+	size := (key.Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	r.FillBytes(sig[:size])
+	s.FillBytes(sig[size:])
+	return header + "." + payload + "." + enc.EncodeToString(sig)
+}
+
+func TestVerifyJwtES(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.Nil(t, err)
+	enc := base64.RawURLEncoding
+	ecJwk := func(kid, crv string, key *ecdsa.PrivateKey) map[string]string {
+		return map[string]string{
+			"kty": "EC",
+			"kid": kid,
+			"crv": crv,
+			"x":   enc.EncodeToString(key.X.Bytes()),
+			"y":   enc.EncodeToString(key.Y.Bytes()),
+		}
+	}
+	path := filepath.Join(dir, "jwks.json")
+	assert.Nil(t, ioutil.WriteFile(path, mustJson(t, map[string]interface{}{
+		"keys": []map[string]string{ecJwk("p256", "P-256", p256), ecJwk("p384", "P-384", p384)},
+	}), 0600))
+	keys := newJwks(path)
+	claims := map[string]interface{}{"sub": "svr_a", "exp": time.Now().Add(time.Hour).Unix()}
+
+	_, err = verifyJwt(signJwtES(t, p256, "ES256", "p256", crypto.SHA256, claims), keys, time.Now())
+	assert.Nil(t, err)
+	_, err = verifyJwt(signJwtES(t, p384, "ES384", "p384", crypto.SHA384, claims), keys, time.Now())
+	assert.Nil(t, err)
+	// the alg must match the curve of the key
+	_, err = verifyJwt(signJwtES(t, p384, "ES256", "p384", crypto.SHA256, claims), keys, time.Now())
+	assert.Equal(t, errUnsupportedAlg, err)
+	_, err = verifyJwt(signJwtES(t, p256, "ES512", "p256", crypto.SHA512, claims), keys, time.Now())
+	assert.Equal(t, errUnsupportedAlg, err)
+}
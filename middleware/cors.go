@@ -0,0 +1,210 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/xutils/lib-common/clients"
+	"github.com/xutils/lib-common/xlog"
+)
+
+/**
+####################################################################################
+CORS
+the CORS policy of NewHttpWrapper, the preflight requests are answered by the
+wrapper and never reach the gateway mux
+*/
+
+type CORSConfig struct {
+	// origins allowed, "*" for any, or with wildcards, e.g. https://*.example.com
+	AllowedOrigins []string `toml:"allowed_origins"`
+	// GET, HEAD, POST, PUT and DELETE when empty
+	AllowedMethods []string `toml:"allowed_methods"`
+	// request headers allowed, "*" for any, the ones of DefaultCORSConfig when empty
+	AllowedHeaders []string `toml:"allowed_headers"`
+	// response headers readable by the scripts, e.g. grpc-trace-id
+	ExposedHeaders []string `toml:"exposed_headers"`
+	// allows cookies and the Authorization header, for the origins listed only,
+	// never for the ones allowed by "*"
+	AllowCredentials bool `toml:"allow_credentials"`
+	// how long the preflight responses are cached, not sent when 0
+	MaxAgeSec int `toml:"max_age_sec"`
+}
+
+// DefaultCORSConfig is the policy of DefaultHttpWrapper, any origin allowed
+var DefaultCORSConfig = CORSConfig{
+	AllowedOrigins: []string{"*"},
+	AllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "DELETE"},
+	AllowedHeaders: []string{
+		"Content-Type",
+		"Accept",
+		"Authorization",
+		clients.HEADER_CALLER,
+		clients.HEADER_TRACE,
+		clients.HEADER_TRACEPARENT,
+	},
+}
+
+// OptCORS sets the CORS policy of NewHttpWrapper, no CORS headers are sent
+// without it
+func OptCORS(conf CORSConfig) HttpInterceptorOpt {
+	c := newCors(conf)
+	return func(opts *httpInterceptorOptions) {
+		opts.cors = c
+		xlog.Info("cors registered||allowed_origins=%v||allow_credentials=%v", conf.AllowedOrigins, conf.AllowCredentials)
+	}
+}
+
+type cors struct {
+	conf           CORSConfig
+	origins        []string
+	anyOrigin      bool
+	methods        map[string]bool
+	headers        map[string]bool
+	anyHeader      bool
+	allowedMethods string
+	allowedHeaders string
+	exposedHeaders string
+}
+
+func newCors(conf CORSConfig) *cors {
+	if len(conf.AllowedMethods) == 0 {
+		conf.AllowedMethods = DefaultCORSConfig.AllowedMethods
+	}
+	if len(conf.AllowedHeaders) == 0 {
+		conf.AllowedHeaders = DefaultCORSConfig.AllowedHeaders
+	}
+	c := &cors{
+		conf:           conf,
+		methods:        map[string]bool{},
+		headers:        map[string]bool{},
+		exposedHeaders: strings.Join(conf.ExposedHeaders, ","),
+	}
+	for _, origin := range conf.AllowedOrigins {
+		if origin == "*" {
+			c.anyOrigin = true
+		}
+		c.origins = append(c.origins, strings.ToLower(origin))
+	}
+	methods := []string{}
+	for _, method := range conf.AllowedMethods {
+		method = strings.ToUpper(method)
+		c.methods[method] = true
+		methods = append(methods, method)
+	}
+	c.allowedMethods = strings.Join(methods, ",")
+	for _, header := range conf.AllowedHeaders {
+		if header == "*" {
+			c.anyHeader = true
+		}
+		c.headers[http.CanonicalHeaderKey(header)] = true
+	}
+	c.allowedHeaders = strings.Join(conf.AllowedHeaders, ",")
+	if c.anyOrigin && conf.AllowCredentials {
+		xlog.Warn("_http_cors||allow_credentials along \"*\"||credentials only allowed to the origins listed")
+	}
+	return c
+}
+
+// matchWildcard tells if s matches pattern, where * matches any substring
+func matchWildcard(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		idx := strings.Index(s, part)
+		if idx < 0 {
+			return false
+		}
+		s = s[idx+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+func (c *cors) originAllowed(origin string) bool {
+	return c.anyOrigin || c.originListed(origin)
+}
+
+// originListed tells if origin matches one of the origins allowed other than "*"
+func (c *cors) originListed(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, pattern := range c.origins {
+		if pattern != "*" && matchWildcard(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// headersAllowed tells if all the headers of Access-Control-Request-Headers are allowed
+func (c *cors) headersAllowed(requested string) bool {
+	if c.anyHeader {
+		return true
+	}
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header != "" && !c.headers[http.CanonicalHeaderKey(header)] {
+			return false
+		}
+	}
+	return true
+}
+
+// handle sets the CORS headers of r, and answers it when a preflight request,
+// in which case true is returned
+func (c *cors) handle(w http.ResponseWriter, r *http.Request) (done bool) {
+	origin := r.Header.Get("Origin")
+	reqMethod := r.Header.Get("Access-Control-Request-Method")
+	preflight := r.Method == http.MethodOptions && reqMethod != ""
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	if origin == "" {
+		return false
+	}
+	if preflight {
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+		reqHeaders := r.Header.Get("Access-Control-Request-Headers")
+		if !c.originAllowed(origin) || !c.methods[strings.ToUpper(reqMethod)] || !c.headersAllowed(reqHeaders) {
+			xlog.Info("_http_cors||preflight denied||origin=%v||method=%v||headers=%v", origin, reqMethod, reqHeaders)
+			w.WriteHeader(http.StatusForbidden)
+			return true
+		}
+		c.allowOrigin(header, origin)
+		header.Set("Access-Control-Allow-Methods", c.allowedMethods)
+		if c.anyHeader && reqHeaders != "" {
+			header.Set("Access-Control-Allow-Headers", reqHeaders)
+		} else {
+			header.Set("Access-Control-Allow-Headers", c.allowedHeaders)
+		}
+		if c.conf.MaxAgeSec > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(c.conf.MaxAgeSec))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	if !c.originAllowed(origin) {
+		return false
+	}
+	c.allowOrigin(header, origin)
+	if c.exposedHeaders != "" {
+		header.Set("Access-Control-Expose-Headers", c.exposedHeaders)
+	}
+	return false
+}
+
+// allowOrigin allows origin itself rather than *, which browsers refuse along
+// credentials. an origin only allowed by "*" never gets credentials, any site
+// could act on behalf of the user otherwise
+func (c *cors) allowOrigin(header http.Header, origin string) {
+	header.Set("Access-Control-Allow-Origin", origin)
+	if c.conf.AllowCredentials && c.originListed(origin) {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
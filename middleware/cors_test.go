@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORS(t *testing.T) {
+	reached := 0
+	mux := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached++
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := NewHttpWrapper(OptCORS(CORSConfig{
+		AllowedOrigins:   []string{"https://app.example.com", "https://*.example.org"},
+		AllowedMethods:   []string{"get", "POST"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		ExposedHeaders:   []string{"Grpc-Trace-Id"},
+		AllowCredentials: true,
+		MaxAgeSec:        600,
+	}))(mux)
+	serve := func(method, origin string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/v1/orders", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	preflight := func(origin, method, headers string) *httptest.ResponseRecorder {
+		return serve(http.MethodOptions, origin, map[string]string{
+			"Access-Control-Request-Method":  method,
+			"Access-Control-Request-Headers": headers,
+		})
+	}
+
+	// preflight, answered by the wrapper
+	w := preflight("https://app.example.com", "POST", "content-type, authorization")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "GET,POST", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Content-Type,Authorization", w.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"))
+	assert.Contains(t, w.Header().Values("Vary"), "Origin")
+	w = preflight("https://a.b.example.org", "GET", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://a.b.example.org", w.Header().Get("Access-Control-Allow-Origin"))
+	for _, denied := range []*httptest.ResponseRecorder{
+		preflight("https://evil.com", "POST", ""),
+		preflight("https://example.org", "POST", ""),
+		preflight("https://app.example.com", "DELETE", ""),
+		preflight("https://app.example.com", "POST", "X-Custom"),
+	} {
+		assert.Equal(t, http.StatusForbidden, denied.Code)
+		assert.Equal(t, "", denied.Header().Get("Access-Control-Allow-Origin"))
+	}
+	assert.Equal(t, 0, reached)
+
+	// actual requests reach the mux, with the headers for the allowed origins only
+	w = serve(http.MethodPost, "https://app.example.com", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Grpc-Trace-Id", w.Header().Get("Access-Control-Expose-Headers"))
+	w = serve(http.MethodPost, "https://evil.com", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", w.Header().Get("Access-Control-Allow-Origin"))
+	// a plain OPTIONS is not a preflight
+	serve(http.MethodOptions, "https://app.example.com", nil)
+	assert.Equal(t, 3, reached)
+
+	// any origin, and no CORS without OptCORS
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodOptions, "/v1/orders", nil)
+	r.Header.Set("Origin", "https://any.com")
+	r.Header.Set("Access-Control-Request-Method", "PUT")
+	DefaultHttpWrapper(mux).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://any.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "", w.Header().Get("Access-Control-Allow-Credentials"))
+	w = httptest.NewRecorder()
+	NewHttpWrapper()(mux).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORSAnyOriginCredentials(t *testing.T) {
+	mux := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := NewHttpWrapper(OptCORS(CORSConfig{
+		AllowedOrigins:   []string{"*", "https://app.example.com"},
+		AllowCredentials: true,
+	}))(mux)
+	serve := func(method, origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/v1/orders", nil)
+		r.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			r.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// allowed by "*", without credentials
+	for _, method := range []string{http.MethodOptions, http.MethodPost} {
+		w := serve(method, "https://evil.com")
+		assert.Equal(t, "https://evil.com", w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "", w.Header().Get("Access-Control-Allow-Credentials"))
+	}
+	// the listed origin keeps them
+	w := serve(http.MethodPost, "https://app.example.com")
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+}
@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xutils/lib-common/errors"
+	"github.com/xutils/lib-common/metrics"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var codeOrderNotFound = errors.Register(20404, codes.NotFound, "ORDER_NOT_FOUND")
+
+func TestBusinessError(t *testing.T) {
+	m := &metrics.MetricsBase{}
+	InitRpcMetrics(m, "unitTestBusinessError")
+	interceptor := GrpcInterceptor(*m,
+		OptEnsureError(func(req reflect.Type) ErrorIface {
+			return &validatedError{}
+		}))
+	info := &grpc.UnaryServerInfo{Server: &validatedServer{}, FullMethod: "/test.Svr/Create"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, fmt.Errorf("create: %w", errors.New(codeOrderNotFound, "no such order"))
+	}
+
+	// the Error of the rsp carries the business code
+	rsp, err := interceptor(context.Background(), &validatedReq{Name: "a"}, info, handler)
+	assert.Nil(t, err)
+	assert.Equal(t, &validatedRsp{Error: &validatedError{
+		Code:    int64(codeOrderNotFound),
+		Message: "create: no such order",
+	}}, rsp)
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.GetTimeoutMetricsCounter().WithLabelValues("Create", "20404", "")))
+
+	// without OptEnsureError grpc gets the mapped code, the business code is
+	// kept in the details
+	m2 := &metrics.MetricsBase{}
+	InitRpcMetrics(m2, "unitTestBusinessErrorGrpc")
+	rsp, err = GrpcInterceptor(*m2)(context.Background(), &validatedReq{Name: "a"}, info, handler)
+	assert.Nil(t, rsp)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Equal(t, codeOrderNotFound, errors.FromError(status.Convert(err).Err()).Code)
+	assert.Equal(t, float64(1), testutil.ToFloat64(m2.GetTimeoutMetricsCounter().WithLabelValues("Create", "20404", "")))
+
+	// the gateway body has the business code, decoded back as the same err
+	marshaler := &StandardResponsMarshaler{Marshaler: &runtime.JSONBuiltin{}}
+	data, _err := marshaler.Marshal(status.Convert(err).Proto())
+	assert.Nil(t, _err)
+	assert.JSONEq(t, `{"code":20404,"message":"create: no such order"}`, string(data))
+	decoded := marshaler.Unmarshal(data, &validatedReq{})
+	assert.True(t, errors.Is(decoded, errors.New(codeOrderNotFound, "")))
+	assert.Equal(t, codes.NotFound, status.Code(decoded))
+}
+
+var codeQuotaExceeded = errors.Register(20429, codes.ResourceExhausted, "QUOTA_EXCEEDED")
+
+func TestHttpErrorHandler(t *testing.T) {
+	opts := []HttpInterceptorOpt{
+		OptHttpStatus(map[errors.Code]int{
+			codeQuotaExceeded:          http.StatusPaymentRequired,
+			errors.Code(codes.Unknown): http.StatusBadGateway,
+		}),
+	}
+	mux := runtime.NewServeMux(HttpMarshalerServerMuxOption(opts...), HttpErrorHandlerServerMuxOption(opts...))
+	marshaler := HttpMarshaler(opts...)
+	handler := HttpErrorHandler(opts...)
+	reply := func(err error) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/v1/orders/1", nil)
+		handler(context.Background(), mux, marshaler, w, r, err)
+		return w
+	}
+
+	// registered business code, the status of its grpc code
+	w := reply(fmt.Errorf("get: %w", errors.New(codeOrderNotFound, "no such order")))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.JSONEq(t, `{"code":20404,"message":"get: no such order"}`, w.Body.String())
+
+	// overrides
+	w = reply(errors.New(codeQuotaExceeded, "quota exceeded"))
+	assert.Equal(t, http.StatusPaymentRequired, w.Code)
+	assert.JSONEq(t, `{"code":20429,"message":"quota exceeded"}`, w.Body.String())
+	w = reply(fmt.Errorf("boom"))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+
+	// grpc codes
+	w = reply(status.Error(codes.InvalidArgument, "bad id"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"code":3,"message":"bad id"}`, w.Body.String())
+	w = reply(status.Error(codes.Unauthenticated, "unauthenticated"))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// business codes not registered
+	w = reply(errors.New(10001, "unknown business"))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"code":10001,"message":"unknown business"}`, w.Body.String())
+}
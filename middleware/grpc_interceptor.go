@@ -12,6 +12,8 @@ import (
 	"github.com/xutils/lib-common/utils"
 
 	"github.com/xutils/lib-common/clients"
+	"github.com/xutils/lib-common/errors"
+	"github.com/xutils/lib-common/health"
 	"google.golang.org/grpc/metadata"
 
 	"github.com/xutils/lib-common/xlog"
@@ -20,8 +22,11 @@ import (
 
 	"github.com/xutils/lib-common/local_context"
 	"github.com/xutils/lib-common/metrics"
+	"github.com/xutils/lib-common/validate"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 )
 
 func DefaultGrpcOptions() (opts []grpc.ServerOption) {
@@ -31,6 +36,21 @@ func DefaultGrpcOptions() (opts []grpc.ServerOption) {
 	return
 }
 
+// DefaultGrpcOptionsWithTLS is DefaultGrpcOptions serving tls, or mtls with
+// RequireClientCert, as configured by conf
+func DefaultGrpcOptionsWithTLS(conf clients.TLSConfig) (opts []grpc.ServerOption, err error) {
+	opts = DefaultGrpcOptions()
+	if !conf.Enable {
+		return
+	}
+	creds, err := clients.NewServerTLSCredentials(conf)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, grpc.Creds(creds))
+	return
+}
+
 func InitRpcMetrics(metrics *metrics.MetricsBase, prefix string) {
 	metrics.CreateMetrics(fmt.Sprintf("%v_rpc", prefix), nil, []string{"method"})
 	metrics.CreateMetricsCountVec(prefix, "rpc", "cnt", []string{"method", "err", "caller"})
@@ -103,22 +123,136 @@ func setTraceId(trace interface{}, traceId string) {
 
 }
 
-type GrpcInterceptorOpt interface{}
+// errorRsp returns a rsp of the method of info.Server with its Error set to
+// the code and message of err, see errors.FromError, it is returned in place
+// of err. nil when the rsp type is unknown or has no Error matching the one of
+// ensureErrorFunc
+func errorRsp(
+	ensureErrorFunc func(req reflect.Type) ErrorIface,
+	info *grpc.UnaryServerInfo,
+	method string,
+	err error) interface{} {
+	if ensureErrorFunc == nil || info.Server == nil {
+		return nil
+	}
+	handler := reflect.ValueOf(info.Server).MethodByName(method)
+	if !handler.IsValid() || handler.Type().NumOut() != 2 {
+		return nil
+	}
+	rspType := handler.Type().Out(0)
+	if rspType.Kind() != reflect.Ptr || rspType.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	rsp := reflect.New(rspType.Elem())
+	refErr := rsp.Elem().FieldByName(fieldError)
+	if !refErr.IsValid() || refErr.Type().Kind() != reflect.Ptr {
+		return nil
+	}
+	newError := ensureErrorFunc(refErr.Type())
+	if newError == nil || reflect.TypeOf(newError) != refErr.Type() {
+		return nil
+	}
+	e := errors.FromError(err)
+	setErrorFields(newError, int64(e.Code), e.Message)
+	refErr.Set(reflect.ValueOf(newError))
+	return rsp.Interface()
+}
 
-type optEnsureTrace func(req reflect.Type) TraceIface
+func setErrorFields(e interface{}, code int64, message string) {
+	val := reflect.ValueOf(e).Elem()
+	if codeVal := val.FieldByName("Code"); codeVal.IsValid() {
+		switch codeVal.Kind() {
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			codeVal.SetInt(code)
+		}
+	}
+	if msgVal := val.FieldByName("Message"); msgVal.IsValid() && msgVal.Kind() == reflect.String {
+		msgVal.SetString(message)
+	}
+}
 
-func OptEnsureTrace(defaultTrace func(req reflect.Type) TraceIface) GrpcInterceptorOpt {
-	return GrpcInterceptorOpt(optEnsureTrace(defaultTrace))
+type grpcInterceptorOptions struct {
+	ensureTrace   func(req reflect.Type) TraceIface
+	ensureError   func(req reflect.Type) ErrorIface
+	chain         []grpc.UnaryServerInterceptor
+	streamChain   []grpc.StreamServerInterceptor
+	limiter       *limiter
+	accessLogger  *accessLogger
+	timeouts      *TimeoutConfig
+	validate      bool
+	authenticator *authenticator
 }
 
-type optEnsureError func(req reflect.Type) ErrorIface
+// GrpcInterceptorOpt configures GrpcInterceptor and GrpcStreamInterceptor.
+//
+// the interceptors run in this order, each one wrapping the next:
+//  1. the OptAccessLog access log
+//  2. metrics, observing the final err including the recovered panics
+//  3. panic recovery
+//  4. trace and caller parsing, the LocalContext is created here
+//  5. the OptAuth authentication and ACL, skipped by the grpc.health.v1 rpcs
+//  6. the OptLimit limits, skipped by the grpc.health.v1 rpcs
+//  7. the OptValidate validation of the request
+//  8. the OptChain interceptors in the order given, with the LocalContext as ctx
+//  9. the handler
+type GrpcInterceptorOpt func(opts *grpcInterceptorOptions)
+
+func newGrpcInterceptorOptions(opts ...GrpcInterceptorOpt) *grpcInterceptorOptions {
+	options := &grpcInterceptorOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+func OptEnsureTrace(defaultTrace func(req reflect.Type) TraceIface) GrpcInterceptorOpt {
+	return func(opts *grpcInterceptorOptions) {
+		opts.ensureTrace = defaultTrace
+		xlog.Info("ensureTraceFunc registered")
+	}
+}
 
 func OptEnsureError(defaultError func(req reflect.Type) ErrorIface) GrpcInterceptorOpt {
-	return GrpcInterceptorOpt(optEnsureError(defaultError))
+	return func(opts *grpcInterceptorOptions) {
+		opts.ensureError = defaultError
+		xlog.Info("ensureErrorFunc registered")
+	}
+}
+
+// OptChain appends unary interceptors run after the trace parsing, the first
+// one is the outermost, several OptChain add up in the order given
+func OptChain(interceptors ...grpc.UnaryServerInterceptor) GrpcInterceptorOpt {
+	return func(opts *grpcInterceptorOptions) {
+		opts.chain = append(opts.chain, interceptors...)
+		xlog.Info("inner interceptors registered||cnt=%v", len(interceptors))
+	}
 }
 
+// OptStreamChain is OptChain for GrpcStreamInterceptor
+func OptStreamChain(interceptors ...grpc.StreamServerInterceptor) GrpcInterceptorOpt {
+	return func(opts *grpcInterceptorOptions) {
+		opts.streamChain = append(opts.streamChain, interceptors...)
+		xlog.Info("inner stream interceptors registered||cnt=%v", len(interceptors))
+	}
+}
+
+// Deprecated: use OptChain
 func OptInnerInterceptor(innerInterceptor grpc.UnaryServerInterceptor) GrpcInterceptorOpt {
-	return GrpcInterceptorOpt(innerInterceptor)
+	return OptChain(innerInterceptor)
+}
+
+// chainUnaryHandler wraps handler with interceptors, interceptors[0] outermost
+func chainUnaryHandler(
+	interceptors []grpc.UnaryServerInterceptor,
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) grpc.UnaryHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, req interface{}) (interface{}, error) {
+			return interceptor(ctx, req, info, next)
+		}
+	}
+	return handler
 }
 
 const (
@@ -126,38 +260,77 @@ const (
 	fieldError = "Error"
 )
 
+const ERR_DEADLINE_EXCEEDED = "deadline_exceeded"
+
+// errTypeOf returns the err type counted for rejections, deadline exceeded
+// rpcs and business errs, "" for the other errs
+func errTypeOf(err error) string {
+	switch err {
+	case errRateLimited:
+		return ERR_RATE_LIMITED
+	case errConcurrencyLimited:
+		return ERR_CONCURRENCY_LIMITED
+	case errUnauthenticated:
+		return ERR_UNAUTHENTICATED
+	case errPermissionDenied:
+		return ERR_PERMISSION_DENIED
+	}
+	if err == context.DeadlineExceeded || status.Code(err) == codes.DeadlineExceeded {
+		return ERR_DEADLINE_EXCEEDED
+	}
+	// the code of business errs, as the one of the Error of the rsp
+	if code := errors.CodeOf(err); !code.IsGRPC() {
+		return strconv.Itoa(int(code))
+	}
+	return ""
+}
+
 func GrpcInterceptor(
 	metrics metrics.MetricsBase,
 	opts ...GrpcInterceptorOpt) (interceptor grpc.UnaryServerInterceptor) {
 
-	var ensureTraceFunc optEnsureTrace = nil
-	var innerInterceptor grpc.UnaryServerInterceptor = nil
-	var ensureErrorFunc optEnsureError = nil
-
-	for _, opt := range opts {
-		if newTraceFunc, ok := opt.(optEnsureTrace); ok {
-			ensureTraceFunc = newTraceFunc
-			xlog.Info("ensureTraceFunc registered")
-		}
-		if newErrorFunc, ok := opt.(optEnsureError); ok {
-			ensureErrorFunc = newErrorFunc
-			xlog.Info("ensureErrorFunc registered")
-		}
-		if inner, ok := opt.(grpc.UnaryServerInterceptor); ok {
-			innerInterceptor = inner
-			xlog.Info("inner interceptor registered")
-		}
-	}
+	options := newGrpcInterceptorOptions(opts...)
+	ensureTraceFunc := options.ensureTrace
+	ensureErrorFunc := options.ensureError
+	chain := options.chain
+	limiter := options.limiter
+	accessLogger := options.accessLogger
+	timeouts := options.timeouts
+	validateReq := options.validate
+	authenticator := options.authenticator
 	//var interceptor grpc.UnaryServerInterceptor
 	interceptor = func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (rsp interface{}, err error) {
-		lctx := local_context.NewLocalContextWithCtx(ctx)
 		method := info.FullMethod
 		subStrs := GrpcMethodReg.FindStringSubmatch(method)
 		if len(subStrs) > 1 {
 			method = subStrs[1]
 		}
+		timeout := timeouts.of(method)
+		if timeout > 0 {
+			// the deadline of the caller is kept if shorter
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		// the span of the rpc, ended last
+		ctx, span := startServerSpan(ctx, info.FullMethod)
+		lctx := local_context.NewLocalContextWithCtx(ctx)
 		lctx.SetMethod(method)
 		t0 := time.Now()
+		var traceId, caller string
+		defer func() {
+			endServerSpan(span, lctx.LogId(), caller, err)
+		}()
+		// access log
+		if accessLogger != nil {
+			defer func() {
+				accessLogger.logUnary(method, caller, lctx.LogId(), t0, req, rsp, err)
+			}()
+		}
+		// 1. common metrics, observing the recovered panics as well
+		defer func() {
+			observeUnary(metrics, ensureErrorFunc, method, caller, t0, rsp, err)
+		}()
 		defer func() {
 			if e := recover(); e != nil {
 				xlog.Fatal("_grpc_recover||logid=%v||method=%v||catch panic||%s\n%s", lctx.LogId(), method, e, debug.Stack())
@@ -166,7 +339,7 @@ func GrpcInterceptor(
 			}
 		}()
 		// 0.parse trace and caller from header
-		traceId, caller := ParseTraceAndCaller(ctx, lctx)
+		traceId, caller = ParseTraceAndCaller(ctx, lctx)
 		xlog.Debug("trace_id=%v||caller=%v", traceId, caller)
 		if ensureTraceFunc != nil {
 			// 0.1 compatible to request with trace object
@@ -201,51 +374,109 @@ func GrpcInterceptor(
 				}
 			}
 		}
-		// 1. common metrics
-		defer func() {
-			timecost := utils.CalTimecost(t0)
-			metrics.Observe(timecost, method)
-			//xlog.Fatal("TIMECOST=%v", timecost)
-			errType := ""
-			if err != nil {
-				errType = clients.ERR_ERR
-			} else {
-				// 0.1 compatible to request with error object
-				if rsp != nil && ensureErrorFunc != nil {
-					refErr := reflect.ValueOf(rsp).Elem().FieldByName(fieldError)
-					if refErr.IsValid() && refErr.Type().Kind() == reflect.Ptr {
-						if !refErr.IsNil() {
-							Error, ok := refErr.Interface().(ErrorIface)
-							if ok {
-								if Error.GetCode() != clients.CODE_SUCC {
-									errType = strconv.Itoa(int(Error.GetCode()))
-								}
-							}
-						} else if ensureErrorFunc != nil {
-							// 1.1 assign default error Msg
-							newError := ensureErrorFunc(refErr.Type())
-							// 0.1 compare filed type and set default value
-							errorRefType, _ := reflect.TypeOf(rsp).Elem().FieldByName(fieldError)
-							if reflect.TypeOf(newError) == errorRefType.Type {
-								refErr.Set(reflect.ValueOf(newError))
-							}
-						}
-					}
+		// 2. auth
+		// the limits apply to the authenticated caller when known, the header
+		// is up to the client
+		limitCaller := caller
+		if authenticator != nil && !health.IsHealthMethod(info.FullMethod) {
+			principal, _err := authenticator.authenticate(ctx, method, caller)
+			if _err != nil {
+				return nil, _err
+			}
+			if principal != nil {
+				lctx.Put(principalKey, principal)
+				limitCaller = principal.Caller
+			}
+		}
 
-				}
+		// 3. limits
+		if limiter != nil && !health.IsHealthMethod(info.FullMethod) {
+			release, _err := limiter.acquire(method, limitCaller)
+			if _err != nil {
+				return nil, _err
 			}
-			if errType != "" {
-				metrics.ObserveCounter(1, method, errType, caller)
-			} else {
-				metrics.ObserveCounter(1, method, clients.ERR_SUCC, caller)
+			defer func() {
+				release(time.Since(t0), err)
+			}()
+		}
+
+		// 4. validation
+		if validateReq {
+			if _err := validate.Check(req); _err != nil {
+				xlog.Info("_grpc_validate||logid=%v||method=%v||caller=%v||err=%v", lctx.LogId(), method, caller, _err)
+				if rsp = errorRsp(ensureErrorFunc, info, method, _err); rsp != nil {
+					return rsp, nil
+				}
+				return nil, _err
 			}
-		}()
+		}
 
-		if innerInterceptor != nil {
-			return innerInterceptor(lctx, req, info, handler)
+		// 5. inner interceptors
+		if timeout > 0 {
+			rsp, err = runWithTimeout(lctx, req, chainUnaryHandler(chain, info, handler))
+		} else {
+			rsp, err = chainUnaryHandler(chain, info, handler)(lctx, req)
 		}
-		return handler(lctx, req)
+		if err != nil {
+			err = errors.ToGRPC(err)
+			if rsp == nil {
+				// grpc drops the rsp along an err, the Error of the rsp carries it
+				if rsp = errorRsp(ensureErrorFunc, info, method, err); rsp != nil {
+					err = nil
+				}
+			}
+		}
+		return
 	}
 	return interceptor
 	//return grpc.UnaryInterceptor(interceptor)
 }
+
+// observeUnary observes the common metrics of an rpc, the code of the Error
+// object of rsp counts as the err type when set
+func observeUnary(
+	metrics metrics.MetricsBase,
+	ensureErrorFunc func(req reflect.Type) ErrorIface,
+	method, caller string,
+	t0 time.Time,
+	rsp interface{},
+	err error) {
+	timecost := utils.CalTimecost(t0)
+	metrics.Observe(timecost, method)
+	//xlog.Fatal("TIMECOST=%v", timecost)
+	errType := ""
+	if err != nil {
+		if errType = errTypeOf(err); errType == "" {
+			errType = clients.ERR_ERR
+		}
+	} else {
+		// 0.1 compatible to request with error object
+		if rsp != nil && ensureErrorFunc != nil {
+			refErr := reflect.ValueOf(rsp).Elem().FieldByName(fieldError)
+			if refErr.IsValid() && refErr.Type().Kind() == reflect.Ptr {
+				if !refErr.IsNil() {
+					Error, ok := refErr.Interface().(ErrorIface)
+					if ok {
+						if Error.GetCode() != clients.CODE_SUCC {
+							errType = strconv.Itoa(int(Error.GetCode()))
+						}
+					}
+				} else if ensureErrorFunc != nil {
+					// 1.1 assign default error Msg
+					newError := ensureErrorFunc(refErr.Type())
+					// 0.1 compare filed type and set default value
+					errorRefType, _ := reflect.TypeOf(rsp).Elem().FieldByName(fieldError)
+					if reflect.TypeOf(newError) == errorRefType.Type {
+						refErr.Set(reflect.ValueOf(newError))
+					}
+				}
+			}
+
+		}
+	}
+	if errType != "" {
+		metrics.ObserveCounter(1, method, errType, caller)
+	} else {
+		metrics.ObserveCounter(1, method, clients.ERR_SUCC, caller)
+	}
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xutils/lib-common/clients"
+	"github.com/xutils/lib-common/local_context"
+	"github.com/xutils/lib-common/metrics"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestGrpcInterceptorChain(t *testing.T) {
+	m := &metrics.MetricsBase{}
+	InitRpcMetrics(m, "unitTestChain")
+
+	order := []string{}
+	named := func(name string) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			// the trace is parsed before the chain
+			lctx, ok := ctx.(*local_context.LocalContext)
+			assert.True(t, ok)
+			assert.Equal(t, "chain_trace", lctx.LogId())
+			order = append(order, name)
+			return handler(ctx, req)
+		}
+	}
+	interceptor := GrpcInterceptor(*m,
+		OptChain(named("a"), named("b")),
+		OptChain(named("c")))
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.New(map[string]string{
+		clients.HEADER_TRACE:  "chain_trace",
+		clients.HEADER_CALLER: "chain_caller",
+	}))
+	info := &grpc.UnaryServerInfo{FullMethod: "/test.Svr/Chain"}
+	_, err := interceptor(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		order = append(order, "handler")
+		return nil, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b", "c", "handler"}, order)
+
+	// a panic of the chain is recovered and counted as err
+	panicking := GrpcInterceptor(*m, OptChain(
+		func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			panic("boom")
+		}))
+	_, err = panicking(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.GetTimeoutMetricsCounter().WithLabelValues("Chain", clients.ERR_ERR, "chain_caller")))
+}
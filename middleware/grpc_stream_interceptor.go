@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/xutils/lib-common/clients"
+	"github.com/xutils/lib-common/health"
+	"github.com/xutils/lib-common/local_context"
+	"github.com/xutils/lib-common/metrics"
+	"github.com/xutils/lib-common/utils"
+	"github.com/xutils/lib-common/xlog"
+
+	"google.golang.org/grpc"
+)
+
+const (
+	streamDirectionRecv = "recv"
+	streamDirectionSend = "send"
+)
+
+var streamMsgMetrics = &metrics.MetricsBase{}
+
+// InitStreamMetrics creates and registers the metrics of GrpcStreamInterceptor:
+// stream duration by method, streams by method, err and caller, and the
+// messages received and sent by method and direction, counted once the
+// streams end
+func InitStreamMetrics(m *metrics.MetricsBase, prefix string) {
+	m.CreateMetrics(fmt.Sprintf("%v_stream", prefix),
+		[]float64{10, 100, 1000, 10000, 60000, 600000}, []string{"method"})
+	m.CreateMetricsCountVec(prefix, "stream", "cnt", []string{"method", "err", "caller"})
+	prometheus.MustRegister(m.GetMetricsVectors()...)
+	streamMsgMetrics.CreateMetricsCountVec(prefix, "stream", "msg_cnt", []string{"method", "direction"})
+	prometheus.MustRegister(streamMsgMetrics.GetMetricsVectors()...)
+}
+
+func GrpcStreamInterceptorServerOption(
+	metrics metrics.MetricsBase,
+	opt ...GrpcInterceptorOpt) (serverOpt grpc.ServerOption) {
+	return grpc.StreamInterceptor(GrpcStreamInterceptor(metrics, opt...))
+}
+
+// GrpcInterceptorServerOptions installs both GrpcInterceptor and
+// GrpcStreamInterceptor, see InitRpcMetrics and InitStreamMetrics
+func GrpcInterceptorServerOptions(
+	metrics metrics.MetricsBase,
+	streamMetrics metrics.MetricsBase,
+	opt ...GrpcInterceptorOpt) (serverOpts []grpc.ServerOption) {
+	return []grpc.ServerOption{
+		GrpcInterceptorServerOption(metrics, opt...),
+		GrpcStreamInterceptorServerOption(streamMetrics, opt...),
+	}
+}
+
+// tracedServerStream hands the LocalContext to the handler and counts messages
+type tracedServerStream struct {
+	grpc.ServerStream
+	lctx    *local_context.LocalContext
+	recvCnt int64
+	sendCnt int64
+}
+
+func (s *tracedServerStream) Context() context.Context {
+	return s.lctx
+}
+
+func (s *tracedServerStream) RecvMsg(m interface{}) (err error) {
+	if err = s.ServerStream.RecvMsg(m); err == nil {
+		atomic.AddInt64(&s.recvCnt, 1)
+	}
+	return
+}
+
+func (s *tracedServerStream) SendMsg(m interface{}) (err error) {
+	if err = s.ServerStream.SendMsg(m); err == nil {
+		atomic.AddInt64(&s.sendCnt, 1)
+	}
+	return
+}
+
+// GrpcStreamInterceptor is the streaming counterpart of GrpcInterceptor, the
+// trace id and caller are parsed from the md of the stream, OptEnsureTrace and
+// OptEnsureError do not apply to streams
+func GrpcStreamInterceptor(
+	metrics metrics.MetricsBase,
+	opts ...GrpcInterceptorOpt) (interceptor grpc.StreamServerInterceptor) {
+
+	options := newGrpcInterceptorOptions(opts...)
+	chain := options.streamChain
+	limiter := options.limiter
+	accessLogger := options.accessLogger
+	authenticator := options.authenticator
+
+	interceptor = func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		ctx, span := startServerSpan(ss.Context(), info.FullMethod)
+		lctx := local_context.NewLocalContextWithCtx(ctx)
+		method := info.FullMethod
+		subStrs := GrpcMethodReg.FindStringSubmatch(method)
+		if len(subStrs) > 1 {
+			method = subStrs[1]
+		}
+		lctx.SetMethod(method)
+		t0 := time.Now()
+		stream := &tracedServerStream{
+			ServerStream: ss,
+			lctx:         lctx,
+		}
+		var traceId, caller string
+		defer func() {
+			endServerSpan(span, lctx.LogId(), caller, err)
+		}()
+
+		// access log
+		if accessLogger != nil {
+			defer func() {
+				accessLogger.logStream(method, caller, lctx.LogId(), t0,
+					atomic.LoadInt64(&stream.recvCnt), atomic.LoadInt64(&stream.sendCnt), err)
+			}()
+		}
+		// 1. common metrics, observing the recovered panics as well
+		defer func() {
+			timecost := utils.CalTimecost(t0)
+			metrics.Observe(timecost, method)
+			// the err types of GrpcInterceptor
+			errType := clients.ERR_SUCC
+			if err != nil {
+				if errType = errTypeOf(err); errType == "" {
+					errType = clients.ERR_ERR
+				}
+			}
+			metrics.ObserveCounter(1, method, errType, caller)
+			streamMsgMetrics.ObserveCounter(float64(atomic.LoadInt64(&stream.recvCnt)), method, streamDirectionRecv)
+			streamMsgMetrics.ObserveCounter(float64(atomic.LoadInt64(&stream.sendCnt)), method, streamDirectionSend)
+		}()
+		defer func() {
+			if e := recover(); e != nil {
+				xlog.Fatal("_grpc_recover||logid=%v||method=%v||stream||catch panic||%s\n%s", lctx.LogId(), method, e, debug.Stack())
+				err = fmt.Errorf("panic err=%v", e)
+				return
+			}
+		}()
+		// 0.parse trace and caller from header
+		traceId, caller = ParseTraceAndCaller(ss.Context(), lctx)
+		xlog.Debug("trace_id=%v||caller=%v||stream", traceId, caller)
+
+		// 2. auth
+		// the limits apply to the authenticated caller when known, the header
+		// is up to the client
+		limitCaller := caller
+		if authenticator != nil && !health.IsHealthMethod(info.FullMethod) {
+			principal, _err := authenticator.authenticate(ss.Context(), method, caller)
+			if _err != nil {
+				return _err
+			}
+			if principal != nil {
+				lctx.Put(principalKey, principal)
+				limitCaller = principal.Caller
+			}
+		}
+
+		// 3. limits, a stream holds its concurrency slot until it ends
+		if limiter != nil && !health.IsHealthMethod(info.FullMethod) {
+			release, _err := limiter.acquire(method, limitCaller)
+			if _err != nil {
+				return _err
+			}
+			defer func() {
+				// the duration of a stream says nothing of the load
+				release(noLatencySample, err)
+			}()
+		}
+
+		// 4. inner interceptors
+		return chainStreamHandler(chain, info, handler)(srv, stream)
+	}
+	return interceptor
+}
+
+// chainStreamHandler wraps handler with interceptors, interceptors[0] outermost
+func chainStreamHandler(
+	interceptors []grpc.StreamServerInterceptor,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) grpc.StreamHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(srv interface{}, ss grpc.ServerStream) error {
+			return interceptor(srv, ss, info, next)
+		}
+	}
+	return handler
+}
@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xutils/lib-common/clients"
+	"github.com/xutils/lib-common/local_context"
+	"github.com/xutils/lib-common/metrics"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// fakeServerStream receives recvN messages then io.EOF
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx   context.Context
+	recvN int
+	sent  int
+}
+
+func (s *fakeServerStream) Context() context.Context { return s.ctx }
+
+func (s *fakeServerStream) RecvMsg(m interface{}) error {
+	if s.recvN == 0 {
+		return io.EOF
+	}
+	s.recvN--
+	return nil
+}
+
+func (s *fakeServerStream) SendMsg(m interface{}) error {
+	s.sent++
+	return nil
+}
+
+func TestGrpcStreamInterceptor(t *testing.T) {
+	m := &metrics.MetricsBase{}
+	InitStreamMetrics(m, "unitTestStream")
+	interceptor := GrpcStreamInterceptor(*m)
+	info := &grpc.StreamServerInfo{FullMethod: "/test.Svr/Chat", IsClientStream: true, IsServerStream: true}
+
+	md := metadata.New(map[string]string{
+		clients.HEADER_TRACE:  "stream_trace",
+		clients.HEADER_CALLER: "stream_caller",
+	})
+	ss := &fakeServerStream{ctx: metadata.NewIncomingContext(context.Background(), md), recvN: 3}
+	err := interceptor(nil, ss, info, func(srv interface{}, stream grpc.ServerStream) error {
+		lctx, ok := stream.Context().(*local_context.LocalContext)
+		assert.True(t, ok)
+		assert.Equal(t, "stream_trace", lctx.LogId())
+		assert.Equal(t, "Chat", lctx.Method())
+		for {
+			if err := stream.RecvMsg(nil); err != nil {
+				break
+			}
+			assert.Nil(t, stream.SendMsg(nil))
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, ss.sent)
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.GetTimeoutMetricsCounter().WithLabelValues("Chat", clients.ERR_SUCC, "stream_caller")))
+	msgCnt := streamMsgMetrics.GetTimeoutMetricsCounter()
+	assert.Equal(t, float64(3), testutil.ToFloat64(msgCnt.WithLabelValues("Chat", "recv")))
+	assert.Equal(t, float64(3), testutil.ToFloat64(msgCnt.WithLabelValues("Chat", "send")))
+
+	// panic is recovered and counted
+	err = interceptor(nil, &fakeServerStream{ctx: context.Background()}, info, func(srv interface{}, stream grpc.ServerStream) error {
+		panic(errors.New("boom"))
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.GetTimeoutMetricsCounter().WithLabelValues("Chat", clients.ERR_ERR, "")))
+}
+
+func TestGrpcStreamInterceptorLimit(t *testing.T) {
+	opt := OptLimit(LimitConfig{
+		Concurrency: ConcurrencyLimitConfig{Enable: true, InitialLimit: 2, MaxLimit: 2, LatencyThresholdMs: 1},
+	})
+	interceptor := GrpcStreamInterceptor(metrics.MetricsBase{}, opt)
+	info := &grpc.StreamServerInfo{FullMethod: "/test.Svr/Chat"}
+	for i := 0; i < 3; i++ {
+		err := interceptor(nil, &fakeServerStream{ctx: context.Background()}, info, func(srv interface{}, stream grpc.ServerStream) error {
+			time.Sleep(time.Millisecond * 5)
+			return nil
+		})
+		assert.Nil(t, err)
+	}
+	// the streams longer than the latency threshold do not shrink the limit
+	limit := newGrpcInterceptorOptions(opt).limiter.concLimit("Chat")
+	assert.Equal(t, 2, limit.current())
+	assert.Equal(t, 0, limit.inflight)
+}
@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"github.com/xutils/lib-common/health"
+	"github.com/xutils/lib-common/xlog"
+)
+
+/**
+####################################################################################
+HEALTH
+NewHttpWrapper answers health.PATH_HEALTHZ and health.PATH_READYZ with the
+handlers of h, before the logs and the spans, the grpc.health.v1 rpcs skip
+OptAuth and OptLimit so that the probes never get rejected
+*/
+
+// OptHealth serves the health probes of h in NewHttpWrapper, see
+// health.Health.Handle
+func OptHealth(h *health.Health) HttpInterceptorOpt {
+	return func(opts *httpInterceptorOptions) {
+		opts.health = h
+		xlog.Info("health registered||paths=%v,%v", health.PATH_HEALTHZ, health.PATH_READYZ)
+	}
+}
@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xutils/lib-common/health"
+	"github.com/xutils/lib-common/metrics"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestHttpWrapperHealth(t *testing.T) {
+	h := health.NewHealth(health.Config{})
+	var dbErr error
+	h.AddChecker("db", health.CheckerFunc(func(ctx context.Context) error { return dbErr }))
+	h.CheckNow(context.Background())
+
+	reached := false
+	mux := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	})
+	handler := NewHttpWrapper(OptHealth(h))(mux)
+	serve := func(path string) *httptest.ResponseRecorder {
+		reached = false
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	w := serve(health.PATH_READYZ)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, reached)
+	dbErr = errors.New("down")
+	h.CheckNow(context.Background())
+	w = serve(health.PATH_READYZ)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	w = serve(health.PATH_HEALTHZ)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, reached)
+
+	w = serve("/v1/users")
+	assert.True(t, reached)
+	assert.NotEqual(t, "", w.Header().Get("grpc-trace-id"))
+}
+
+func TestGrpcInterceptorHealth(t *testing.T) {
+	m := &metrics.MetricsBase{}
+	InitRpcMetrics(m, "unitTestHealth")
+	interceptor := GrpcInterceptor(*m,
+		OptAuth(AuthConfig{
+			HmacSecrets: map[string]string{"svr_a": "secret_a"},
+		}),
+		OptLimit(LimitConfig{
+			RateLimits: []RateLimit{{Method: "*", Caller: "*", Rate: 0.001, Burst: 1}},
+		}))
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+
+	// the probes carry no credentials and are never limited
+	for i := 0; i < 3; i++ {
+		_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/grpc.health.v1.Health/Check"}, handler)
+		assert.Nil(t, err)
+	}
+	_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/test.Svr/Check"}, handler)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
@@ -0,0 +1,256 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/xutils/lib-common/errors"
+	"github.com/xutils/lib-common/local_context"
+	"github.com/xutils/lib-common/xlog"
+
+	"google.golang.org/grpc/codes"
+)
+
+/**
+####################################################################################
+HTTP BODY
+the request bodies of NewHttpWrapper are decompressed, gzip or deflate, limited
+and buffered for the handlers, the responses compressed with gzip for the
+clients accepting it, see OptHttpBody
+*/
+
+type HttpBodyConfig struct {
+	// max bytes of a request body once decompressed, 413 beyond, no limit when 0
+	MaxBytes int64 `toml:"max_bytes"`
+	// compress the responses with gzip for the clients accepting it
+	GzipResponse bool `toml:"gzip_response"`
+	// 1 to 9, gzip.DefaultCompression when 0
+	GzipLevel int `toml:"gzip_level"`
+	// path prefixes of the requests the body of is streamed to the mux instead
+	// of buffered, e.g. uploads, still limited to MaxBytes
+	SkipBufferPaths []string `toml:"skip_buffer_paths"`
+}
+
+// OptHttpBody sets the body limit and compression of NewHttpWrapper, the
+// request bodies are decompressed and buffered without it as well
+func OptHttpBody(conf HttpBodyConfig) HttpInterceptorOpt {
+	if conf.GzipLevel == 0 || conf.GzipLevel < gzip.HuffmanOnly || conf.GzipLevel > gzip.BestCompression {
+		conf.GzipLevel = gzip.DefaultCompression
+	}
+	return func(opts *httpInterceptorOptions) {
+		opts.body = conf
+		xlog.Info("http body registered||max_bytes=%v||gzip_response=%v||skip_buffer_paths=%v", conf.MaxBytes, conf.GzipResponse, conf.SkipBufferPaths)
+	}
+}
+
+var (
+	errBodyTooLarge        = errors.New(errors.Code(codes.ResourceExhausted), "request body too large")
+	errUnsupportedEncoding = errors.New(errors.Code(codes.InvalidArgument), "unsupported content encoding")
+)
+
+func (conf *HttpBodyConfig) skipBuffer(path string) bool {
+	for _, prefix := range conf.SkipBufferPaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// replyBodyErr replies err with the standard body
+func replyBodyErr(w http.ResponseWriter, status int, err *errors.Error) {
+	data, _err := HttpMarshaler().Marshal(err)
+	if _err != nil {
+		data = []byte(err.Message)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
+
+// decompressBody replaces the body of req by its decompressed content
+func decompressBody(req *http.Request) (err error) {
+	encoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+	var reader io.ReadCloser
+	switch encoding {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+		if reader, err = gzip.NewReader(req.Body); err != nil {
+			return errors.Wrap(err, errors.Code(codes.InvalidArgument), "bad gzip body")
+		}
+	case "deflate":
+		// zlib as of the rfc, raw deflate as sent by some clients
+		buffered := bufio.NewReader(req.Body)
+		header, _ := buffered.Peek(2)
+		if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			if reader, err = zlib.NewReader(buffered); err != nil {
+				return errors.Wrap(err, errors.Code(codes.InvalidArgument), "bad deflate body")
+			}
+		} else {
+			reader = flate.NewReader(buffered)
+		}
+	default:
+		return errUnsupportedEncoding
+	}
+	req.Body = reader
+	req.Header.Del("Content-Encoding")
+	req.Header.Del("Content-Length")
+	req.ContentLength = -1
+	return nil
+}
+
+// readReqBody decompresses the body of req and, unless skipped, buffers it,
+// replying the failures. the returned req, holding lctx and the body, is nil
+// when replied
+func readReqBody(lctx *local_context.LocalContext, conf *HttpBodyConfig, w http.ResponseWriter, req *http.Request) *http.Request {
+	if conf.MaxBytes > 0 && req.ContentLength > conf.MaxBytes && req.Header.Get("Content-Encoding") == "" {
+		xlog.Info("logid=%v||_http_body||too large||content_length=%v", lctx.LogId(), req.ContentLength)
+		replyBodyErr(w, http.StatusRequestEntityTooLarge, errBodyTooLarge)
+		return nil
+	}
+	if err := decompressBody(req); err != nil {
+		xlog.Info("logid=%v||_http_body||failed to decompress||err=%v", lctx.LogId(), err)
+		status := http.StatusBadRequest
+		if err == errUnsupportedEncoding {
+			status = http.StatusUnsupportedMediaType
+		}
+		replyBodyErr(w, status, errors.FromError(err))
+		return nil
+	}
+	if conf.skipBuffer(req.URL.Path) {
+		if conf.MaxBytes > 0 {
+			req.Body = http.MaxBytesReader(w, req.Body, conf.MaxBytes)
+		}
+		return req.WithContext(lctx)
+	}
+	body, err := copyReqBody(lctx, req, conf.MaxBytes)
+	if err == errBodyTooLarge {
+		replyBodyErr(w, http.StatusRequestEntityTooLarge, errBodyTooLarge)
+		return nil
+	}
+	if err != nil {
+		replyBodyErr(w, http.StatusBadRequest, errors.FromError(err))
+		return nil
+	}
+	//xlog.Debug("header=%+v||body=%s", req.Header, body)
+	xlog.Debug("logid=%v||body=%s", lctx.LogId(), body)
+	return req.WithContext(context.WithValue(lctx, _body, body))
+}
+
+// copyReqBody reads the body of req, up to maxBytes when > 0, and leaves a
+// copy of it as the body
+func copyReqBody(lctx *local_context.LocalContext, req *http.Request, maxBytes int64) (body []byte, err error) {
+	reader := io.Reader(req.Body)
+	if maxBytes > 0 {
+		reader = io.LimitReader(req.Body, maxBytes+1)
+	}
+	body, err = ioutil.ReadAll(reader)
+	if err != nil {
+		xlog.Error("logid=%v||failed to read req body||err=%v", lctx.LogId(), err)
+		err = errors.Wrap(err, errors.Code(codes.InvalidArgument), "failed to read req body")
+		return
+	}
+	if maxBytes > 0 && int64(len(body)) > maxBytes {
+		xlog.Info("logid=%v||_http_body||too large||max_bytes=%v", lctx.LogId(), maxBytes)
+		return nil, errBodyTooLarge
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return
+}
+
+// acceptsGzip tells if the Accept-Encoding of req allows gzip
+func acceptsGzip(req *http.Request) bool {
+	if req.Method == http.MethodHead {
+		return false
+	}
+	for _, part := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the response unless already encoded or without body
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	level       int
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	header := w.Header()
+	header.Add("Vary", "Accept-Encoding")
+	if header.Get("Content-Encoding") == "" && code >= http.StatusOK &&
+		code != http.StatusNoContent && code != http.StatusNotModified {
+		gz, err := gzip.NewWriterLevel(w.ResponseWriter, w.level)
+		if err == nil {
+			header.Set("Content-Encoding", "gzip")
+			header.Del("Content-Length")
+			w.gz = gz
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(data))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		_ = w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *gzipResponseWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	if err := w.gz.Close(); err != nil {
+		return fmt.Errorf("failed to close gzip||err=%v", err)
+	}
+	return nil
+}
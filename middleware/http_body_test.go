@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(buf)
+	case "zlib":
+		w = zlib.NewWriter(buf)
+	default:
+		var err error
+		w, err = flate.NewWriter(buf, flate.DefaultCompression)
+		assert.Nil(t, err)
+	}
+	_, err := w.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestHttpBody(t *testing.T) {
+	var received []byte
+	mux := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		received, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"code":200,"message":"` + strings.Repeat("a", 64) + `"}`))
+	})
+	handler := NewHttpWrapper(OptHttpBody(HttpBodyConfig{
+		MaxBytes:        16,
+		GzipResponse:    true,
+		SkipBufferPaths: []string{"/v1/upload"},
+	}))(mux)
+	serve := func(path string, body []byte, header map[string]string) *httptest.ResponseRecorder {
+		received = nil
+		r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("/v1/orders", []byte(`{"id":1}`), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"id":1}`, string(received))
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+
+	// limits, on the decompressed body
+	w = serve("/v1/orders", []byte(strings.Repeat("a", 17)), nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.JSONEq(t, `{"code":8,"message":"request body too large"}`, w.Body.String())
+	assert.Nil(t, received)
+	w = serve("/v1/orders", compress(t, "gzip", []byte(strings.Repeat("a", 17))), map[string]string{"Content-Encoding": "gzip"})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// decompression
+	for _, encoding := range []string{"gzip", "zlib", "deflate"} {
+		contentEncoding := encoding
+		if encoding == "zlib" {
+			contentEncoding = "deflate"
+		}
+		w = serve("/v1/orders", compress(t, encoding, []byte(`{"id":2}`)), map[string]string{"Content-Encoding": contentEncoding})
+		assert.Equal(t, http.StatusOK, w.Code, encoding)
+		assert.Equal(t, `{"id":2}`, string(received), encoding)
+	}
+	w = serve("/v1/orders", []byte(`{"id":2}`), map[string]string{"Content-Encoding": "gzip"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = serve("/v1/orders", []byte(`{"id":2}`), map[string]string{"Content-Encoding": "br"})
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	// streamed, still limited
+	w = serve("/v1/upload/1", []byte(strings.Repeat("a", 16)), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 16, len(received))
+	w = serve("/v1/upload/1", []byte(strings.Repeat("a", 17)), map[string]string{"Content-Length": ""})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// responses compressed as accepted
+	for _, accept := range []string{"gzip", "deflate, gzip;q=0.5", "*"} {
+		w = serve("/v1/orders", nil, map[string]string{"Accept-Encoding": accept})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"), accept)
+		assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+		reader, err := gzip.NewReader(w.Body)
+		assert.Nil(t, err)
+		data, err := ioutil.ReadAll(reader)
+		assert.Nil(t, err)
+		assert.Contains(t, string(data), `"code":200`)
+	}
+	for _, accept := range []string{"deflate", "gzip;q=0", "identity"} {
+		w = serve("/v1/orders", nil, map[string]string{"Accept-Encoding": accept})
+		assert.Equal(t, "", w.Header().Get("Content-Encoding"), accept)
+		assert.Contains(t, w.Body.String(), `"code":200`)
+	}
+}
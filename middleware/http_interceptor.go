@@ -1,18 +1,19 @@
 package middleware
 
 import (
-	"bytes"
 	"context"
-	"io/ioutil"
+	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/xutils/lib-common/clients"
+	"github.com/xutils/lib-common/errors"
+	"github.com/xutils/lib-common/health"
+	"github.com/xutils/lib-common/tracing"
 
 	status2 "google.golang.org/grpc/status"
 
-	"google.golang.org/grpc/codes"
-
 	"github.com/xutils/lib-common/local_context"
 	"github.com/xutils/lib-common/xlog"
 
@@ -37,14 +38,40 @@ func tracedIncomingHeaderMatcher(in string) (out string, match bool) {
 	if match {
 		return
 	}
-	if strings.HasPrefix(in, clients.HEADER_PREFIX) {
+	if strings.HasPrefix(in, clients.HEADER_PREFIX) || strings.EqualFold(in, clients.HEADER_TRACEPARENT) {
 		out = in
 		match = true
 	}
 	return
 }
 
-type HttpInterceptorOpt interface{}
+type httpInterceptorOptions struct {
+	httpStatuses map[errors.Code]int
+	cors         *cors
+	body         HttpBodyConfig
+	health       *health.Health
+}
+
+type HttpInterceptorOpt func(opts *httpInterceptorOptions)
+
+func newHttpInterceptorOptions(opts ...HttpInterceptorOpt) *httpInterceptorOptions {
+	options := &httpInterceptorOptions{httpStatuses: map[errors.Code]int{}}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// OptHttpStatus overrides the http status of the errs of the codes in statuses,
+// grpc or business ones, the others get errors.Code.HTTPStatus
+func OptHttpStatus(statuses map[errors.Code]int) HttpInterceptorOpt {
+	return func(opts *httpInterceptorOptions) {
+		for code, st := range statuses {
+			opts.httpStatuses[code] = st
+		}
+		xlog.Info("http statuses registered||statuses=%v", statuses)
+	}
+}
 
 func HttpMarshalerServerMuxOption(
 	opt ...HttpInterceptorOpt) (serverMuxOpt runtime.ServeMuxOption) {
@@ -53,6 +80,53 @@ func HttpMarshalerServerMuxOption(
 
 }
 
+// HttpErrorHandlerServerMuxOption replies the errs of the gateway with the
+// standard body of HttpMarshaler, see HttpErrorHandler
+func HttpErrorHandlerServerMuxOption(
+	opt ...HttpInterceptorOpt) (serverMuxOpt runtime.ServeMuxOption) {
+	return runtime.WithProtoErrorHandler(HttpErrorHandler(opt...))
+}
+
+// HttpErrorHandler replies err with the http status of its code, grpc or
+// business one, the body is the status of err given to the marshaler of the
+// mux, i.e. {code,message} with StandardResponsMarshaler
+func HttpErrorHandler(opts ...HttpInterceptorOpt) runtime.ProtoErrorHandlerFunc {
+	options := newHttpInterceptorOptions(opts...)
+	return func(ctx context.Context, mux *runtime.ServeMux, marshaler runtime.Marshaler,
+		w http.ResponseWriter, r *http.Request, err error) {
+		// the Errors wrapped by err are otherwise Unknown to the gateway
+		err = errors.ToGRPC(err)
+		sw := &statusWriter{
+			ResponseWriter: w,
+			grpcStatus:     runtime.HTTPStatusFromCode(status2.Code(err)),
+			status:         options.httpStatus(errors.CodeOf(err)),
+		}
+		runtime.DefaultHTTPProtoErrorHandler(ctx, mux, marshaler, sw, r, err)
+	}
+}
+
+func (opts *httpInterceptorOptions) httpStatus(code errors.Code) int {
+	if st, ok := opts.httpStatuses[code]; ok {
+		return st
+	}
+	return code.HTTPStatus()
+}
+
+// statusWriter writes status instead of grpcStatus, the one of the grpc code,
+// the others, i.e. the 500 of the marshal failures, are kept
+type statusWriter struct {
+	http.ResponseWriter
+	grpcStatus int
+	status     int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if code == w.grpcStatus {
+		code = w.status
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
 func HttpMarshaler(opts ...HttpInterceptorOpt) (marshaler runtime.Marshaler) {
 	marshaler = &runtime.JSONBuiltin{}
 
@@ -84,6 +158,19 @@ func (m *StandardResponsMarshaler) Marshal(v interface{}) (data []byte, err erro
 	defer func() {
 		xlog.Debug("data=%s", data)
 	}()
+	// the errs of the gateway, with their business code
+	if rspErr, ok := v.(*status.Status); ok {
+		if e := errors.FromStatus(status2.FromProto(rspErr)); e != nil {
+			v = e
+		}
+	}
+	if e, ok := v.(*errors.Error); ok && e != nil {
+		data, err = m.Marshaler.Marshal(&json_rsp_unmarshal.Response{
+			Code:    int32(e.Code),
+			Message: e.Message,
+		})
+		return
+	}
 	if e, ok := v.(rspErr); ok {
 		rspErr := &json_rsp_unmarshal.Response{
 			Code:    e.GetCode(),
@@ -92,11 +179,6 @@ func (m *StandardResponsMarshaler) Marshal(v interface{}) (data []byte, err erro
 		data, err = m.Marshaler.Marshal(rspErr)
 		return
 	}
-	if rspErr, ok := v.(*status.Status); ok {
-		data, err = m.Marshaler.Marshal(rspErr)
-		return
-	} else {
-	}
 	vProtoMsg, ok := v.(proto.Message)
 	if !ok {
 		//xlog.Info("not proto message")
@@ -113,53 +195,93 @@ func (m *StandardResponsMarshaler) Unmarshal(data []byte, v interface{}) (err er
 	if errStatus != nil && int32(errStatus.Code()) == json_rsp_unmarshal.CodeDecodeError {
 		errStatus = json_rsp_unmarshal.UnmarshalStd(data, v)
 	}
-	if errStatus != nil {
-		err = errStatus.Err()
+	if e := errors.FromStatus(errStatus); e != nil {
+		err = e
 	}
 	return
 }
 
+// DefaultHttpWrapper is the wrapper of NewHttpWrapper with DefaultCORSConfig
 func DefaultHttpWrapper(h http.Handler) (handler http.Handler) {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		lctx := local_context.NewLocalContext()
-		// copy request
-		body, err := copyReqBody(lctx, r)
-		//xlog.Debug("header=%+v||body=%s", r.Header, body)
-		if err != nil {
-			xlog.Error("logid=%v||failed to copy req||err=%v", lctx.LogId(), err)
-		} else {
-			xlog.Debug("logid=%v||body=%s", lctx.LogId(), body)
-		}
-		r = r.WithContext(context.WithValue(r.Context(), _body, body))
-		allowCORS(w, r)
-		h.ServeHTTP(w, r)
-	})
+	return NewHttpWrapper(OptCORS(DefaultCORSConfig))(h)
 }
 
-func copyReqBody(lctx *local_context.LocalContext, req *http.Request) (body []byte, err error) {
-	body, err = ioutil.ReadAll(req.Body)
-	if err != nil {
-		xlog.Error("logid=%v||failed to read req body||err=%v", lctx.LogId(), err)
-		err = status2.New(codes.Internal, err.Error()).Err()
-		return
+// NewHttpWrapper returns the wrapper of the gateway mux, running the requests
+// in a LocalContext of the trace id of HEADER_TRACE or of the traceparent
+// header, a new one otherwise. the trace id is passed to the gateway as
+// HEADER_TRACE, see ParseTraceAndCaller, and echoed in the response. the span
+// of the request is the parent of the one of the rpc through the traceparent
+// md. the CORS policy is the one of OptCORS, the health probes are answered
+// as of OptHealth
+func NewHttpWrapper(opts ...HttpInterceptorOpt) func(h http.Handler) http.Handler {
+	options := newHttpInterceptorOptions(opts...)
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if options.health != nil && options.health.Handle(w, r) {
+				return
+			}
+			t0 := time.Now()
+			parent, _ := tracing.ExtractHTTP(r.Header)
+			ctx, span := tracing.StartRemoteSpan(r.Context(), parent, "HTTP "+r.Method, tracing.SpanKindServer)
+			lctx := local_context.NewLocalContextWithCtx(ctx)
+			if traceId := r.Header.Get(clients.HEADER_TRACE); traceId != "" {
+				lctx.SetLogId(traceId)
+			} else if parent.IsValid() {
+				lctx.SetLogId(parent.TraceID.String())
+			}
+			r.Header.Set(clients.HEADER_TRACE, lctx.LogId())
+			tracing.InjectHTTP(ctx, r.Header)
+			w.Header().Set(clients.HEADER_TRACE, lctx.LogId())
+			xlog.Debug("_http_in||logid=%v||method=%v||path=%v||caller=%v", lctx.LogId(), r.Method, r.URL.Path, r.Header.Get(clients.HEADER_CALLER))
+			rw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			// the preflight requests are answered here
+			if options.cors == nil || !options.cors.handle(rw, r) {
+				var out http.ResponseWriter = rw
+				if options.body.GzipResponse && acceptsGzip(r) {
+					gw := &gzipResponseWriter{ResponseWriter: rw, level: options.body.GzipLevel}
+					defer func() {
+						if err := gw.Close(); err != nil {
+							xlog.Warn("logid=%v||%v", lctx.LogId(), err)
+						}
+					}()
+					out = gw
+				}
+				// decompress, limit and copy the request
+				if req := readReqBody(lctx, &options.body, out, r); req != nil {
+					r = req
+					h.ServeHTTP(out, r)
+				}
+			}
+			xlog.Debug("_http_out||logid=%v||method=%v||path=%v||status=%v||proc_time=%v",
+				lctx.LogId(), r.Method, r.URL.Path, rw.status, time.Since(t0).Milliseconds())
+			if span.IsRecording() {
+				span.SetAttribute(tracing.AttrHttpMethod, r.Method)
+				span.SetAttribute(tracing.AttrHttpRoute, r.URL.Path)
+				span.SetAttribute(tracing.AttrHttpStatusCode, rw.status)
+				span.SetAttribute(tracing.AttrLogId, lctx.LogId())
+				if rw.status >= http.StatusInternalServerError {
+					span.SetError(fmt.Errorf("%v %v", rw.status, http.StatusText(rw.status)))
+				}
+			}
+			span.End()
+		})
 	}
-	req.Body = ioutil.NopCloser(bytes.NewReader(body))
-	return
 }
 
-func allowCORS(w http.ResponseWriter, r *http.Request) {
-	if origin := r.Header.Get("Origin"); origin != "" {
-		w.Header().Set("Access-Control-Allow-Origin", origin)
-		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
-			headers := []string{"Content-Type",
-				"Accept",
-				"Authorization",
-				clients.HEADER_CALLER,
-				clients.HEADER_TRACE}
-			w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ","))
-			methods := []string{"GET", "HEAD", "POST", "PUT", "DELETE"}
-			w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ","))
-		}
+// statusRecorder keeps the status written for the log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
 	}
 }
 
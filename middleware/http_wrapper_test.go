@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xutils/lib-common/clients"
+	"github.com/xutils/lib-common/local_context"
+)
+
+func TestHttpWrapperTrace(t *testing.T) {
+	mux := runtime.NewServeMux(TracedIncomingHeaderMatcherMuxOption())
+	var wrapperTraceId, gatewayTraceId, traceparent string
+	handler := DefaultHttpWrapper(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lctx, ok := local_context.FromContext(r.Context())
+		assert.True(t, ok)
+		wrapperTraceId = lctx.LogId()
+		// what the generated gateway handlers give to the interceptor
+		ctx, err := runtime.AnnotateIncomingContext(r.Context(), mux, r)
+		assert.Nil(t, err)
+		gatewayLctx := local_context.NewLocalContextWithCtx(ctx)
+		ParseTraceAndCaller(ctx, gatewayLctx)
+		gatewayTraceId = gatewayLctx.LogId()
+		traceparent = r.Header.Get(clients.HEADER_TRACEPARENT)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	serve := func(header map[string]string) *httptest.ResponseRecorder {
+		wrapperTraceId, gatewayTraceId = "", ""
+		r := httptest.NewRequest(http.MethodPost, "/v1/orders", nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		return w
+	}
+
+	w := serve(map[string]string{"Grpc-Trace-Id": "trace_1"})
+	assert.Equal(t, "trace_1", wrapperTraceId)
+	assert.Equal(t, "trace_1", gatewayTraceId)
+	assert.Equal(t, "trace_1", w.Header().Get(clients.HEADER_TRACE))
+
+	// the trace id of traceparent, HEADER_TRACE first
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	w = serve(map[string]string{"traceparent": tp})
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", gatewayTraceId)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", w.Header().Get(clients.HEADER_TRACE))
+	// replaced by the one of the span of the request
+	assert.True(t, strings.HasPrefix(traceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-"))
+	assert.NotEqual(t, tp, traceparent)
+	serve(map[string]string{"traceparent": tp, "Grpc-Trace-Id": "trace_2"})
+	assert.Equal(t, "trace_2", gatewayTraceId)
+
+	// a new one for the missing or invalid ones
+	for _, tp := range []string{"", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", "xx"} {
+		w = serve(map[string]string{"traceparent": tp})
+		assert.NotEmpty(t, wrapperTraceId)
+		assert.NotEqual(t, "4bf92f3577b34da6a3ce929d0e0e4736", wrapperTraceId)
+		assert.Equal(t, wrapperTraceId, gatewayTraceId)
+		assert.Equal(t, wrapperTraceId, w.Header().Get(clients.HEADER_TRACE))
+	}
+}
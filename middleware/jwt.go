@@ -0,0 +1,320 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xutils/lib-common/xlog"
+)
+
+/**
+####################################################################################
+JWT
+RS256/384/512 and ES256/384/512 tokens verified with the keys of a local JWKS
+file, the file is checked for changes every jwksCheckInterval
+*/
+
+const (
+	jwksCheckInterval = time.Second * 10
+	// allowed clock skew on exp and nbf
+	jwtLeeway = time.Second * 30
+)
+
+var (
+	errUnknownKey       = errors.New("unknown key")
+	errUnsupportedAlg   = errors.New("unsupported alg")
+	errTokenNotYetValid = errors.New("token not yet valid")
+	errMissingExp       = errors.New("missing exp")
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// rsa
+	N string `json:"n"`
+	E string `json:"e"`
+	// ec
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported crv %v", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported kty %v", k.Kty)
+}
+
+type jwks struct {
+	path    string
+	mtx     *sync.Mutex
+	keys    map[string]crypto.PublicKey
+	modTime time.Time
+	checkTs time.Time
+	now     func() time.Time
+}
+
+func newJwks(path string) *jwks {
+	k := &jwks{
+		path: path,
+		mtx:  &sync.Mutex{},
+		keys: map[string]crypto.PublicKey{},
+		now:  time.Now,
+	}
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	if err := k.reload(); err != nil {
+		xlog.Error("_jwks||failed to load||path=%v||err=%v", path, err)
+	}
+	return k
+}
+
+// reload reads the file again if changed, mtx held
+func (k *jwks) reload() error {
+	k.checkTs = k.now()
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(k.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err = json.Unmarshal(data, &set); err != nil {
+		return err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		pub, err := key.publicKey()
+		if err != nil {
+			xlog.Warn("_jwks||key ignored||path=%v||kid=%v||err=%v", k.path, key.Kid, err)
+			continue
+		}
+		keys[key.Kid] = pub
+	}
+	k.keys = keys
+	k.modTime = info.ModTime()
+	xlog.Info("_jwks||loaded||path=%v||keys=%v", k.path, len(keys))
+	return nil
+}
+
+// key returns the key of kid, or the only one when kid is empty
+func (k *jwks) key(kid string) (crypto.PublicKey, bool) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	if k.now().Sub(k.checkTs) >= jwksCheckInterval {
+		if err := k.reload(); err != nil {
+			xlog.Error("_jwks||failed to reload, keys kept||path=%v||err=%v", k.path, err)
+		}
+	}
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+type jwtClaims map[string]interface{}
+
+func (c jwtClaims) str(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+func (c jwtClaims) issuer() string {
+	return c.str("iss")
+}
+
+func (c jwtClaims) subject() string {
+	return c.str("sub")
+}
+
+// hasAudience tells if aud, either a string or a list of them, includes audience
+func (c jwtClaims) hasAudience(audience string) bool {
+	switch aud := c["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c jwtClaims) time(name string) (t time.Time, ok bool) {
+	sec, ok := c[name].(float64)
+	if !ok {
+		return
+	}
+	return time.Unix(int64(sec), 0), true
+}
+
+// jwtCurve returns the curve the ES alg is defined on
+func jwtCurve(alg string) elliptic.Curve {
+	switch alg {
+	case "ES256":
+		return elliptic.P256()
+	case "ES384":
+		return elliptic.P384()
+	case "ES512":
+		return elliptic.P521()
+	}
+	return nil
+}
+
+func jwtHash(alg string) (crypto.Hash, bool) {
+	switch alg[2:] {
+	case "256":
+		return crypto.SHA256, true
+	case "384":
+		return crypto.SHA384, true
+	case "512":
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
+// verifyJwt checks the signature, exp and nbf of token and returns its
+// claims, the tokens without exp are rejected
+func verifyJwt(token string, keys *jwks, now time.Time) (claims jwtClaims, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errMalformedToken
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &header) != nil {
+		return nil, errMalformedToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errMalformedToken
+	}
+	key, ok := keys.key(header.Kid)
+	if !ok {
+		return nil, errUnknownKey
+	}
+	if len(header.Alg) != 5 {
+		return nil, errUnsupportedAlg
+	}
+	hash, ok := jwtHash(header.Alg)
+	if !ok {
+		return nil, errUnsupportedAlg
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg[:2] != "RS" {
+			return nil, errUnsupportedAlg
+		}
+		if rsa.VerifyPKCS1v15(pub, hash, digest, sig) != nil {
+			return nil, errBadSignature
+		}
+	case *ecdsa.PublicKey:
+		// e.g. ES256 with a P-384 key would be a truncated hash
+		if curve := jwtCurve(header.Alg); curve == nil || curve.Params().Name != pub.Curve.Params().Name {
+			return nil, errUnsupportedAlg
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return nil, errBadSignature
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return nil, errBadSignature
+		}
+	default:
+		return nil, errUnsupportedAlg
+	}
+
+	if data, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return nil, errMalformedToken
+	}
+	if err = json.Unmarshal(data, &claims); err != nil {
+		return nil, errMalformedToken
+	}
+	exp, ok := claims.time("exp")
+	if !ok {
+		return nil, errMissingExp
+	}
+	if now.After(exp.Add(jwtLeeway)) {
+		return nil, errTokenExpired
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(jwtLeeway).Before(nbf) {
+		return nil, errTokenNotYetValid
+	}
+	return claims, nil
+}
@@ -0,0 +1,353 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/xutils/lib-common/xlog"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/**
+####################################################################################
+LIMITER
+token buckets per method and caller and an adaptive (AIMD) concurrency limit,
+rejected rpcs get codes.ResourceExhausted and are counted in the rpc counter vec
+with the err ERR_RATE_LIMITED or ERR_CONCURRENCY_LIMITED
+*/
+
+const (
+	ERR_RATE_LIMITED        = "rate_limited"
+	ERR_CONCURRENCY_LIMITED = "concurrency_limited"
+)
+
+var (
+	errRateLimited        = status.Error(codes.ResourceExhausted, "rate limited")
+	errConcurrencyLimited = status.Error(codes.ResourceExhausted, "concurrency limited")
+)
+
+// RateLimit applies to the rpcs matching Method and Caller, each of them is
+// either empty to match all sharing one bucket, "*" to match all with one
+// bucket per distinct value, or the exact short method name or caller. the
+// caller is the authenticated one with OptAuth, the HEADER_CALLER otherwise
+type RateLimit struct {
+	Method string `toml:"method"`
+	Caller string `toml:"caller"`
+	// tokens per second
+	Rate float64 `toml:"rate"`
+	// max tokens, Rate when not set
+	Burst int `toml:"burst"`
+}
+
+type ConcurrencyLimitConfig struct {
+	Enable       bool `toml:"enable"`
+	InitialLimit int  `toml:"initial_limit"`
+	MinLimit     int  `toml:"min_limit"`
+	MaxLimit     int  `toml:"max_limit"`
+	// an rpc slower than this, or failing with DeadlineExceeded or
+	// ResourceExhausted, shrinks the limit
+	LatencyThresholdMs int `toml:"latency_threshold_ms"`
+	// limit multiplier on overload
+	BackoffRatio float64 `toml:"backoff_ratio"`
+	// one limit per method instead of one for the server
+	PerMethod bool `toml:"per_method"`
+}
+
+func (conf *ConcurrencyLimitConfig) setDefault() {
+	if conf.MinLimit <= 0 {
+		conf.MinLimit = 1
+	}
+	if conf.MaxLimit <= 0 {
+		conf.MaxLimit = 1000
+	}
+	if conf.InitialLimit <= 0 {
+		conf.InitialLimit = 20
+	}
+	if conf.InitialLimit < conf.MinLimit {
+		conf.InitialLimit = conf.MinLimit
+	}
+	if conf.InitialLimit > conf.MaxLimit {
+		conf.InitialLimit = conf.MaxLimit
+	}
+	if conf.LatencyThresholdMs <= 0 {
+		conf.LatencyThresholdMs = 500
+	}
+	if conf.BackoffRatio <= 0 || conf.BackoffRatio >= 1 {
+		conf.BackoffRatio = 0.9
+	}
+}
+
+type LimitConfig struct {
+	RateLimits []RateLimit `toml:"rate_limits"`
+	// max buckets kept for the "*" limits, 10000 when not set, the values
+	// beyond share one bucket per limit. the buckets idle long enough to be
+	// full again are dropped
+	MaxBuckets  int                    `toml:"max_buckets"`
+	Concurrency ConcurrencyLimitConfig `toml:"concurrency"`
+}
+
+const (
+	defaultMaxBuckets = 10000
+	// min period of the sweeps of the idle buckets
+	bucketSweepInterval = time.Second
+	overflowBucketKey   = "_overflow"
+	// the latency released with by the rpcs not sampled, i.e. the streams
+	noLatencySample = time.Duration(-1)
+)
+
+// OptLimit rejects the rpcs over the limits of conf, the limits apply once the
+// caller is parsed and before the OptChain interceptors
+func OptLimit(conf LimitConfig) GrpcInterceptorOpt {
+	l := newLimiter(conf)
+	return func(opts *grpcInterceptorOptions) {
+		opts.limiter = l
+		xlog.Info("limiter registered||rate_limits=%v||concurrency=%+v", len(conf.RateLimits), conf.Concurrency)
+	}
+}
+
+type limiter struct {
+	rateLimits []RateLimit
+	maxBuckets int
+	bucketsMtx *sync.Mutex
+	buckets    map[string]*tokenBucket
+	lastSweep  time.Time
+	conc       *ConcurrencyLimitConfig
+	concMtx    *sync.Mutex
+	concMap    map[string]*aimdLimit
+}
+
+func newLimiter(conf LimitConfig) *limiter {
+	if conf.MaxBuckets <= 0 {
+		conf.MaxBuckets = defaultMaxBuckets
+	}
+	l := &limiter{
+		rateLimits: conf.RateLimits,
+		maxBuckets: conf.MaxBuckets,
+		bucketsMtx: &sync.Mutex{},
+		buckets:    map[string]*tokenBucket{},
+		concMtx:    &sync.Mutex{},
+		concMap:    map[string]*aimdLimit{},
+	}
+	if conf.Concurrency.Enable {
+		conc := conf.Concurrency
+		conc.setDefault()
+		l.conc = &conc
+	}
+	return l
+}
+
+func matchLimitKey(pattern, value string) (key string, ok bool) {
+	switch pattern {
+	case "":
+		return "", true
+	case "*":
+		return value, true
+	}
+	return value, pattern == value
+}
+
+// acquire returns the release func to call once the rpc is done, err is
+// errRateLimited or errConcurrencyLimited when rejected, the tokens taken are
+// given back then
+func (l *limiter) acquire(method, caller string) (release func(latency time.Duration, err error), err error) {
+	taken := []*tokenBucket{}
+	refund := func() {
+		for _, b := range taken {
+			b.refund()
+		}
+	}
+	for idx, rl := range l.rateLimits {
+		methodKey, ok := matchLimitKey(rl.Method, method)
+		if !ok {
+			continue
+		}
+		callerKey, ok := matchLimitKey(rl.Caller, caller)
+		if !ok {
+			continue
+		}
+		b := l.bucket(idx, rl, methodKey, callerKey)
+		if !b.take() {
+			refund()
+			xlog.Warn("_grpc_limit||rate limited||method=%v||caller=%v||rate=%v", method, caller, rl.Rate)
+			return nil, errRateLimited
+		}
+		taken = append(taken, b)
+	}
+
+	if l.conc == nil {
+		return func(time.Duration, error) {}, nil
+	}
+	limit := l.concLimit(method)
+	if !limit.acquire() {
+		refund()
+		xlog.Warn("_grpc_limit||concurrency limited||method=%v||caller=%v||limit=%v", method, caller, limit.current())
+		return nil, errConcurrencyLimited
+	}
+	return limit.release, nil
+}
+
+// bucket returns the bucket of the keys for the limit idx, the one shared by
+// the overflowing values once maxBuckets are kept
+func (l *limiter) bucket(idx int, rl RateLimit, methodKey, callerKey string) *tokenBucket {
+	key := fmt.Sprintf("%v|%v|%v", idx, methodKey, callerKey)
+	l.bucketsMtx.Lock()
+	defer l.bucketsMtx.Unlock()
+	if b, ok := l.buckets[key]; ok {
+		return b
+	}
+	if len(l.buckets) >= l.maxBuckets {
+		l.sweepLocked()
+	}
+	if len(l.buckets) >= l.maxBuckets {
+		key = fmt.Sprintf("%v|%v|%v", idx, methodKey, overflowBucketKey)
+		if b, ok := l.buckets[key]; ok {
+			return b
+		}
+	}
+	b := newTokenBucket(rl.Rate, rl.Burst)
+	l.buckets[key] = b
+	return b
+}
+
+// sweepLocked drops the full buckets, a new one would be the same, at most
+// once per bucketSweepInterval
+func (l *limiter) sweepLocked() {
+	now := time.Now()
+	if now.Sub(l.lastSweep) < bucketSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+	xlog.Debug("_grpc_limit||buckets swept||left=%v", len(l.buckets))
+}
+
+func (l *limiter) concLimit(method string) *aimdLimit {
+	key := ""
+	if l.conc.PerMethod {
+		key = method
+	}
+	l.concMtx.Lock()
+	defer l.concMtx.Unlock()
+	limit, ok := l.concMap[key]
+	if !ok {
+		limit = newAimdLimit(*l.conc)
+		l.concMap[key] = limit
+	}
+	return limit
+}
+
+type tokenBucket struct {
+	mtx    *sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	lastTs time.Time
+	now    func() time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return &tokenBucket{
+		mtx:    &sync.Mutex{},
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		lastTs: time.Now(),
+		now:    time.Now,
+	}
+}
+
+func (b *tokenBucket) take() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	now := b.now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.lastTs).Seconds()*b.rate)
+	b.lastTs = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refund gives back the token of a take
+func (b *tokenBucket) refund() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+// full tells if the bucket refilled to its burst by now
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.tokens+now.Sub(b.lastTs).Seconds()*b.rate >= b.burst
+}
+
+// aimdLimit grows the limit by one per limit rpcs done in time while it is
+// used at least by half, and shrinks it by BackoffRatio on every overload
+type aimdLimit struct {
+	conf     ConcurrencyLimitConfig
+	mtx      *sync.Mutex
+	limit    float64
+	inflight int
+}
+
+func newAimdLimit(conf ConcurrencyLimitConfig) *aimdLimit {
+	return &aimdLimit{
+		conf:  conf,
+		mtx:   &sync.Mutex{},
+		limit: float64(conf.InitialLimit),
+	}
+}
+
+func (a *aimdLimit) current() int {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return int(a.limit)
+}
+
+func (a *aimdLimit) acquire() bool {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.inflight >= int(a.limit) {
+		return false
+	}
+	a.inflight++
+	return true
+}
+
+// release ends an rpc, the limit is adjusted unless latency is noLatencySample
+func (a *aimdLimit) release(latency time.Duration, err error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	inflight := a.inflight
+	a.inflight--
+	if latency == noLatencySample {
+		return
+	}
+
+	code := status.Code(err)
+	if latency > time.Duration(a.conf.LatencyThresholdMs)*time.Millisecond ||
+		code == codes.DeadlineExceeded ||
+		code == codes.ResourceExhausted {
+		a.limit = math.Max(float64(a.conf.MinLimit), a.limit*a.conf.BackoffRatio)
+		return
+	}
+	if float64(inflight)*2 >= a.limit {
+		a.limit = math.Min(float64(a.conf.MaxLimit), a.limit+1/a.limit)
+	}
+}
@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xutils/lib-common/clients"
+	"github.com/xutils/lib-common/metrics"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func callerCtx(caller string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.New(map[string]string{
+		clients.HEADER_CALLER: caller,
+	}))
+}
+
+func TestRateLimit(t *testing.T) {
+	m := &metrics.MetricsBase{}
+	InitRpcMetrics(m, "unitTestRateLimit")
+	interceptor := GrpcInterceptor(*m, OptLimit(LimitConfig{
+		RateLimits: []RateLimit{
+			// 2 per caller
+			{Method: "Limited", Caller: "*", Rate: 0.001, Burst: 2},
+		},
+	}))
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	info := &grpc.UnaryServerInfo{FullMethod: "/test.Svr/Limited"}
+
+	for i := 0; i < 2; i++ {
+		_, err := interceptor(callerCtx("a"), nil, info, handler)
+		assert.Nil(t, err)
+	}
+	_, err := interceptor(callerCtx("a"), nil, info, handler)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, float64(1), testutil.ToFloat64(
+		m.GetTimeoutMetricsCounter().WithLabelValues("Limited", ERR_RATE_LIMITED, "a")))
+
+	// other callers and methods have their own buckets
+	_, err = interceptor(callerCtx("b"), nil, info, handler)
+	assert.Nil(t, err)
+	_, err = interceptor(callerCtx("a"), nil, &grpc.UnaryServerInfo{FullMethod: "/test.Svr/Other"}, handler)
+	assert.Nil(t, err)
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	m := &metrics.MetricsBase{}
+	InitRpcMetrics(m, "unitTestConcLimit")
+	interceptor := GrpcInterceptor(*m, OptLimit(LimitConfig{
+		Concurrency: ConcurrencyLimitConfig{Enable: true, InitialLimit: 1, MaxLimit: 1},
+	}))
+	info := &grpc.UnaryServerInfo{FullMethod: "/test.Svr/Slow"}
+
+	started, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		_, _ = interceptor(callerCtx("a"), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			close(started)
+			<-done
+			return nil, nil
+		})
+	}()
+	<-started
+	_, err := interceptor(callerCtx("a"), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, float64(1), testutil.ToFloat64(
+		m.GetTimeoutMetricsCounter().WithLabelValues("Slow", ERR_CONCURRENCY_LIMITED, "a")))
+
+	close(done)
+	time.Sleep(time.Millisecond * 10)
+	_, err = interceptor(callerCtx("a"), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	assert.Nil(t, err)
+}
+
+func TestRateLimitBuckets(t *testing.T) {
+	// the values beyond the cap share a bucket
+	l := newLimiter(LimitConfig{
+		MaxBuckets: 2,
+		RateLimits: []RateLimit{{Method: "Limited", Caller: "*", Rate: 0.001, Burst: 1}},
+	})
+	for _, caller := range []string{"a", "b", "c"} {
+		_, err := l.acquire("Limited", caller)
+		assert.Nil(t, err, caller)
+	}
+	_, err := l.acquire("Limited", "d")
+	assert.Equal(t, errRateLimited, err)
+	assert.Equal(t, 3, len(l.buckets))
+
+	// the idle buckets are full again and dropped
+	l = newLimiter(LimitConfig{
+		MaxBuckets: 2,
+		RateLimits: []RateLimit{{Method: "Limited", Caller: "*", Rate: 1000, Burst: 1}},
+	})
+	for _, caller := range []string{"a", "b"} {
+		_, err = l.acquire("Limited", caller)
+		assert.Nil(t, err)
+	}
+	time.Sleep(time.Millisecond * 5)
+	_, err = l.acquire("Limited", "c")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(l.buckets))
+	_, ok := l.buckets["0|Limited|c"]
+	assert.True(t, ok)
+}
+
+func TestRateLimitRefund(t *testing.T) {
+	l := newLimiter(LimitConfig{
+		RateLimits: []RateLimit{
+			{Rate: 0.001, Burst: 10},
+			{Method: "Limited", Caller: "*", Rate: 0.001, Burst: 1},
+		},
+	})
+	_, err := l.acquire("Limited", "a")
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = l.acquire("Limited", "a")
+		assert.Equal(t, errRateLimited, err)
+	}
+	// only the rpc let through took a token of the shared bucket
+	assert.InDelta(t, 9, l.buckets["0||"].tokens, 0.01)
+}
+
+func TestRateLimitAuthenticatedCaller(t *testing.T) {
+	m := &metrics.MetricsBase{}
+	InitRpcMetrics(m, "unitTestLimitAuth")
+	interceptor := GrpcInterceptor(*m,
+		OptAuth(AuthConfig{HmacSecrets: map[string]string{"svr_a": "secret_a"}}),
+		OptLimit(LimitConfig{
+			RateLimits: []RateLimit{{Method: "Limited", Caller: "*", Rate: 0.001, Burst: 1}},
+		}))
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	info := &grpc.UnaryServerInfo{FullMethod: "/test.Svr/Limited"}
+	token := clients.HmacToken("svr_a", "secret_a", time.Now())
+
+	_, err := interceptor(authCtx("", token), nil, info, handler)
+	assert.Nil(t, err)
+	// another caller header does not get another bucket
+	_, err = interceptor(authCtx("svr_b", token), nil, info, handler)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = interceptor(authCtx("", token), nil, info, handler)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
@@ -67,6 +67,7 @@ func NewHttpStub(ctx context.Context, listen string, grpcListen string) (err err
 
 	httpOpts := []runtime.ServeMuxOption{
 		middleware.HttpMarshalerServerMuxOption(),
+		middleware.HttpErrorHandlerServerMuxOption(),
 		middleware.TracedIncomingHeaderMatcherMuxOption(),
 	}
 	mux := runtime.NewServeMux(httpOpts...)
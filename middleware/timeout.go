@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/xutils/lib-common/xlog"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TimeoutConfig sets the max time an unary rpc is served, the deadline sent by
+// the caller applies if shorter. timed out rpcs are counted with the err
+// ERR_DEADLINE_EXCEEDED
+type TimeoutConfig struct {
+	// for the methods not in Methods, 0 for no timeout
+	DefaultMs int `toml:"default_ms"`
+	// by short method name
+	Methods map[string]int `toml:"methods"`
+}
+
+func (conf *TimeoutConfig) of(method string) time.Duration {
+	if conf == nil {
+		return 0
+	}
+	if ms, ok := conf.Methods[method]; ok {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return time.Duration(conf.DefaultMs) * time.Millisecond
+}
+
+// OptTimeout enforces per method timeouts, streams are not concerned
+func OptTimeout(conf TimeoutConfig) GrpcInterceptorOpt {
+	return func(opts *grpcInterceptorOptions) {
+		opts.timeouts = &conf
+		xlog.Info("timeouts registered||default_ms=%v||methods=%v", conf.DefaultMs, conf.Methods)
+	}
+}
+
+type handlerResult struct {
+	rsp   interface{}
+	err   error
+	panic interface{}
+	stack []byte
+}
+
+// runWithTimeout returns as soon as ctx is done, the handler is left running
+// in the background until it notices ctx and its rsp is dropped
+func runWithTimeout(ctx context.Context, req interface{}, handler grpc.UnaryHandler) (interface{}, error) {
+	done := make(chan handlerResult, 1)
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				done <- handlerResult{panic: e, stack: debug.Stack()}
+			}
+		}()
+		rsp, err := handler(ctx, req)
+		done <- handlerResult{rsp: rsp, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.panic != nil {
+			// raised again for the recovery of the interceptor
+			panic(fmt.Sprintf("%v\n%s", r.panic, r.stack))
+		}
+		return r.rsp, r.err
+	case <-ctx.Done():
+		if ctx.Err() == context.Canceled {
+			return nil, status.Error(codes.Canceled, ctx.Err().Error())
+		}
+		return nil, status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+	}
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xutils/lib-common/clients"
+	"github.com/xutils/lib-common/metrics"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTimeout(t *testing.T) {
+	m := &metrics.MetricsBase{}
+	InitRpcMetrics(m, "unitTestTimeout")
+	interceptor := GrpcInterceptor(*m, OptTimeout(TimeoutConfig{
+		DefaultMs: 1000,
+		Methods:   map[string]int{"Slow": 50},
+	}))
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+			return "rsp", nil
+		}
+	}
+
+	// per method timeout
+	t0 := time.Now()
+	_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/test.Svr/Slow"}, handler)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.True(t, time.Since(t0) < 150*time.Millisecond)
+	assert.Equal(t, float64(1), testutil.ToFloat64(
+		m.GetTimeoutMetricsCounter().WithLabelValues("Slow", ERR_DEADLINE_EXCEEDED, "")))
+
+	// default timeout
+	rsp, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/test.Svr/Other"}, handler)
+	assert.Nil(t, err)
+	assert.Equal(t, "rsp", rsp)
+	assert.Equal(t, float64(1), testutil.ToFloat64(
+		m.GetTimeoutMetricsCounter().WithLabelValues("Other", clients.ERR_SUCC, "")))
+
+	// the shorter deadline of the caller is kept
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/test.Svr/Other"}, handler)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	// panics of the handler are still recovered
+	_, err = interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/test.Svr/Panic"},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			panic(errors.New("boom"))
+		})
+	assert.NotNil(t, err)
+}
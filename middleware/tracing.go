@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"context"
+
+	"github.com/xutils/lib-common/tracing"
+)
+
+// startServerSpan starts the span of an rpc, child of the traceparent of the
+// incoming md, e.g. the one of a client span or of DefaultHttpWrapper
+func startServerSpan(ctx context.Context, fullMethod string) (context.Context, *tracing.Span) {
+	parent, _ := tracing.ExtractIncoming(ctx)
+	ctx, span := tracing.StartRemoteSpan(ctx, parent, fullMethod, tracing.SpanKindServer)
+	if span.IsRecording() {
+		span.SetAttribute(tracing.AttrRpcSystem, "grpc")
+		span.SetAttribute(tracing.AttrRpcMethod, fullMethod)
+	}
+	return ctx, span
+}
+
+func endServerSpan(span *tracing.Span, logId, caller string, err error) {
+	if span.IsRecording() {
+		span.SetAttribute(tracing.AttrLogId, logId)
+		span.SetAttribute(tracing.AttrCaller, caller)
+		if err == nil {
+			span.SetAttribute(tracing.AttrGrpcStatusCode, 0)
+		}
+	}
+	span.Finish(err)
+}
@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xutils/lib-common/clients"
+	"github.com/xutils/lib-common/metrics"
+	"github.com/xutils/lib-common/tracing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestServerSpans(t *testing.T) {
+	exporter := tracing.NewInMemoryExporter()
+	defer tracing.SetTracer(tracing.DefaultTracer())
+	tracing.SetTracer(tracing.NewTracer("test", tracing.ParentBased(tracing.AlwaysSample()), exporter))
+
+	m := &metrics.MetricsBase{}
+	InitRpcMetrics(m, "unitTestServerSpans")
+	interceptor := GrpcInterceptor(*m)
+	info := &grpc.UnaryServerInfo{FullMethod: "/test.Svr/Get"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		_, span := tracing.StartSpan(ctx, "db", tracing.SpanKindClient)
+		span.End()
+		return nil, status.Error(codes.NotFound, "no such order")
+	}
+
+	// through the gateway, the span of the request is the parent of the one of the rpc
+	mux := runtime.NewServeMux(TracedIncomingHeaderMatcherMuxOption())
+	wrapper := DefaultHttpWrapper(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := runtime.AnnotateIncomingContext(r.Context(), mux, r)
+		assert.Nil(t, err)
+		_, err = interceptor(ctx, nil, info, handler)
+		assert.Equal(t, codes.NotFound, status.Code(err))
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/v1/orders/1", nil)
+	r.Header.Set(clients.HEADER_TRACEPARENT, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	wrapper.ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := exporter.Spans()
+	assert.Equal(t, 3, len(spans))
+	db, rpc, req := spans[0], spans[1], spans[2]
+	for _, span := range spans {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.Context.TraceID.String())
+	}
+	assert.Equal(t, "00f067aa0ba902b7", req.ParentID.String())
+	assert.Equal(t, req.Context.SpanID, rpc.ParentID)
+	assert.Equal(t, rpc.Context.SpanID, db.ParentID)
+
+	assert.Equal(t, "HTTP GET", req.Name)
+	assert.Equal(t, tracing.SpanKindServer, req.Kind)
+	assert.Equal(t, http.StatusNotFound, req.Attributes[tracing.AttrHttpStatusCode])
+	assert.Equal(t, "/v1/orders/1", req.Attributes[tracing.AttrHttpRoute])
+	assert.Equal(t, "", req.Err)
+
+	assert.Equal(t, "/test.Svr/Get", rpc.Name)
+	assert.Equal(t, tracing.SpanKindServer, rpc.Kind)
+	assert.Equal(t, int(codes.NotFound), rpc.Attributes[tracing.AttrGrpcStatusCode])
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", rpc.Attributes[tracing.AttrLogId])
+	assert.Equal(t, "rpc error: code = NotFound desc = no such order", rpc.Err)
+
+	// a root span without traceparent, not sampled ones are not exported
+	exporter.Reset()
+	_, err := interceptor(context.Background(), nil, info, handler)
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, len(exporter.Spans()))
+	assert.False(t, exporter.Spans()[1].ParentID.IsValid())
+	exporter.Reset()
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		clients.HEADER_TRACEPARENT, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"))
+	_, err = interceptor(ctx, nil, info, handler)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, len(exporter.Spans()))
+}
@@ -0,0 +1,15 @@
+package middleware
+
+import (
+	"github.com/xutils/lib-common/xlog"
+)
+
+// OptValidate checks the unary requests with validate.Check once the limits
+// passed, invalid ones get codes.InvalidArgument with an errdetails.BadRequest
+// detail. with OptEnsureError a rsp with its Error filled is returned instead
+func OptValidate() GrpcInterceptorOpt {
+	return func(opts *grpcInterceptorOptions) {
+		opts.validate = true
+		xlog.Info("request validation registered")
+	}
+}
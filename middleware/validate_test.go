@@ -0,0 +1,154 @@
+package middleware
+
+import (
+	"context"
+	stdjson "encoding/json"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/xutils/lib-common/clients"
+	"github.com/xutils/lib-common/metrics"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type validatedReq struct {
+	Name string
+}
+
+func (r *validatedReq) Validate() error {
+	if r.Name == "" {
+		return errors.New("name required")
+	}
+	return nil
+}
+
+type validatedError struct {
+	Code    int64
+	Message string
+}
+
+func (e *validatedError) GetCode() int64     { return e.Code }
+func (e *validatedError) GetMessage() string { return e.Message }
+
+type validatedRsp struct {
+	Error *validatedError
+}
+
+type validatedServer struct{}
+
+func (s *validatedServer) Create(ctx context.Context, req *validatedReq) (*validatedRsp, error) {
+	return &validatedRsp{}, nil
+}
+
+func TestValidate(t *testing.T) {
+	m := &metrics.MetricsBase{}
+	InitRpcMetrics(m, "unitTestValidate")
+	called := 0
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		called++
+		return &validatedRsp{}, nil
+	}
+	info := &grpc.UnaryServerInfo{Server: &validatedServer{}, FullMethod: "/test.Svr/Create"}
+
+	interceptor := GrpcInterceptor(*m, OptValidate())
+	_, err := interceptor(context.Background(), &validatedReq{Name: "a"}, info, handler)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, called)
+
+	rsp, err := interceptor(context.Background(), &validatedReq{}, info, handler)
+	assert.Nil(t, rsp)
+	assert.Equal(t, 1, called)
+	st := status.Convert(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	assert.Equal(t, 1, len(st.Details()))
+	assert.Equal(t, "name required", st.Details()[0].(*errdetails.BadRequest).FieldViolations[0].Description)
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.GetTimeoutMetricsCounter().WithLabelValues("Create", clients.ERR_ERR, "")))
+
+	// the Error of the rsp is filled with OptEnsureError
+	m2 := &metrics.MetricsBase{}
+	InitRpcMetrics(m2, "unitTestValidateEnsureError")
+	interceptor = GrpcInterceptor(*m2, OptValidate(),
+		OptEnsureError(func(req reflect.Type) ErrorIface {
+			return &validatedError{}
+		}))
+	rsp, err = interceptor(context.Background(), &validatedReq{}, info, handler)
+	assert.Nil(t, err)
+	assert.Equal(t, &validatedRsp{Error: &validatedError{
+		Code:    int64(codes.InvalidArgument),
+		Message: "invalid argument: name required",
+	}}, rsp)
+}
+
+// jsonCodec lets the plain structs of the tests go through a grpc conn
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return stdjson.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return stdjson.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return "json" }
+
+func TestEnsureErrorClient(t *testing.T) {
+	m := &metrics.MetricsBase{}
+	InitRpcMetrics(m, "unitTestEnsureErrorClient")
+	interceptor := GrpcInterceptor(*m, OptValidate(),
+		OptEnsureError(func(req reflect.Type) ErrorIface {
+			return &validatedError{}
+		}))
+	svr := grpc.NewServer(grpc.ForceServerCodec(jsonCodec{}), grpc.UnaryInterceptor(interceptor))
+	svr.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.Svr",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Create",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &validatedReq{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/test.Svr/Create"}
+				return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					if req.(*validatedReq).Name == "fail" {
+						return nil, status.Error(codes.NotFound, "no such order")
+					}
+					return srv.(*validatedServer).Create(ctx, req.(*validatedReq))
+				})
+			},
+		}},
+	}, &validatedServer{})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go svr.Serve(lis)
+	defer svr.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure(),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(jsonCodec{})))
+	assert.Nil(t, err)
+	defer conn.Close()
+	call := func(name string) (*validatedRsp, error) {
+		rsp := &validatedRsp{}
+		err := conn.Invoke(context.Background(), "/test.Svr/Create", &validatedReq{Name: name}, rsp)
+		return rsp, err
+	}
+
+	// the client gets the Error of the rsp, for invalid reqs and failed handlers
+	rsp, err := call("")
+	assert.Nil(t, err)
+	assert.Equal(t, &validatedError{
+		Code:    int64(codes.InvalidArgument),
+		Message: "invalid argument: name required",
+	}, rsp.Error)
+	rsp, err = call("fail")
+	assert.Nil(t, err)
+	assert.Equal(t, &validatedError{Code: int64(codes.NotFound), Message: "no such order"}, rsp.Error)
+	rsp, err = call("a")
+	assert.Nil(t, err)
+	assert.Equal(t, &validatedError{}, rsp.Error)
+}
@@ -0,0 +1,208 @@
+package tracing
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+// Exporter is handed the recorded spans once ended
+type Exporter interface {
+	ExportSpans(spans []*Span) error
+	Shutdown() error
+}
+
+/** ### IN MEMORY */
+
+// InMemoryExporter keeps the spans, for the tests
+type InMemoryExporter struct {
+	mtx   *sync.Mutex
+	spans []*Span
+}
+
+func NewInMemoryExporter() *InMemoryExporter {
+	return &InMemoryExporter{mtx: &sync.Mutex{}}
+}
+
+func (e *InMemoryExporter) ExportSpans(spans []*Span) error {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *InMemoryExporter) Shutdown() error {
+	return nil
+}
+
+// Spans returns the spans exported so far, in the order they ended
+func (e *InMemoryExporter) Spans() []*Span {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return append([]*Span{}, e.spans...)
+}
+
+func (e *InMemoryExporter) Reset() {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.spans = nil
+}
+
+/** ### FILE */
+
+// FileExporter appends the spans to a file, a line of otlp json, i.e. an
+// ExportTraceServiceRequest, per export, as read by the file receiver of the
+// otel collector
+type FileExporter struct {
+	mtx         *sync.Mutex
+	file        *os.File
+	serviceName string
+}
+
+func NewFileExporter(path string, serviceName string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{
+		mtx:         &sync.Mutex{},
+		file:        file,
+		serviceName: serviceName,
+	}, nil
+}
+
+func (e *FileExporter) ExportSpans(spans []*Span) error {
+	data, err := json.Marshal(otlpRequest(e.serviceName, spans))
+	if err != nil {
+		return err
+	}
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	_, err = e.file.Write(append(data, '\n'))
+	return err
+}
+
+func (e *FileExporter) Shutdown() error {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return e.file.Close()
+}
+
+/** ### OTLP JSON */
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	// 2 for error
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string         `json:"traceId"`
+	SpanId            string         `json:"spanId"`
+	ParentSpanId      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+const otlpStatusError = 2
+
+func otlpAttribute(key string, value interface{}) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	switch v := value.(type) {
+	case string:
+		kv.Value.StringValue = &v
+	case bool:
+		kv.Value.BoolValue = &v
+	case int:
+		s := strconv.FormatInt(int64(v), 10)
+		kv.Value.IntValue = &s
+	case int32:
+		s := strconv.FormatInt(int64(v), 10)
+		kv.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &s
+	case float32:
+		f := float64(v)
+		kv.Value.DoubleValue = &f
+	case float64:
+		kv.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
+
+func otlpRequest(serviceName string, spans []*Span) *otlpExportRequest {
+	scope := otlpScopeSpans{}
+	scope.Scope.Name = "github.com/xutils/lib-common/tracing"
+	for _, span := range spans {
+		s := otlpSpan{
+			TraceId:           span.Context.TraceID.String(),
+			SpanId:            span.Context.SpanID.String(),
+			Name:              span.Name,
+			Kind:              int(span.Kind),
+			StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+		}
+		if span.ParentID.IsValid() {
+			s.ParentSpanId = span.ParentID.String()
+		}
+		keys := make([]string, 0, len(span.Attributes))
+		for key := range span.Attributes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s.Attributes = append(s.Attributes, otlpAttribute(key, span.Attributes[key]))
+		}
+		if span.Err != "" {
+			s.Status = otlpStatus{Code: otlpStatusError, Message: span.Err}
+		}
+		scope.Spans = append(scope.Spans, s)
+	}
+	resource := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resource.Resource.Attributes = []otlpKeyValue{otlpAttribute("service.name", serviceName)}
+	return &otlpExportRequest{ResourceSpans: []otlpResourceSpans{resource}}
+}
@@ -0,0 +1,104 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+/**
+####################################################################################
+PROPAGATION
+w3c traceparent, version-traceid-parentid-flags, over http headers, grpc md
+and kafka headers
+*/
+
+const (
+	HEADER_TRACEPARENT = "traceparent"
+
+	traceparentVersion = "00"
+	flagSampled        = 0x01
+)
+
+// Traceparent returns the traceparent header of sc
+func (sc SpanContext) Traceparent() string {
+	flags := 0
+	if sc.Sampled {
+		flags = flagSampled
+	}
+	return fmt.Sprintf("%v-%v-%v-%02x", traceparentVersion, sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent returns the span context of a traceparent header, ok false
+// for the invalid ones
+func ParseTraceparent(s string) (sc SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	// later versions may append fields
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		(parts[0] == traceparentVersion && len(parts) != 4) {
+		return
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	var version, flags [1]byte
+	if !decodeLowerHex(version[:], parts[0]) || !decodeLowerHex(sc.TraceID[:], parts[1]) ||
+		!decodeLowerHex(sc.SpanID[:], parts[2]) || !decodeLowerHex(flags[:], parts[3]) {
+		return SpanContext{}, false
+	}
+	if !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&flagSampled != 0
+	return sc, true
+}
+
+func decodeLowerHex(dst []byte, s string) bool {
+	if strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+// InjectHTTP sets the traceparent of the span of ctx in header, if any
+func InjectHTTP(ctx context.Context, header http.Header) {
+	if span := SpanFromContext(ctx); span != nil {
+		header.Set(HEADER_TRACEPARENT, span.Context.Traceparent())
+	}
+}
+
+// ExtractHTTP returns the span context of the traceparent of header
+func ExtractHTTP(header http.Header) (SpanContext, bool) {
+	return ParseTraceparent(header.Get(HEADER_TRACEPARENT))
+}
+
+// InjectOutgoing returns ctx with the traceparent of its span in the outgoing
+// md, replacing the one of the md of ctx, if any
+func InjectOutgoing(ctx context.Context) context.Context {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return ctx
+	}
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if !ok {
+		return metadata.AppendToOutgoingContext(ctx, HEADER_TRACEPARENT, span.Context.Traceparent())
+	}
+	md = md.Copy()
+	md.Set(HEADER_TRACEPARENT, span.Context.Traceparent())
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// ExtractIncoming returns the span context of the traceparent of the incoming
+// md of ctx
+func ExtractIncoming(ctx context.Context) (SpanContext, bool) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if vals := md.Get(HEADER_TRACEPARENT); len(vals) > 0 {
+		return ParseTraceparent(vals[0])
+	}
+	return SpanContext{}, false
+}
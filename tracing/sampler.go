@@ -0,0 +1,55 @@
+package tracing
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Sampler tells if the span of traceID, child of parent, is sampled, parent
+// is not valid for the root spans
+type Sampler interface {
+	ShouldSample(traceID TraceID, parent SpanContext) bool
+}
+
+type SamplerFunc func(traceID TraceID, parent SpanContext) bool
+
+func (f SamplerFunc) ShouldSample(traceID TraceID, parent SpanContext) bool {
+	return f(traceID, parent)
+}
+
+func AlwaysSample() Sampler {
+	return SamplerFunc(func(TraceID, SpanContext) bool {
+		return true
+	})
+}
+
+func NeverSample() Sampler {
+	return SamplerFunc(func(TraceID, SpanContext) bool {
+		return false
+	})
+}
+
+// RatioSample samples ratio of the traces, by their id so that the services
+// sampling the same ratio agree on a trace
+func RatioSample(ratio float64) Sampler {
+	if ratio >= 1 {
+		return AlwaysSample()
+	}
+	if ratio <= 0 {
+		return NeverSample()
+	}
+	bound := uint64(ratio * math.MaxUint64)
+	return SamplerFunc(func(traceID TraceID, _ SpanContext) bool {
+		return binary.BigEndian.Uint64(traceID[8:]) < bound
+	})
+}
+
+// ParentBased follows the decision of the parent, root samples the root spans
+func ParentBased(root Sampler) Sampler {
+	return SamplerFunc(func(traceID TraceID, parent SpanContext) bool {
+		if parent.IsValid() {
+			return parent.Sampled
+		}
+		return root.ShouldSample(traceID, parent)
+	})
+}
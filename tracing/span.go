@@ -0,0 +1,193 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/xutils/lib-common/xlog"
+
+	"google.golang.org/grpc/status"
+)
+
+/**
+####################################################################################
+SPANS
+spans of the w3c trace context model, the ones of the sampled traces are handed
+to the exporter of their tracer once ended, the others only carry the ids to
+the downstream services
+*/
+
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+func newTraceID() (id TraceID) {
+	for !id.IsValid() {
+		if _, err := rand.Read(id[:]); err != nil {
+			xlog.Error("_tracing||failed to gen trace id||err=%v", err)
+			return
+		}
+	}
+	return
+}
+
+func newSpanID() (id SpanID) {
+	for !id.IsValid() {
+		if _, err := rand.Read(id[:]); err != nil {
+			xlog.Error("_tracing||failed to gen span id||err=%v", err)
+			return
+		}
+	}
+	return
+}
+
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+type SpanKind int
+
+// the values of the otlp span kinds
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+	SpanKindProducer SpanKind = 4
+	SpanKindConsumer SpanKind = 5
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case SpanKindServer:
+		return "server"
+	case SpanKindClient:
+		return "client"
+	case SpanKindProducer:
+		return "producer"
+	case SpanKindConsumer:
+		return "consumer"
+	}
+	return "internal"
+}
+
+// Span is an operation of a trace, its fields are not to be changed but by
+// its methods, and only read once ended, e.g. by the exporters
+type Span struct {
+	Name      string
+	Kind      SpanKind
+	Context   SpanContext
+	ParentID  SpanID
+	StartTime time.Time
+	EndTime   time.Time
+	// nil when not recording
+	Attributes map[string]interface{}
+	// message of the err the span ended with, empty when succeeded
+	Err string
+
+	mtx       *sync.Mutex
+	tracer    *Tracer
+	recording bool
+	ended     bool
+}
+
+// IsRecording tells if s is sampled and exported, the attributes and errs of
+// the others are dropped
+func (s *Span) IsRecording() bool {
+	return s != nil && s.recording
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if !s.IsRecording() {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if !s.ended {
+		s.Attributes[key] = value
+	}
+}
+
+// SetError marks s failed with err, and sets the grpc code of err for the ones
+// having a grpc status
+func (s *Span) SetError(err error) {
+	if err == nil || !s.IsRecording() {
+		return
+	}
+	if st, ok := status.FromError(err); ok {
+		s.SetAttribute(AttrGrpcStatusCode, int(st.Code()))
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if !s.ended {
+		s.Err = err.Error()
+	}
+}
+
+// End ends s and exports it when recording, only the first call counts
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	if s.ended {
+		s.mtx.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mtx.Unlock()
+	if s.recording {
+		s.tracer.export(s)
+	}
+}
+
+// Finish is SetError and End
+func (s *Span) Finish(err error) {
+	s.SetError(err)
+	s.End()
+}
+
+// attribute keys of the otel semantic conventions
+const (
+	AttrRpcSystem      = "rpc.system"
+	AttrRpcService     = "rpc.service"
+	AttrRpcMethod      = "rpc.method"
+	AttrGrpcStatusCode = "rpc.grpc.status_code"
+	AttrHttpMethod     = "http.method"
+	AttrHttpUrl        = "http.url"
+	AttrHttpRoute      = "http.target"
+	AttrHttpStatusCode = "http.status_code"
+	AttrNetPeerName    = "net.peer.name"
+	AttrDbSystem       = "db.system"
+	AttrDbOperation    = "db.operation"
+	AttrDbTable        = "db.sql.table"
+	AttrMsgSystem      = "messaging.system"
+	AttrMsgDestination = "messaging.destination"
+	// not otel ones
+	AttrLogId  = "logid"
+	AttrCaller = "caller"
+)
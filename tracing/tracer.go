@@ -0,0 +1,149 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/xutils/lib-common/xlog"
+)
+
+/**
+####################################################################################
+TRACER
+starts the spans, samples the root ones and exports the recorded ones. the
+default tracer samples none but the children of sampled parents and exports
+nothing, so that the ids still reach the downstream services, see Init
+*/
+
+type Config struct {
+	// service.name of the exported spans
+	ServiceName string `toml:"service_name"`
+	// ratio of the root spans sampled, 0 to 1, the others follow their parent
+	SampleRatio float64 `toml:"sample_ratio"`
+	// file the spans are appended to as otlp json lines, none exported when empty
+	File string `toml:"file"`
+}
+
+type Tracer struct {
+	serviceName string
+	sampler     Sampler
+	exporter    Exporter
+}
+
+// NewTracer returns a tracer exporting the spans sampled by sampler to
+// exporter, nil for none
+func NewTracer(serviceName string, sampler Sampler, exporter Exporter) *Tracer {
+	return &Tracer{
+		serviceName: serviceName,
+		sampler:     sampler,
+		exporter:    exporter,
+	}
+}
+
+var (
+	tracerMtx     = &sync.RWMutex{}
+	defaultTracer = NewTracer("", ParentBased(NeverSample()), nil)
+)
+
+// SetTracer sets the tracer of StartSpan and StartRemoteSpan
+func SetTracer(t *Tracer) {
+	tracerMtx.Lock()
+	defer tracerMtx.Unlock()
+	defaultTracer = t
+}
+
+func DefaultTracer() *Tracer {
+	tracerMtx.RLock()
+	defer tracerMtx.RUnlock()
+	return defaultTracer
+}
+
+// Init sets the tracer of conf as the default one
+func Init(conf Config) (err error) {
+	var exporter Exporter
+	if conf.File != "" {
+		if exporter, err = NewFileExporter(conf.File, conf.ServiceName); err != nil {
+			xlog.Error("_tracing||failed to open file||file=%v||err=%v", conf.File, err)
+			return
+		}
+	}
+	SetTracer(NewTracer(conf.ServiceName, ParentBased(RatioSample(conf.SampleRatio)), exporter))
+	xlog.Info("_tracing||inited||service=%v||sample_ratio=%v||file=%v", conf.ServiceName, conf.SampleRatio, conf.File)
+	return
+}
+
+// Shutdown releases the exporter of the default tracer
+func Shutdown() error {
+	if exporter := DefaultTracer().exporter; exporter != nil {
+		return exporter.Shutdown()
+	}
+	return nil
+}
+
+type spanKey struct{}
+
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the span of ctx, nil for none
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// StartSpan starts a child of the span of ctx, a root span when none, and
+// returns it along with a ctx holding it
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	return DefaultTracer().Start(ctx, name, kind)
+}
+
+// StartRemoteSpan starts a child of parent, e.g. the one of a traceparent
+// header, a root span when parent is not valid
+func StartRemoteSpan(ctx context.Context, parent SpanContext, name string, kind SpanKind) (context.Context, *Span) {
+	return DefaultTracer().StartRemote(ctx, parent, name, kind)
+}
+
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	var parent SpanContext
+	if span := SpanFromContext(ctx); span != nil {
+		parent = span.Context
+	}
+	return t.StartRemote(ctx, parent, name, kind)
+}
+
+func (t *Tracer) StartRemote(ctx context.Context, parent SpanContext, name string, kind SpanKind) (context.Context, *Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	span := &Span{
+		Name:      name,
+		Kind:      kind,
+		StartTime: time.Now(),
+		mtx:       &sync.Mutex{},
+		tracer:    t,
+	}
+	if parent.IsValid() {
+		span.Context.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	} else {
+		span.Context.TraceID = newTraceID()
+	}
+	span.Context.SpanID = newSpanID()
+	span.Context.Sampled = t.sampler.ShouldSample(span.Context.TraceID, parent)
+	if span.Context.Sampled && t.exporter != nil {
+		span.recording = true
+		span.Attributes = map[string]interface{}{}
+	}
+	return ContextWithSpan(ctx, span), span
+}
+
+func (t *Tracer) export(span *Span) {
+	if err := t.exporter.ExportSpans([]*Span{span}); err != nil {
+		xlog.Error("_tracing||failed to export||span=%v||err=%v", span.Name, err)
+	}
+}
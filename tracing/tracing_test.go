@@ -0,0 +1,176 @@
+package tracing
+
+import (
+	"bufio"
+	"context"
+	stdjson "encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestTraceparent(t *testing.T) {
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(tp)
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, tp, sc.Traceparent())
+
+	sc, ok = ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.True(t, ok)
+	assert.False(t, sc.Sampled)
+
+	// later versions may have more fields
+	_, ok = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-xyz")
+	assert.True(t, ok)
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-xyz",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+	} {
+		_, ok = ParseTraceparent(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestSpans(t *testing.T) {
+	exporter := NewInMemoryExporter()
+	tracer := NewTracer("test", AlwaysSample(), exporter)
+
+	ctx, root := tracer.Start(context.Background(), "root", SpanKindServer)
+	assert.True(t, root.IsRecording())
+	assert.False(t, root.ParentID.IsValid())
+	_, child := tracer.Start(ctx, "child", SpanKindClient)
+	child.SetAttribute(AttrRpcMethod, "Get")
+	child.Finish(status.Error(codes.NotFound, "no such user"))
+	child.SetAttribute("after_end", true)
+	root.End()
+	root.End()
+
+	spans := exporter.Spans()
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, "child", spans[0].Name)
+	assert.Equal(t, root.Context.TraceID, spans[0].Context.TraceID)
+	assert.Equal(t, root.Context.SpanID, spans[0].ParentID)
+	assert.Equal(t, map[string]interface{}{
+		AttrRpcMethod:      "Get",
+		AttrGrpcStatusCode: int(codes.NotFound),
+	}, spans[0].Attributes)
+	assert.Equal(t, "rpc error: code = NotFound desc = no such user", spans[0].Err)
+	assert.Equal(t, "root", spans[1].Name)
+	assert.Equal(t, "", spans[1].Err)
+
+	// child of a remote parent, the sampling decision followed
+	exporter.Reset()
+	tracer = NewTracer("test", ParentBased(AlwaysSample()), exporter)
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, span := tracer.StartRemote(context.Background(), parent, "remote", SpanKindServer)
+	assert.False(t, span.IsRecording())
+	assert.Equal(t, parent.TraceID, span.Context.TraceID)
+	assert.Equal(t, parent.SpanID, span.ParentID)
+	span.SetAttribute("k", "v")
+	span.End()
+	assert.Equal(t, 0, len(exporter.Spans()))
+
+	// the ids are propagated without exporter
+	tracer = NewTracer("test", ParentBased(NeverSample()), nil)
+	parent.Sampled = true
+	_, span = tracer.StartRemote(context.Background(), parent, "remote", SpanKindServer)
+	assert.True(t, span.Context.Sampled)
+	assert.False(t, span.IsRecording())
+}
+
+func TestRatioSample(t *testing.T) {
+	sampler := RatioSample(0.25)
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		if sampler.ShouldSample(newTraceID(), SpanContext{}) {
+			sampled++
+		}
+	}
+	assert.InDelta(t, 2500, sampled, 300)
+	assert.False(t, RatioSample(0).ShouldSample(newTraceID(), SpanContext{}))
+	assert.True(t, RatioSample(1).ShouldSample(newTraceID(), SpanContext{}))
+}
+
+func TestPropagation(t *testing.T) {
+	tracer := NewTracer("test", AlwaysSample(), nil)
+	ctx, span := tracer.Start(context.Background(), "client", SpanKindClient)
+
+	header := http.Header{}
+	InjectHTTP(ctx, header)
+	sc, ok := ExtractHTTP(header)
+	assert.True(t, ok)
+	assert.Equal(t, span.Context, sc)
+
+	// the traceparent of the md is replaced
+	ctx = metadata.AppendToOutgoingContext(ctx, HEADER_TRACEPARENT, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	md, _ := metadata.FromOutgoingContext(InjectOutgoing(ctx))
+	assert.Equal(t, []string{span.Context.Traceparent()}, md.Get(HEADER_TRACEPARENT))
+	sc, ok = ExtractIncoming(metadata.NewIncomingContext(context.Background(), md))
+	assert.True(t, ok)
+	assert.Equal(t, span.Context, sc)
+}
+
+func TestFileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracing_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spans.json")
+	exporter, err := NewFileExporter(path, "test_svr")
+	assert.Nil(t, err)
+	tracer := NewTracer("test_svr", AlwaysSample(), exporter)
+
+	ctx, root := tracer.Start(context.Background(), "root", SpanKindServer)
+	_, child := tracer.Start(ctx, "child", SpanKindClient)
+	child.SetAttribute(AttrHttpStatusCode, 404)
+	child.SetAttribute(AttrHttpMethod, "GET")
+	child.Finish(status.Error(codes.NotFound, "not found"))
+	root.End()
+	assert.Nil(t, exporter.Shutdown())
+
+	file, err := os.Open(path)
+	assert.Nil(t, err)
+	defer file.Close()
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := map[string]interface{}{}
+		assert.Nil(t, stdjson.Unmarshal(scanner.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	assert.Equal(t, 2, len(lines))
+
+	resource := lines[0]["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"key":   "service.name",
+		"value": map[string]interface{}{"stringValue": "test_svr"},
+	}}, resource["resource"].(map[string]interface{})["attributes"])
+	span := resource["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "child", span["name"])
+	assert.Equal(t, float64(SpanKindClient), span["kind"])
+	assert.Equal(t, root.Context.TraceID.String(), span["traceId"])
+	assert.Equal(t, root.Context.SpanID.String(), span["parentSpanId"])
+	assert.Equal(t, map[string]interface{}{"code": float64(2), "message": "rpc error: code = NotFound desc = not found"}, span["status"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"key": AttrHttpMethod, "value": map[string]interface{}{"stringValue": "GET"}},
+		map[string]interface{}{"key": AttrHttpStatusCode, "value": map[string]interface{}{"intValue": "404"}},
+		map[string]interface{}{"key": AttrGrpcStatusCode, "value": map[string]interface{}{"intValue": "5"}},
+	}, span["attributes"])
+}
@@ -0,0 +1,242 @@
+package validate
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	protoV1 "github.com/golang/protobuf/proto"
+
+	"github.com/xutils/lib-common/xlog"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Error lists the field violations of a message, its grpc status is
+// InvalidArgument with an errdetails.BadRequest detail
+type Error struct {
+	Violations []*errdetails.BadRequest_FieldViolation
+}
+
+func (e *Error) Error() string {
+	descs := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		if v.Field == "" {
+			descs = append(descs, v.Description)
+			continue
+		}
+		descs = append(descs, fmt.Sprintf("%v: %v", v.Field, v.Description))
+	}
+	return "invalid argument: " + strings.Join(descs, "; ")
+}
+
+func (e *Error) GRPCStatus() *status.Status {
+	st := status.New(codes.InvalidArgument, e.Error())
+	withDetails, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: e.Violations})
+	if err != nil {
+		return st
+	}
+	return withDetails
+}
+
+func (e *Error) add(field, format string, args ...interface{}) {
+	e.Violations = append(e.Violations, &errdetails.BadRequest_FieldViolation{
+		Field:       field,
+		Description: fmt.Sprintf(format, args...),
+	})
+}
+
+type validator interface {
+	Validate() error
+}
+
+// Check validates req with its Validate method if any, with the rules of its
+// fields otherwise. the err returned has the status InvalidArgument unless
+// Validate returned a grpc status of its own
+func Check(req interface{}) error {
+	if v, ok := req.(validator); ok {
+		err := v.Validate()
+		if err == nil {
+			return nil
+		}
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		e := &Error{}
+		e.add("", "%v", err)
+		return e
+	}
+	if msg, ok := req.(protoV1.Message); ok {
+		return Validate(protoV1.MessageV2(msg))
+	}
+	return nil
+}
+
+// Validate checks msg and its set sub messages against the rules of their
+// fields, the err is an *Error
+func Validate(msg proto.Message) error {
+	e := &Error{}
+	validateMessage(msg.ProtoReflect(), "", e)
+	if len(e.Violations) == 0 {
+		return nil
+	}
+	return e
+}
+
+type fieldRules struct {
+	*FieldRules
+	re *regexp.Regexp
+}
+
+// protoreflect.FieldDescriptor -> *fieldRules, nil for the fields without rules
+var rulesCache = &sync.Map{}
+
+func rulesOf(fd protoreflect.FieldDescriptor) *fieldRules {
+	if r, ok := rulesCache.Load(fd); ok {
+		return r.(*fieldRules)
+	}
+	var rules *fieldRules
+	opts, ok := fd.Options().(*descriptorpb.FieldOptions)
+	if ok && opts != nil && proto.HasExtension(opts, E_Rules) {
+		rules = &fieldRules{FieldRules: proto.GetExtension(opts, E_Rules).(*FieldRules)}
+		if rules.Pattern != "" {
+			re, err := regexp.Compile(rules.Pattern)
+			if err != nil {
+				xlog.Error("_validate||invalid pattern ignored||field=%v||pattern=%v||err=%v", fd.FullName(), rules.Pattern, err)
+			}
+			rules.re = re
+		}
+	}
+	rulesCache.Store(fd, rules)
+	return rules
+}
+
+func fieldPath(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+func validateMessage(msg protoreflect.Message, prefix string, e *Error) {
+	fields := msg.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		path := fieldPath(prefix, string(fd.Name()))
+		rules := rulesOf(fd)
+		switch {
+		case fd.IsList():
+			list := msg.Get(fd).List()
+			if rules != nil {
+				checkSize(path, rules, list.Len(), e)
+			}
+			for j := 0; j < list.Len(); j++ {
+				itemPath := fmt.Sprintf("%v[%v]", path, j)
+				if fd.Message() != nil {
+					validateMessage(list.Get(j).Message(), itemPath, e)
+				} else if rules != nil {
+					checkValue(itemPath, fd, rules, list.Get(j), e)
+				}
+			}
+		case fd.IsMap():
+			m := msg.Get(fd).Map()
+			if rules != nil {
+				checkSize(path, rules, m.Len(), e)
+			}
+			if fd.MapValue().Message() != nil {
+				m.Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+					validateMessage(v.Message(), fmt.Sprintf("%v[%v]", path, k.String()), e)
+					return true
+				})
+			}
+		case fd.Message() != nil:
+			if !msg.Has(fd) {
+				if rules != nil && rules.Required {
+					e.add(path, "required")
+				}
+				continue
+			}
+			validateMessage(msg.Get(fd).Message(), path, e)
+		default:
+			if rules == nil {
+				continue
+			}
+			if !msg.Has(fd) {
+				if rules.Required {
+					e.add(path, "required")
+					continue
+				}
+				// unset optional and oneof fields
+				if fd.HasPresence() {
+					continue
+				}
+			}
+			checkValue(path, fd, rules, msg.Get(fd), e)
+		}
+	}
+}
+
+// checkSize checks the rules applying to lists and maps as a whole
+func checkSize(path string, rules *fieldRules, n int, e *Error) {
+	if rules.Required && n == 0 {
+		e.add(path, "required")
+		return
+	}
+	checkLen(path, rules, n, e)
+}
+
+func checkLen(path string, rules *fieldRules, n int, e *Error) {
+	if rules.MinLen != nil && uint64(n) < *rules.MinLen {
+		e.add(path, "length must be >= %v", *rules.MinLen)
+	}
+	if rules.MaxLen != nil && uint64(n) > *rules.MaxLen {
+		e.add(path, "length must be <= %v", *rules.MaxLen)
+	}
+}
+
+func checkRange(path string, rules *fieldRules, n float64, e *Error) {
+	if rules.Gte != nil && n < *rules.Gte {
+		e.add(path, "must be >= %v", *rules.Gte)
+	}
+	if rules.Lte != nil && n > *rules.Lte {
+		e.add(path, "must be <= %v", *rules.Lte)
+	}
+	if rules.Gt != nil && n <= *rules.Gt {
+		e.add(path, "must be > %v", *rules.Gt)
+	}
+	if rules.Lt != nil && n >= *rules.Lt {
+		e.add(path, "must be < %v", *rules.Lt)
+	}
+}
+
+func checkValue(path string, fd protoreflect.FieldDescriptor, rules *fieldRules, v protoreflect.Value, e *Error) {
+	switch fd.Kind() {
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		checkRange(path, rules, float64(v.Int()), e)
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		checkRange(path, rules, float64(v.Uint()), e)
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		checkRange(path, rules, v.Float(), e)
+	case protoreflect.StringKind:
+		s := v.String()
+		checkLen(path, rules, utf8.RuneCountInString(s), e)
+		if rules.re != nil && !rules.re.MatchString(s) {
+			e.add(path, "must match %v", rules.Pattern)
+		}
+	case protoreflect.BytesKind:
+		checkLen(path, rules, len(v.Bytes()), e)
+	case protoreflect.EnumKind:
+		if rules.DefinedOnly && fd.Enum().Values().ByNumber(v.Enum()) == nil {
+			e.add(path, "must be a defined enum value")
+		}
+	}
+}
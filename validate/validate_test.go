@@ -0,0 +1,141 @@
+package validate
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func ruledField(name string, num int32, typ descriptorpb.FieldDescriptorProto_Type, rules *FieldRules) *descriptorpb.FieldDescriptorProto {
+	fd := &descriptorpb.FieldDescriptorProto{
+		Name:   proto.String(name),
+		Number: proto.Int32(num),
+		Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		Type:   typ.Enum(),
+	}
+	if rules != nil {
+		fd.Options = &descriptorpb.FieldOptions{}
+		proto.SetExtension(fd.Options, E_Rules, rules)
+	}
+	return fd
+}
+
+// newTestMessage returns a dynamic message of
+//
+//	message User { string name = 1; int32 age = 2; Color color = 3; repeated string tags = 4; User friend = 5; }
+//
+// with rules on all the fields
+func newTestMessage(t *testing.T) protoreflect.MessageDescriptor {
+	tags := ruledField("tags", 4, descriptorpb.FieldDescriptorProto_TYPE_STRING, &FieldRules{MaxLen: proto.Uint64(2), Pattern: "^[a-z]+$"})
+	tags.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	color := ruledField("color", 3, descriptorpb.FieldDescriptorProto_TYPE_ENUM, &FieldRules{DefinedOnly: true})
+	color.TypeName = proto.String(".validate_test.Color")
+	friend := ruledField("friend", 5, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, nil)
+	friend.TypeName = proto.String(".validate_test.User")
+
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:       proto.String("validate_test.proto"),
+		Package:    proto.String("validate_test"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"validate/validate.proto"},
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String("Color"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: proto.String("UNKNOWN"), Number: proto.Int32(0)},
+				{Name: proto.String("RED"), Number: proto.Int32(1)},
+			},
+		}},
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("User"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				ruledField("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, &FieldRules{Required: true, MaxLen: proto.Uint64(4)}),
+				ruledField("age", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32, &FieldRules{Gte: proto.Float64(0), Lt: proto.Float64(150)}),
+				color,
+				tags,
+				friend,
+			},
+		}},
+	}, protoregistry.GlobalFiles)
+	assert.Nil(t, err)
+	return file.Messages().ByName("User")
+}
+
+func TestValidate(t *testing.T) {
+	md := newTestMessage(t)
+	fields := md.Fields()
+	newUser := func(name string, age int32) *dynamicpb.Message {
+		msg := dynamicpb.NewMessage(md)
+		if name != "" {
+			msg.Set(fields.ByName("name"), protoreflect.ValueOfString(name))
+		}
+		msg.Set(fields.ByName("age"), protoreflect.ValueOfInt32(age))
+		return msg
+	}
+
+	assert.Nil(t, Validate(newUser("bob", 20)))
+
+	// names are counted in runes
+	assert.Nil(t, Validate(newUser("世界你好", 20)))
+
+	msg := newUser("", 150)
+	msg.Set(fields.ByName("color"), protoreflect.ValueOfEnum(7))
+	tags := msg.Mutable(fields.ByName("tags")).List()
+	for _, tag := range []string{"a", "B", "c"} {
+		tags.Append(protoreflect.ValueOfString(tag))
+	}
+	msg.Set(fields.ByName("friend"), protoreflect.ValueOfMessage(newUser("alice", -1)))
+
+	err := Validate(msg)
+	assert.NotNil(t, err)
+	st := status.Convert(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	assert.Equal(t, 1, len(st.Details()))
+	badRequest := st.Details()[0].(*errdetails.BadRequest)
+	violations := map[string]string{}
+	for _, v := range badRequest.FieldViolations {
+		violations[v.Field] = v.Description
+	}
+	assert.Equal(t, map[string]string{
+		"name":        "required",
+		"age":         "must be < 150",
+		"color":       "must be a defined enum value",
+		"tags":        "length must be <= 2",
+		"tags[1]":     "must match ^[a-z]+$",
+		"friend.name": "length must be <= 4",
+		"friend.age":  "must be >= 0",
+	}, violations)
+}
+
+type selfValidated struct {
+	err error
+}
+
+func (r *selfValidated) Validate() error {
+	return r.err
+}
+
+func TestCheck(t *testing.T) {
+	assert.Nil(t, Check(&selfValidated{}))
+
+	err := Check(&selfValidated{err: errors.New("id and name both empty")})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, "invalid argument: id and name both empty", err.Error())
+
+	// grpc statuses are kept
+	err = Check(&selfValidated{err: status.Error(codes.NotFound, "no such user")})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// no rules
+	assert.Nil(t, Check(&errdetails.BadRequest{}))
+}